@@ -94,17 +94,28 @@ func main() {
 		die(errors.Wrap(err, "building validity map"))
 	}
 
-	key, err := certloader.LoadKeyFromFile(config)
-	if err != nil {
-		die(errors.Wrap(err, "loading key file"))
-	}
+	var certCaches []*certcache.CertCache
+	var certKeys []signer.CertKey
+	for _, chain := range config.CertChains() {
+		chainConfig := config.ForCertChain(chain)
+		key, err := certloader.LoadKeyFromFile(chainConfig)
+		if err != nil {
+			die(errors.Wrapf(err, "loading key file %s", chain.KeyFile))
+		}
 
-	var responder certcache.OCSPResponder = nil
-	if *flagDevelopment {
-		// Key is guaranteed to be ECDSA by signedexchange.ParsePrivateKey. This may change in future versions of SXG.
-		responder = fakeOCSPResponder{key: key.(*ecdsa.PrivateKey)}.Respond
+		var responder certcache.OCSPResponder = nil
+		if *flagDevelopment {
+			// Key is guaranteed to be ECDSA by signedexchange.ParsePrivateKey. This may change in future versions of SXG.
+			responder = fakeOCSPResponder{key: key.(*ecdsa.PrivateKey)}.Respond
+		}
+		certCache, err := certcache.PopulateCertCache(chainConfig, key, responder, *flagDevelopment || *flagInvalidCert, *flagAutoRenewCert)
+		if err != nil {
+			die(errors.Wrapf(err, "building cert cache for %s", chain.CertFile))
+		}
+		certCaches = append(certCaches, certCache)
+		certKeys = append(certKeys, signer.CertKey{CertHandler: certCache, Key: key})
 	}
-	certCache, err := certcache.PopulateCertCache(config, key, responder, *flagDevelopment || *flagInvalidCert, *flagAutoRenewCert)
+	certCache, err := certcache.NewMultiCertCache(certCaches, config.URLSet)
 	if err != nil {
 		die(errors.Wrap(err, "building cert cache"))
 	}
@@ -142,15 +153,45 @@ func main() {
 		}
 	}
 
+	var sxgCache *signer.SXGCache
+	if config.SXGCache != nil {
+		sxgCache, err = signer.NewSXGCache(config.SXGCache.MaxMemoryBytes, config.SXGCache.Dir, config.SXGCache.MaxDiskBytes)
+		if err != nil {
+			die(errors.Wrap(err, "building SXG cache"))
+		}
+	}
+
 	signerRequireHeaders := !*flagDevelopment
-	signer, err := signer.New(certCache, key, config.URLSet, rtvCache, certCache.IsHealthy,
-		overrideBaseURL, signerRequireHeaders, config.ForwardedRequestHeaders, time.Now)
+	packager, err := signer.New(signer.Options{
+		Certs:                   certKeys,
+		SignWithAllCerts:        config.SignWithAllCertChains,
+		URLSets:                 config.URLSet,
+		RTVCache:                rtvCache,
+		ShouldPackage:           certCache.IsHealthyFor,
+		OverrideBaseURL:         overrideBaseURL,
+		RequireHeaders:          signerRequireHeaders,
+		ForwardedRequestHeaders: config.ForwardedRequestHeaders,
+		SXGCache:                sxgCache,
+		Compression:             config.Compression,
+		CSPPolicy:               config.ContentSecurityPolicy,
+		Concurrency:             config.Concurrency,
+		Debug:                   config.Debug,
+	})
 	if err != nil {
 		die(errors.Wrap(err, "building signer"))
 	}
 
 	// TODO(twifkak): Make log output configurable.
 
+	handler := mux.New(certCache, packager, signer.NewExplainer(packager), validityMap, healthz, promhttp.Handler())
+	if config.FrontEnd != nil {
+		frontEnd, err := signer.NewFrontEnd(packager, config.FrontEnd)
+		if err != nil {
+			die(errors.Wrap(err, "building front end"))
+		}
+		handler = mux.NewFrontEnd(certCache, frontEnd, validityMap, healthz, promhttp.Handler())
+	}
+
 	addr := ""
 	if config.LocalOnly {
 		addr = "localhost"
@@ -160,7 +201,7 @@ func main() {
 		Addr: addr,
 		// Don't use DefaultServeMux, per
 		// https://blog.cloudflare.com/exposing-go-on-the-internet/.
-		Handler:           logIntercept{mux.New(certCache, signer, validityMap, healthz, promhttp.Handler())},
+		Handler:           logIntercept{handler},
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 		// If needing to stream the response, disable WriteTimeout and
@@ -181,7 +222,8 @@ func main() {
 
 	if *flagDevelopment {
 		log.Println("WARNING: Running in development, using SXG key for TLS. This won't work in production.")
-		log.Fatal(server.ListenAndServeTLS(config.CertFile, config.KeyFile))
+		tlsChain := config.CertChains()[0]
+		log.Fatal(server.ListenAndServeTLS(tlsChain.CertFile, tlsChain.KeyFile))
 	} else if *flagInvalidCert {
 		log.Println("WARNING: Running in production without valid signing certificate. Signed exchanges will not be valid.")
 		log.Fatal(server.ListenAndServe())
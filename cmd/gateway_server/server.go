@@ -39,7 +39,7 @@ type gatewayServer struct {
 	rtvCache *rtv.RTVCache
 }
 
-func shouldPackage() error {
+func shouldPackage(string) error {
 	return nil
 }
 
@@ -116,7 +116,13 @@ func (s *gatewayServer) GenerateSXG(ctx context.Context, request *pb.SXGRequest)
 		},
 	}
 
-	packager, err := signer.New(certCache, privateKey, urlSets, s.rtvCache, shouldPackage, signUrl, false, []string{}, time.Now)
+	packager, err := signer.New(signer.Options{
+		Certs:           []signer.CertKey{{CertHandler: certCache, Key: privateKey}},
+		URLSets:         urlSets,
+		RTVCache:        s.rtvCache,
+		ShouldPackage:   shouldPackage,
+		OverrideBaseURL: signUrl,
+	})
 
 	if err != nil {
 		return errorToSXGResponse(err), nil
@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/WICG/webpackage v0.0.0-20210623222345-39b429db6dac
 	github.com/ampproject/amphtml v0.0.0-20210802160724-a648a87e5643
+	github.com/andybalholm/brotli v1.0.4
 	github.com/go-acme/lego/v4 v4.4.0
 	github.com/gofrs/flock v0.8.1
 	github.com/golang/protobuf v1.5.2
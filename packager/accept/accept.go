@@ -3,23 +3,28 @@ package accept
 import (
 	"log"
 	"mime"
+	"strconv"
 	"strings"
 
 	"github.com/WICG/webpackage/go/signedexchange/version"
 	"github.com/ampproject/amppackager/packager/util"
 )
 
-// The SXG version that packager can produce. In the future, it may need to be
-// able to produce multiple versions.
+// The preferred SXG version that packager produces, as it appears in the v
+// parameter of the Content-Type.
 const AcceptedSxgVersion = "b3"
 
-// The Content-Type for the SXG version that the signer produces.
+// The Content-Type for the preferred SXG version.
 const SxgContentType = "application/signed-exchange;v=" + AcceptedSxgVersion
 
-// The enum of the SXG version that the signer produces, for passing to the
-// signedexchange library.
+// The enum of the preferred SXG version, for passing to the signedexchange
+// library.
 var SxgVersion = version.Version1b3
 
+// The SXG versions that packager can produce, in order of preference. Chrome
+// 73+ supports only b3; b2 is supported for older clients.
+var SupportedSxgVersions = []version.Version{version.Version1b3, version.Version1b2}
+
 // Tokenize a comma-separated string of accept patterns into a slice
 func tokenize(accept string) []string {
 	var tokens []string
@@ -52,30 +57,86 @@ func tokenize(accept string) []string {
 	return tokens
 }
 
-// Determine whether a version specified by the accept header matches the
-// version of signed exchange output by the packager
-func hasMatchingSxgVersion(versions []string) bool {
-	for _, version := range versions {
-		if version == AcceptedSxgVersion {
-			return true
+// Returns the supported SXG version with the given v parameter value (e.g.
+// "b3"), if any.
+func supportedSxgVersion(v string) (version.Version, bool) {
+	for _, supported := range SupportedSxgVersions {
+		if supported.MimeType() == "application/signed-exchange;v="+v {
+			return supported, true
 		}
 	}
-	return false
+	return "", false
 }
 
-// True if the given Accept header is one that the packager can satisfy. It
-// must contain application/signed-exchange;v=$V so that the packager knows
-// whether or not it can supply the correct version. "" and "*/*" are not
-// satisfiable, for this reason.
-func CanSatisfy(accept string) bool {
-	types := tokenize(accept)
-	for _, mediaRange := range types {
+// Returns the q-value of the given media range parameters, per
+// https://tools.ietf.org/html/rfc7231#section-5.3.1, or false if it's invalid.
+func qvalue(params map[string]string) (float64, bool) {
+	q, ok := params["q"]
+	if !ok {
+		return 1, true
+	}
+	parsed, err := strconv.ParseFloat(q, 64)
+	if err != nil || parsed < 0 || parsed > 1 {
+		return 0, false
+	}
+	return parsed, true
+}
+
+// Negotiate returns the SXG version that best satisfies the given Accept
+// header, or false if the client should be served the unsigned HTML instead.
+//
+// An SXG version is only chosen if it's explicitly listed, as in
+// application/signed-exchange;v=$V, so that the packager knows the client can
+// parse it; "" and "*/*" only accept HTML, for this reason. Of the listed
+// versions, the one with the highest q-value is chosen, with ties broken by
+// the order of SupportedSxgVersions. It's chosen only if its q-value is at
+// least that of HTML (i.e. text/html, text/*, or */*, whichever is most
+// specific). Ties go to the SXG, as crawlers commonly list both text/html and
+// SXG without q-values.
+func Negotiate(accept string) (version.Version, bool) {
+	sxgQs := map[version.Version]float64{}
+	// The q-value of HTML, and the specificity of the media range that set
+	// it: 1 for */*, 2 for text/*, 3 for text/html.
+	htmlQ, htmlSpecificity := 0.0, 0
+	for _, mediaRange := range tokenize(accept) {
 		mediatype, params, err := mime.ParseMediaType(mediaRange)
-		if err == nil && mediatype == "application/signed-exchange" {
-			if hasMatchingSxgVersion(strings.Split(params["v"], ",")) {
-				return true
+		if err != nil {
+			continue
+		}
+		q, ok := qvalue(params)
+		if !ok {
+			continue
+		}
+		switch mediatype {
+		case "application/signed-exchange":
+			for _, v := range strings.Split(params["v"], ",") {
+				if sxgVersion, ok := supportedSxgVersion(strings.TrimSpace(v)); ok && q > sxgQs[sxgVersion] {
+					sxgQs[sxgVersion] = q
+				}
 			}
+		case "text/html", "text/*", "*/*":
+			specificity := map[string]int{"*/*": 1, "text/*": 2, "text/html": 3}[mediatype]
+			if specificity > htmlSpecificity || (specificity == htmlSpecificity && q > htmlQ) {
+				htmlQ, htmlSpecificity = q, specificity
+			}
+		}
+	}
+	var best version.Version
+	bestQ := 0.0
+	for _, supported := range SupportedSxgVersions {
+		if sxgQs[supported] > bestQ {
+			best, bestQ = supported, sxgQs[supported]
 		}
 	}
-	return false
+	if bestQ > 0 && bestQ >= htmlQ {
+		return best, true
+	}
+	return "", false
+}
+
+// True if the given Accept header is one that the packager can satisfy with
+// an SXG. See Negotiate.
+func CanSatisfy(accept string) bool {
+	_, ok := Negotiate(accept)
+	return ok
 }
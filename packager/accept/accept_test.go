@@ -3,6 +3,7 @@ package accept
 import (
 	"testing"
 
+	"github.com/WICG/webpackage/go/signedexchange/version"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,8 +11,8 @@ func TestCanSatisfy(t *testing.T) {
 	assert.False(t, CanSatisfy(""))
 	assert.False(t, CanSatisfy("*/*"))
 	assert.False(t, CanSatisfy("image/jpeg;v=b3"))
-	assert.False(t, CanSatisfy(`application/signed-exchange;v=b2`))
-	assert.False(t, CanSatisfy(`application/signed-exchange;v="b1,b2"`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;v=b1`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;v="b1,b4"`))
 	assert.False(t, CanSatisfy(`application/signed-exchange;x="y,application/signed-exchange;v=b3,z";v=b1`))
 
 	assert.True(t, CanSatisfy(`application/signed-exchange;v=b3`))
@@ -25,3 +26,42 @@ func TestCanSatisfy(t *testing.T) {
 	assert.True(t, CanSatisfy("*/* \t,\t application/signed-exchange;v=b3"))
 	assert.True(t, CanSatisfy(`application/signed-exchange;x="a,b";v="b3"`))
 }
+
+func assertNegotiates(t *testing.T, expected version.Version, accept string) {
+	actual, ok := Negotiate(accept)
+	assert.True(t, ok, "for %s", accept)
+	assert.Equal(t, expected, actual, "for %s", accept)
+}
+
+func assertNegotiatesHTML(t *testing.T, accept string) {
+	actual, ok := Negotiate(accept)
+	assert.False(t, ok, "for %s; got %s", accept, actual)
+}
+
+func TestNegotiate(t *testing.T) {
+	assertNegotiates(t, version.Version1b3, `application/signed-exchange;v=b3`)
+	assertNegotiates(t, version.Version1b2, `application/signed-exchange;v=b2`)
+	// Ties are broken by preference.
+	assertNegotiates(t, version.Version1b3, `application/signed-exchange;v="b2,b3"`)
+	assertNegotiates(t, version.Version1b3, `application/signed-exchange;v=b2,application/signed-exchange;v=b3`)
+	// Otherwise, by q-value.
+	assertNegotiates(t, version.Version1b2, `application/signed-exchange;v=b2;q=0.9,application/signed-exchange;v="b3,b4";q=0.8`)
+	assertNegotiates(t, version.Version1b3, `application/signed-exchange;v=b2;q=0.1,application/signed-exchange;v=b3;q=0.2`)
+
+	// SXG vs HTML.
+	assertNegotiates(t, version.Version1b3, `text/html,application/signed-exchange;v=b3`)
+	assertNegotiates(t, version.Version1b3, `application/signed-exchange;v=b3;q=0.9,*/*;q=0.8`)
+	assertNegotiates(t, version.Version1b3, `text/html;q=0.5,*/*,application/signed-exchange;v=b3;q=0.6`)
+	assertNegotiatesHTML(t, `text/html,application/signed-exchange;v=b3;q=0.9`)
+	assertNegotiatesHTML(t, `text/*,application/signed-exchange;v=b3;q=0.9`)
+	assertNegotiatesHTML(t, `text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7`)
+	// text/html takes precedence over less specific ranges.
+	assertNegotiatesHTML(t, `text/html;q=0.8,*/*;q=0.1,application/signed-exchange;v=b3;q=0.5`)
+
+	// Invalid or zero q-values.
+	assertNegotiatesHTML(t, `application/signed-exchange;v=b3;q=0`)
+	assertNegotiatesHTML(t, `application/signed-exchange;v=b3;q=2`)
+	assertNegotiatesHTML(t, `application/signed-exchange;v=b3;q=x`)
+	assertNegotiatesHTML(t, "")
+	assertNegotiatesHTML(t, "*/*")
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// Given the path of an OCSP cache file, returns the Updateable that stores it.
+type storageFactory func(path string) Updateable
+
+// The registry of Updateable implementations that can be selected by
+// OCSPStorage.Backend. Each returns a storageFactory for the given config, so
+// that clients are shared among all of the cert chains' OCSP caches.
+var storageBackends = map[string]func(*util.OCSPStorageConfig) (storageFactory, error){
+	util.OCSPStorageFile: func(*util.OCSPStorageConfig) (storageFactory, error) {
+		return newLocalFileStorage, nil
+	},
+	util.OCSPStorageMemory: func(*util.OCSPStorageConfig) (storageFactory, error) {
+		return func(string) Updateable { return &InMemory{} }, nil
+	},
+	util.OCSPStorageRedis: newRedisStorage,
+	util.OCSPStorageS3:    newS3Storage,
+}
+
+// The default storage: an in-memory copy of a local file.
+func newLocalFileStorage(path string) Updateable {
+	return &Chained{first: &InMemory{}, second: &LocalFile{path: path}}
+}
+
+// Returns the storageFactory for the given config.
+func newStorageFactory(config *util.OCSPStorageConfig) (storageFactory, error) {
+	newBackend, ok := storageBackends[config.Backend]
+	if !ok {
+		return nil, errors.Errorf("unknown OCSP storage backend %q", config.Backend)
+	}
+	return newBackend(config)
+}
+
+// Stores the OCSP responses per the given config, rather than in local files.
+// Must be called before Init.
+func (this *CertCache) setOCSPStorage(config *util.OCSPStorageConfig) error {
+	newOCSPFile, err := newStorageFactory(config)
+	if err != nil {
+		return err
+	}
+	this.newOCSPFile = newOCSPFile
+	this.ocspFile = newOCSPFile(this.ocspFilePath)
+	return nil
+}
+
+// A single file on a remote store that supports a lease, for coordinating
+// updates among replicas, and a conditional write.
+type remoteFile interface {
+	// Returns the contents of the file, or nil if it doesn't exist, plus
+	// an opaque version to pass to put.
+	get(ctx context.Context) ([]byte, string, error)
+	// Takes the lease for the given duration, if it's not held by anyone
+	// else. Returns a non-empty token identifying the holder if so.
+	acquire(ctx context.Context, duration time.Duration) (string, error)
+	// Writes the file, if the lease identified by token is still held and
+	// the file is still at the given version.
+	put(ctx context.Context, token string, version string, contents []byte) error
+	// Releases the lease identified by token, if it's still held.
+	release(ctx context.Context, token string) error
+}
+
+// How often a replica waiting on another's update checks for it.
+const leasePollInterval = time.Second
+
+// An Updateable backed by a remoteFile. As with LocalFile, update() is only
+// called by the replica that holds the lease; any others return the existing
+// contents, if any, or else wait for the holder to write them. Unlike a file
+// lock, the lease expires if its holder dies, so a crashed replica doesn't
+// block the others for longer than leaseDuration.
+type leasedFile struct {
+	name          string
+	remote        remoteFile
+	leaseDuration time.Duration
+}
+
+func (this *leasedFile) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error) {
+	contents, _, err := this.remote.get(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", this.name)
+	}
+	if !isExpired(contents) {
+		return contents, nil
+	}
+	// Wait for up to two leases: one held by another replica that may
+	// have died, and then our own attempt.
+	deadline := time.Now().Add(2 * this.leaseDuration)
+	for {
+		token, err := this.remote.acquire(ctx, this.leaseDuration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "acquiring lease for %s", this.name)
+		}
+		if token != "" {
+			return this.updateWithLease(ctx, token, isExpired, update)
+		}
+		if len(contents) > 0 {
+			// Another replica is updating it; use the existing
+			// contents in the meantime.
+			return contents, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for another replica to write %s", this.name)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "while waiting for %s", this.name)
+		case <-time.After(leasePollInterval):
+		}
+		if contents, _, err = this.remote.get(ctx); err != nil {
+			return nil, errors.Wrapf(err, "rereading %s", this.name)
+		}
+		if !isExpired(contents) {
+			return contents, nil
+		}
+	}
+}
+
+func (this *leasedFile) updateWithLease(ctx context.Context, token string, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error) {
+	defer func() {
+		if err := this.remote.release(ctx, token); err != nil {
+			log.Printf("Error releasing lease for %s; %+v", this.name, err)
+		}
+	}()
+	// Reread the file while holding the lease, in case another replica
+	// updated it between our read and acquire.
+	contents, version, err := this.remote.get(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "rereading %s", this.name)
+	}
+	if !isExpired(contents) {
+		return contents, nil
+	}
+	contents, _ = update(contents)
+	if err := this.remote.put(ctx, token, version, contents); err != nil {
+		return nil, errors.Wrapf(err, "writing %s", this.name)
+	}
+	return contents, nil
+}
+
+// Returns a random token identifying a lease holder.
+func newLeaseToken() (string, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", errors.Wrap(err, "generating lease token")
+	}
+	return hex.EncodeToString(token[:]), nil
+}
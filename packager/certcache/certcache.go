@@ -20,8 +20,6 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/base64"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -77,7 +75,8 @@ type CertHandler interface {
 }
 
 type CertCache struct {
-	// TODO(twifkak): Support multiple cert chains (for different domains, for different roots).
+	// A CertCache holds a single cert chain (plus its pending renewal). Use
+	// MultiCertCache to serve multiple chains, e.g. for different domains.
 	certName string
 	certsMu  sync.RWMutex
 	certs    []*x509.Certificate
@@ -89,10 +88,13 @@ type CertCache struct {
 	ocspUpdateAfterMu sync.RWMutex
 	ocspUpdateAfter   time.Time
 	stop              chan struct{}
-	// TODO(twifkak): Implement a registry of Updateable instances which can be configured in the toml.
+	// The current chain's OCSP cache.
 	ocspFile     Updateable
 	ocspFilePath string
 	client       http.Client
+	// Creates the Updateable for an OCSP cache path, per the configured
+	// OCSPStorage.Backend; see storageBackends.
+	newOCSPFile storageFactory
 	// Given a certificate, returns a current OCSP response for the cert;
 	// this is a fallback, called when in development mode and there is no
 	// OCSP URL.
@@ -104,12 +106,26 @@ type CertCache struct {
 	// Is CertCache initialized to do cert renewal or OCSP refreshes?
 	isInitialized bool
 
+	// renewedCerts, as served ahead of the switch. Guarded by renewedCertsMu.
+	renewal *servedChain
+	// Chains replaced by renewals, still served until their SXGs expire.
+	retiredMu sync.RWMutex
+	retired   []*servedChain
+	// The name of the last cert that OCSP reported revoked.
+	revokedMu       sync.RWMutex
+	revokedCertName string
+	// Serializes replaceRevokedCert.
+	reissueMu sync.Mutex
+
 	// "Virtual methods", exposed for testing.
-	// Given a certificate, returns the OCSP responder URL for that cert.
-	extractOCSPServer func(*x509.Certificate) (string, error)
+	// Given a certificate, returns the OCSP responder URLs for that cert,
+	// in order of preference.
+	extractOCSPServers func(*x509.Certificate) ([]string, error)
 	// Given an HTTP request/response, returns its cache expiry.
 	httpExpiry func(*http.Request, *http.Response) time.Time
 	timeNow    func() time.Time
+	// Requests a new cert from the CA. Nil if certFetcher is not set.
+	reissueCert func() ([]*x509.Certificate, error)
 }
 
 // Callers need to call Init() on the returned CertCache before the cache can auto-renew certs.
@@ -127,7 +143,7 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 	if len(certs) > 0 && certs[0] != nil {
 		certName = util.CertName(certs[0])
 	}
-	return &CertCache{
+	certCache := &CertCache{
 		certName:        certName,
 		certs:           certs,
 		certFetcher:     certFetcher,
@@ -141,17 +157,18 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 		//    certificate, all needing to staple an OCSP response. You don't
 		//    want to have all of them hammering the OCSP server - ideally,
 		//    you'd have one request, in the backend, and updating them all.
-		ocspFile:             &Chained{first: &InMemory{}, second: &LocalFile{path: ocspCache}},
+		ocspFile:             newLocalFileStorage(ocspCache),
 		ocspFilePath:         ocspCache,
+		newOCSPFile:          newLocalFileStorage,
 		stop:                 make(chan struct{}),
 		generateOCSPResponse: generateOCSPResponse,
 		client:               http.Client{Timeout: 60 * time.Second},
-		extractOCSPServer: func(cert *x509.Certificate) (string, error) {
+		extractOCSPServers: func(cert *x509.Certificate) ([]string, error) {
 			if cert == nil || len(cert.OCSPServer) < 1 {
-				return "", errors.New("Cert missing OCSPServer.")
+				return nil, errors.New("Cert missing OCSPServer.")
 			}
-			// This is a URI, per https://tools.ietf.org/html/rfc5280#section-4.2.2.1.
-			return cert.OCSPServer[0], nil
+			// These are URIs, per https://tools.ietf.org/html/rfc5280#section-4.2.2.1.
+			return cert.OCSPServer, nil
 		},
 		httpExpiry: func(req *http.Request, resp *http.Response) time.Time {
 			reasons, expiry, err := cachecontrol.CachableResponse(req, resp, cachecontrol.Options{PrivateCache: true})
@@ -167,14 +184,18 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 		isInitialized: false,
 		timeNow:       timeNow,
 	}
+	if certFetcher != nil {
+		certCache.reissueCert = certFetcher.FetchNewCert
+	}
+	return certCache
 }
 
 func (this *CertCache) Init() error {
 	this.updateCertIfNecessary()
+	this.loadRetired()
 
 	// Prime the OCSP disk and memory cache, so we can start serving immediately.
-	_, _, err := this.readOCSP(true)
-	if err != nil {
+	if err := this.updateOCSP(); err != nil {
 		return errors.Wrap(err, "initializing CertCache")
 	}
 	// Update OCSP in the background, per sleevi requirements:
@@ -246,9 +267,12 @@ func (this *CertCache) GetLatestCert() *x509.Certificate {
 func (this *CertCache) createCertChainCBOR(ocsp []byte) ([]byte, error) {
 	this.certsMu.RLock()
 	defer this.certsMu.RUnlock()
+	return certChainCBOR(this.certs, ocsp)
+}
 
-	certChain := make(certurl.CertChain, len(this.certs))
-	for i, cert := range this.certs {
+func certChainCBOR(certs []*x509.Certificate, ocsp []byte) ([]byte, error) {
+	certChain := make(certurl.CertChain, len(certs))
+	for i, cert := range certs {
 		certChain[i] = &certurl.AugmentedCertificate{Cert: cert}
 	}
 	certChain[0].OCSPResponse = ocsp
@@ -273,49 +297,82 @@ func (this *CertCache) ocspMidpoint(resp *ocsp.Response) time.Time {
 	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
 }
 
+// Returns true iff this cache serves the cert chain of the given name: the
+// current one, or a retired or renewal chain.
+func (this *CertCache) hasCertName(certName string) bool {
+	this.certsMu.RLock()
+	isCurrent := certName == this.certName
+	this.certsMu.RUnlock()
+	return isCurrent || this.servedChainNamed(certName) != nil
+}
+
 func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	params := mux.Params(req)
 
+	if chain := this.servedChainNamed(params["certName"]); chain != nil {
+		ocsp, err := this.readChainOCSP(chain)
+		if err != nil {
+			util.NewHTTPError(http.StatusInternalServerError, "Error reading OCSP: ", err).LogAndRespond(resp)
+			return
+		}
+		this.writeCertChain(resp, req, chain.certs, this.findIssuerUsingCerts(chain.certs), ocsp)
+		return
+	}
+
+	// Read before locking certsMu, as updateCertIfNecessary locks
+	// renewedCertsMu first.
+	renewal := this.getRenewalChain()
+
 	// RLock for the certName
 	this.certsMu.RLock()
 	defer this.certsMu.RUnlock()
 	if params["certName"] == this.certName {
-		// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.3
-		// This content-type is not standard, but included to reduce
-		// the chance that faulty user agents employ content sniffing.
-		resp.Header().Set("Content-Type", "application/cert-chain+cbor")
-		// Instruct the intermediary to reload this cert-chain at the
-		// OCSP midpoint, in case it cannot parse it.
 		ocsp, _, err := this.readOCSP(false)
 		if err != nil {
 			util.NewHTTPError(http.StatusInternalServerError, "Error reading OCSP: ", err).LogAndRespond(resp)
 			return
 		}
-		ocspResp, err := this.parseOCSP(ocsp, this.findIssuer())
-		if err != nil {
-			log.Println("Invalid OCSP:", err)
-			util.NewHTTPError(http.StatusInternalServerError, "Invalid OCSP: ", err).LogAndRespond(resp)
-			return
-		}
-		midpoint := this.ocspMidpoint(ocspResp)
-		// int is large enough to represent 24855 days in seconds.
-		expiry := int(midpoint.Sub(this.timeNow()).Seconds())
-		if expiry < 0 {
-			expiry = 0
+		if renewal != nil {
+			// Publish the renewal's cert-url ahead of the switch, so
+			// that caches can prefetch it. It's relative to this one.
+			resp.Header().Set("Link", "<"+url.PathEscape(renewal.certName)+`>;rel="prefetch"`)
 		}
-		resp.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(expiry))
-		resp.Header().Set("X-Content-Type-Options", "nosniff")
-		cbor, err := this.createCertChainCBOR(ocsp)
-		if err != nil {
-			util.NewHTTPError(http.StatusInternalServerError, "Error building cert chain: ", err).LogAndRespond(resp)
-			return
-		}
-		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(cbor))
+		this.writeCertChain(resp, req, this.certs, this.findIssuer(), ocsp)
 	} else {
 		http.NotFound(resp, req)
 	}
 }
 
+// Writes the given cert chain, with the given OCSP response for its leaf.
+func (this *CertCache) writeCertChain(resp http.ResponseWriter, req *http.Request, certs []*x509.Certificate, issuer *x509.Certificate, ocspBytes []byte) {
+	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.3
+	// This content-type is not standard, but included to reduce
+	// the chance that faulty user agents employ content sniffing.
+	resp.Header().Set("Content-Type", "application/cert-chain+cbor")
+	// Instruct the intermediary to reload this cert-chain at the
+	// OCSP midpoint, in case it cannot parse it.
+	ocspResp, err := ocsp.ParseResponseForCert(ocspBytes, certs[0], issuer)
+	if err != nil {
+		log.Println("Invalid OCSP:", err)
+		util.NewHTTPError(http.StatusInternalServerError, "Invalid OCSP: ", err).LogAndRespond(resp)
+		return
+	}
+	midpoint := this.ocspMidpoint(ocspResp)
+	// int is large enough to represent 24855 days in seconds.
+	expiry := int(midpoint.Sub(this.timeNow()).Seconds())
+	if expiry < 0 {
+		expiry = 0
+	}
+	resp.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(expiry))
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	cbor, err := certChainCBOR(certs, ocspBytes)
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error building cert chain: ", err).LogAndRespond(resp)
+		return
+	}
+	http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(cbor))
+}
+
 // If we've been unable to fetch a fresh OCSP response before expiry of the old
 // one, or, at server start-up, if we're unable to fetch a valid OCSP request at
 // all (either from disk or network), then return false. This signals to the
@@ -344,10 +401,15 @@ func (this *CertCache) isHealthy(ocspResp []byte) error {
 	if issuer == nil {
 		return errors.New("Cannot find issuer certificate in CertFile.")
 	}
-	resp, err := ocsp.ParseResponseForCert(ocspResp, this.getCert(), issuer)
+	cert := this.getCert()
+	resp, err := ocsp.ParseResponseForCert(ocspResp, cert, issuer)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing OCSP response")
 	}
+	if resp.Status == ocsp.Revoked {
+		return errors.Wrapf(errCertRevoked, "OCSP reports cert %s revoked at %v (reason %d)",
+			util.CertName(cert), resp.RevokedAt, resp.RevocationReason)
+	}
 	if resp.NextUpdate.Before(this.timeNow()) {
 		return errors.Errorf("Cached OCSP is stale, NextUpdate: %v", resp.NextUpdate)
 	}
@@ -359,8 +421,9 @@ func (this *CertCache) readOCSPHelper(numTries int, exhaustedRetries bool) ([]by
 
 	this.certsMu.RLock()
 	defer this.certsMu.RUnlock()
-	ocsp, err := this.ocspFile.Read(context.Background(), this.shouldUpdateOCSP, func(orig []byte) []byte {
-		return this.fetchOCSP(orig, this.certs, &ocspUpdateAfter, numTries > 0)
+	ctx := context.Background()
+	ocsp, err := this.ocspFile.Read(ctx, this.shouldUpdateOCSP, func(orig []byte) ([]byte, string) {
+		return this.fetchOCSP(ctx, orig, this.certs, &ocspUpdateAfter, numTries > 0)
 	})
 	if err != nil {
 		if exhaustedRetries {
@@ -377,7 +440,11 @@ func (this *CertCache) readOCSPHelper(numTries int, exhaustedRetries bool) ([]by
 		}
 	}
 	if err := this.isHealthy(ocsp); err != nil {
-		if exhaustedRetries {
+		if errors.Cause(err) == errCertRevoked {
+			this.setRevoked(this.certName, err)
+			// Retrying won't unrevoke the cert.
+			return nil, time.Time{}, errors.Wrap(err, "OCSP failed health check")
+		} else if exhaustedRetries {
 			return nil, time.Time{}, errors.Wrap(err, "OCSP failed health check")
 		} else {
 			return nil, time.Time{}, nil
@@ -427,6 +494,16 @@ func (this *CertCache) readOCSP(allowRetries bool) ([]byte, time.Time, error) {
 
 }
 
+// Refreshes the OCSP response if necessary, with retries. If it reports the
+// cert revoked and auto-renewal is configured, replaces the cert.
+func (this *CertCache) updateOCSP() error {
+	_, _, err := this.readOCSP(true)
+	if errors.Cause(err) == errCertRevoked && this.reissueCert != nil {
+		err = this.replaceRevokedCert()
+	}
+	return err
+}
+
 // Print # of retries, wait for specified time and returned updated wait time.
 func waitForSpecifiedTime(waitTimeInMinutes int, numRetries int) int {
 	log.Printf("Retrying OCSP server: retry #%d", numRetries)
@@ -459,10 +536,10 @@ func (this *CertCache) maintainOCSP() {
 	for {
 		select {
 		case <-ticker.C:
-			_, _, err := this.readOCSP(true)
-			if err != nil {
+			if err := this.updateOCSP(); err != nil {
 				log.Println("Warning: OCSP update failed. Cached response may expire:", err)
 			}
+			this.maintainServedChains()
 		case <-this.stop:
 			ticker.Stop()
 			return
@@ -554,101 +631,105 @@ func (this *CertCache) findIssuerUsingCerts(certs []*x509.Certificate) *x509.Cer
 	return nil
 }
 
-// Queries the OCSP responder for this cert and return the OCSP response.
-func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpdateAfter *time.Time, isRetry bool) []byte {
+// Queries the OCSP responders for this cert and returns the OCSP response and
+// the responder that returned it, or orig and "" if none of them returned a
+// valid one. On retry, only POST is used.
+func (this *CertCache) fetchOCSP(ctx context.Context, orig []byte, certs []*x509.Certificate, ocspUpdateAfter *time.Time, isRetry bool) ([]byte, string) {
 	issuer := this.findIssuerUsingCerts(certs)
 	if issuer == nil {
 		log.Println("Cannot find issuer certificate in CertFile.")
-		return orig
+		return orig, ""
 	}
 	// The default SHA1 hash function is mandated by the Lightweight OCSP
 	// Profile, https://tools.ietf.org/html/rfc5019 2.1.1 (sleevi #4, see above).
 	req, err := ocsp.CreateRequest(certs[0], issuer, nil)
 	if err != nil {
 		log.Println("Error creating OCSP request:", err)
-		return orig
+		return orig, ""
 	}
 
-	ocspServer, err := this.extractOCSPServer(certs[0])
+	ocspServers, err := this.extractOCSPServers(certs[0])
 	if err != nil {
 		if this.generateOCSPResponse == nil {
 			log.Println("Error extracting OCSP server:", err)
-			return orig
+			return orig, ""
 		}
 		log.Println("Cert lacks OCSP URL; using fake OCSP in development mode.")
 		resp, err := this.generateOCSPResponse(certs[0])
 		if err != nil {
 			log.Println("error generating fake OCSP response:", err)
-			return orig
+			return orig, ""
 		}
-		return resp
-	}
-
-	// Conform to the Lightweight OCSP Profile, by preferring GET over POST
-	// if the request is small enough (sleevi #4, see above).
-	// https://tools.ietf.org/html/rfc2560#appendix-A.1.1 describes how the
-	// URL should be formed.
-	// https://tools.ietf.org/html/rfc5019#section-5 shows an example where
-	// the base64 encoding includes '/' and '=' (and therefore should be
-	// StdEncoding).
-	getURL := ocspServer + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(req))
-	var httpReq *http.Request
-	// Logic is a fallback, due to some CAs not responding as expected to a GET.
-	if len(getURL) <= 255 && !isRetry {
-		httpReq, err = http.NewRequest("GET", getURL, nil)
-		if err != nil {
-			log.Println("Error creating OCSP response:", err)
-			return orig
+		return resp, ""
+	}
+
+	// Try each responder in turn, in case one is down or serving invalid
+	// responses.
+	for _, ocspServer := range ocspServers {
+		// Conform to the Lightweight OCSP Profile, by preferring GET over
+		// POST if the request is small enough (sleevi #4, see above).
+		// https://tools.ietf.org/html/rfc2560#appendix-A.1.1 describes how
+		// the URL should be formed.
+		// https://tools.ietf.org/html/rfc5019#section-5 shows an example
+		// where the base64 encoding includes '/' and '=' (and therefore
+		// should be StdEncoding).
+		getURL := ocspServer + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(req))
+		methods := []string{http.MethodPost}
+		// POST is a fallback, due to some CAs not responding as expected
+		// to a GET.
+		if len(getURL) <= 255 && !isRetry {
+			methods = []string{http.MethodGet, http.MethodPost}
 		}
-	} else {
-		httpReq, err = http.NewRequest("POST", ocspServer, bytes.NewReader(req))
-		if err != nil {
-			log.Println("Error creating OCSP response:", err)
-			return orig
+		for _, method := range methods {
+			var httpReq *http.Request
+			if method == http.MethodGet {
+				httpReq, err = http.NewRequest(method, getURL, nil)
+			} else {
+				httpReq, err = http.NewRequest(method, ocspServer, bytes.NewReader(req))
+			}
+			if err != nil {
+				log.Println("Error creating OCSP request:", err)
+				continue
+			}
+			if method == http.MethodPost {
+				httpReq.Header.Set("Content-Type", "application/ocsp-request")
+			}
+			respBytes, expiry, err := this.fetchOCSPFrom(ocspServer, httpReq.WithContext(ctx), certs[0], issuer)
+			if err != nil {
+				log.Printf("Error fetching OCSP from %s by %s: %s", ocspServer, method, err)
+				continue
+			}
+			*ocspUpdateAfter = expiry
+			return respBytes, ocspServer
 		}
-		httpReq.Header.Set("Content-Type", "application/ocsp-request")
-	}
-
-	httpResp, err := this.client.Do(httpReq)
-	if err != nil {
-		log.Println("Error issuing OCSP request:", err)
-		return orig
-	}
-	if httpResp.Body != nil {
-		defer httpResp.Body.Close()
-	}
-
-	// If cache-control headers indicate a response that is not ever
-	// cacheable, then ignore them. Otherwise, allow them to indicate an
-	// expiry earlier than we'd usually follow.
-	*ocspUpdateAfter = this.httpExpiry(httpReq, httpResp)
-
-	respBytes, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseBytes))
-	if err != nil {
-		log.Println("Error reading OCSP response:", err)
-		return orig
 	}
+	log.Println("No OCSP responder returned a valid response.")
+	return orig, ""
+}
 
+// Validates the given OCSP response for cert.
+func (this *CertCache) validateOCSPResponse(respBytes []byte, cert, issuer *x509.Certificate) error {
 	// Validate the response, per sleevi requirement:
 	// 2. Validate the server responses to make sure it is something the client will accept.
 	// and also per sleevi #4 (see above), as required by
 	// https://tools.ietf.org/html/rfc5019#section-2.2.2.
-	resp, err := ocsp.ParseResponseForCert(respBytes, certs[0], issuer)
+	resp, err := ocsp.ParseResponseForCert(respBytes, cert, issuer)
 	if err != nil {
-		log.Println("Error parsing OCSP response:", err)
-		return orig
+		return errors.Wrap(err, "parsing OCSP response")
 	}
-	if resp.Status != ocsp.Good {
-		log.Println("Invalid OCSP status:", resp.Status)
-		return orig
+	if resp.Status == ocsp.Revoked {
+		// Cache it, so that isHealthy fails on this and other replicas,
+		// and they stop signing with the cert. readOCSPHelper raises
+		// the alarm.
+		log.Printf("OCSP reports cert %s revoked at %v", util.CertName(cert), resp.RevokedAt)
+	} else if resp.Status != ocsp.Good {
+		return errors.Errorf("invalid OCSP status: %d", resp.Status)
 	}
 	if resp.ThisUpdate.After(this.timeNow()) {
-		log.Println("OCSP thisUpdate in the future:", resp.ThisUpdate)
-		return orig
+		return errors.Errorf("OCSP thisUpdate in the future: %v", resp.ThisUpdate)
 	}
 	if resp.NextUpdate.Before(this.timeNow()) {
-		log.Println("OCSP nextUpdate in the past:", resp.NextUpdate)
-		return orig
+		return errors.Errorf("OCSP nextUpdate in the past: %v", resp.NextUpdate)
 	}
 	for _, test := range []struct {
 		name  string
@@ -658,23 +739,20 @@ func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpd
 		{"nextUpdate", resp.NextUpdate},
 		{"producedAt", resp.ProducedAt},
 	} {
-		if test.value.Before(certs[0].NotBefore) {
-			log.Printf("OCSP %s %+v before certificate notBefore %+v", test.name, test.value, certs[0].NotBefore)
-			return orig
+		if test.value.Before(cert.NotBefore) {
+			return errors.Errorf("OCSP %s %+v before certificate notBefore %+v", test.name, test.value, cert.NotBefore)
 		}
-		if test.value.After(certs[0].NotAfter) {
-			log.Printf("OCSP %s %+v after certificate notAfter %+v", test.name, test.value, certs[0].NotAfter)
-			return orig
+		if test.value.After(cert.NotAfter) {
+			return errors.Errorf("OCSP %s %+v after certificate notAfter %+v", test.name, test.value, cert.NotAfter)
 		}
 	}
 	// OCSP duration must be <=7 days, per
 	// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#cross-origin-trust.
 	// Serving these responses may cause UAs to reject the SXG.
 	if resp.NextUpdate.Sub(resp.ThisUpdate) > time.Hour*24*7 {
-		log.Printf("OCSP nextUpdate %+v too far ahead of thisUpdate %+v", resp.NextUpdate, resp.ThisUpdate)
-		return orig
+		return errors.Errorf("OCSP nextUpdate %+v too far ahead of thisUpdate %+v", resp.NextUpdate, resp.ThisUpdate)
 	}
-	return respBytes
+	return nil
 }
 
 // Checks for cert updates every certCheckInterval hours. Terminates only when stop
@@ -731,6 +809,18 @@ func (this *CertCache) getRenewalCert() *x509.Certificate {
 func (this *CertCache) setCerts(certs []*x509.Certificate) {
 	this.certsMu.Lock()
 	defer this.certsMu.Unlock()
+	if len(this.certs) > 0 && this.certs[0] != nil && this.certName != util.CertName(certs[0]) {
+		if this.isRevokedName(this.certName) {
+			// Not retired, so that SXGs signed with it stop
+			// validating as soon as caches refetch its cert-url.
+			// If it was revoked, it no longer affects signing.
+			promCertRevoked.DeleteLabelValues(this.certName)
+		} else {
+			// SXGs signed with the old chain still refer to its
+			// cert-url.
+			this.retire(this.certs)
+		}
+	}
 	this.certs = certs
 	this.certName = util.CertName(certs[0])
 
@@ -750,6 +840,10 @@ func (this *CertCache) setNewCerts(certs []*x509.Certificate) {
 	defer this.renewedCertsMu.Unlock()
 	this.renewedCerts = certs
 
+	if this.renewal != nil {
+		certloader.RemoveFile(this.renewal.ocspFilePath)
+		this.renewal = nil
+	}
 	if this.renewedCerts == nil {
 		this.renewedCertName = ""
 		err := certloader.RemoveFile(this.NewCertFile)
@@ -759,6 +853,7 @@ func (this *CertCache) setNewCerts(certs []*x509.Certificate) {
 		return
 	}
 	this.renewedCertName = util.CertName(certs[0])
+	this.renewal = this.newServedChain(certs, infiniteFuture)
 
 	err := certloader.WriteCertsToFile(this.renewedCerts, this.NewCertFile)
 	if err != nil {
@@ -777,6 +872,14 @@ func (this *CertCache) updateCertIfNecessary() {
 		this.reloadCertIfExpired()
 		return
 	}
+	if this.isRevoked() {
+		// Retry, in case replacing it failed when the revocation was
+		// first seen.
+		if err := this.replaceRevokedCert(); err != nil {
+			log.Println("Error replacing revoked cert:", err)
+		}
+		return
+	}
 	d := time.Duration(0)
 	err := errors.New("")
 	if this.hasCert() {
@@ -834,7 +937,7 @@ func (this *CertCache) updateCertIfNecessary() {
 
 			ocsp, _, errorOCSP := this.readOCSP(true)
 			if errorOCSP != nil {
-				newOCSP := this.fetchOCSP(ocsp, this.renewedCerts, &ocspUpdateAfter, false)
+				newOCSP, _ := this.fetchOCSP(context.Background(), ocsp, this.renewedCerts, &ocspUpdateAfter, false)
 				// Check if newOCSP != ocsp and that there are no errors, health-wise with new ocsp.
 				if !bytes.Equal(newOCSP, ocsp) && this.isHealthy(newOCSP) == nil {
 					// We were able to fetch new OCSP with renewal cert, time to switch to new certs.
@@ -900,21 +1003,43 @@ func PopulateCertCache(config *util.Config, key crypto.PrivateKey, generateOCSPR
 		log.Println(errors.Wrap(err, "Can't load cert file"))
 		certs = nil
 	}
-	domain := ""
+	// The domains from config.URLSet that this cert chain will be used to
+	// sign. If there are multiple cert chains, each need only cover a subset
+	// of them; NewMultiCertCache verifies that they are all covered.
+	domains := []string{}
 	for _, urlSet := range config.URLSet {
-		domain = urlSet.Sign.Domain
-		if certs != nil {
-			if err := util.CertificateMatches(certs[0], key, domain); err != nil {
-				return nil, errors.Wrapf(err, "checking %s", config.CertFile)
-			}
+		if certs == nil || certs[0].VerifyHostname(urlSet.Sign.Domain) == nil {
+			domains = append(domains, urlSet.Sign.Domain)
 		}
 	}
+	if certs != nil {
+		if len(domains) == 0 {
+			return nil, errors.Errorf("checking %s: certificate does not cover any URLSet.Sign.Domain", config.CertFile)
+		}
+		if err := util.CertificateMatches(certs[0], key, domains[0]); err != nil {
+			return nil, errors.Wrapf(err, "checking %s", config.CertFile)
+		}
+	}
+	domain := ""
+	if len(domains) > 0 {
+		domain = domains[0]
+	}
 
 	certFetcher, err := certloader.CreateCertFetcher(config, key, domain, developmentMode, autoRenewCert)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating cert fetcher from config")
 	}
-	certCache := New(certs, certFetcher, []string{domain}, config.CertFile, config.NewCertFile, config.OCSPCache, generateOCSPResponse, time.Now)
+	certCache := New(certs, certFetcher, domains, config.CertFile, config.NewCertFile, config.OCSPCache, generateOCSPResponse, time.Now)
+	if config.OCSPStorage != nil {
+		if err := certCache.setOCSPStorage(config.OCSPStorage); err != nil {
+			return nil, errors.Wrap(err, "creating OCSP storage from config")
+		}
+	}
+	if config.OCSPFetch != nil {
+		if err := certCache.setOCSPFetch(config.OCSPFetch); err != nil {
+			return nil, errors.Wrap(err, "creating OCSP client from config")
+		}
+	}
 
 	return certCache, nil
 }
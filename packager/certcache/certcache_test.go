@@ -16,6 +16,8 @@ package certcache
 
 import (
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"log"
@@ -23,6 +25,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,6 +33,7 @@ import (
 	"github.com/ampproject/amppackager/packager/mux"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
 	"github.com/ampproject/amppackager/packager/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
 	ocsptest "github.com/twifkak/crypto/ocsp"
 	"golang.org/x/crypto/ocsp"
@@ -40,9 +44,15 @@ import (
 // of rounding down, so that calls to this function with producedAt ==
 // thisUpdate return a valid response.
 func FakeOCSPResponse(thisUpdate, producedAt time.Time) ([]byte, error) {
+	return fakeOCSPResponseForCert(pkgt.B3Certs[0], thisUpdate, producedAt)
+}
+
+// Same as FakeOCSPResponse, but for the given cert, which must be issued by
+// pkgt.CACert.
+func fakeOCSPResponseForCert(cert *x509.Certificate, thisUpdate, producedAt time.Time) ([]byte, error) {
 	template := ocsptest.Response{
 		Status:           ocsp.Good,
-		SerialNumber:     pkgt.B3Certs[0].SerialNumber,
+		SerialNumber:     cert.SerialNumber,
 		ThisUpdate:       thisUpdate,
 		NextUpdate:       thisUpdate.Add(7 * 24 * time.Hour),
 		RevokedAt:        thisUpdate.AddDate( /*years=*/ 0 /*months=*/, 0 /*days=*/, 365),
@@ -51,6 +61,19 @@ func FakeOCSPResponse(thisUpdate, producedAt time.Time) ([]byte, error) {
 	return ocsptest.CreateResponse(pkgt.CACert, pkgt.CACert, template, pkgt.CAKey, producedAt.Add(1*time.Minute))
 }
 
+// Same as fakeOCSPResponseForCert, but reports the cert revoked.
+func fakeRevokedOCSPResponseForCert(cert *x509.Certificate, thisUpdate time.Time) ([]byte, error) {
+	template := ocsptest.Response{
+		Status:           ocsp.Revoked,
+		SerialNumber:     cert.SerialNumber,
+		ThisUpdate:       thisUpdate,
+		NextUpdate:       thisUpdate.Add(7 * 24 * time.Hour),
+		RevokedAt:        thisUpdate.Add(-1 * time.Hour),
+		RevocationReason: ocsp.KeyCompromise,
+	}
+	return ocsptest.CreateResponse(pkgt.CACert, pkgt.CACert, template, pkgt.CAKey, thisUpdate.Add(1*time.Minute))
+}
+
 type CertCacheSuite struct {
 	suite.Suite
 	fakeOCSP            []byte
@@ -75,8 +98,8 @@ func (this *CertCacheSuite) New() (*CertCache, error) {
 	// 	filepath.Join(this.tempDir, "ocsp"), nil, time.Now)
 	certCache := New(pkgt.B3Certs, nil, []string{"example.com"}, "cert.crt", "newcert.crt",
 		filepath.Join(this.tempDir, "ocsp"), nil, this.fakeClock.Now)
-	certCache.extractOCSPServer = func(*x509.Certificate) (string, error) {
-		return this.ocspServer.URL, nil
+	certCache.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{this.ocspServer.URL}, nil
 	}
 	defaultHttpExpiry := certCache.httpExpiry
 	certCache.httpExpiry = func(req *http.Request, resp *http.Response) time.Time {
@@ -122,6 +145,8 @@ func (this *CertCacheSuite) SetupTest() {
 
 	this.handler, err = this.New()
 	this.Require().NoError(err, "instantiating CertCache")
+	// Only count the OCSP requests made by the test itself.
+	promOCSPRequests.Reset()
 }
 
 func (this *CertCacheSuite) TearDownTest() {
@@ -130,6 +155,7 @@ func (this *CertCacheSuite) TearDownTest() {
 
 	// Reverse SetupTest.
 	this.handler.Stop()
+	promCertRevoked.Reset()
 
 	err := os.RemoveAll(this.tempDir)
 	if err != nil {
@@ -138,7 +164,7 @@ func (this *CertCacheSuite) TearDownTest() {
 }
 
 func (this *CertCacheSuite) mux() http.Handler {
-	return mux.New(this.handler, nil, nil, nil, nil)
+	return mux.New(this.handler, nil, nil, nil, nil, nil)
 }
 
 func (this *CertCacheSuite) ocspServerCalled(f func()) bool {
@@ -185,6 +211,113 @@ func (this *CertCacheSuite) TestServesCertificate() {
 	this.Assert().NotContains(cbor, "sct")
 }
 
+// Makes the fake OCSP server respond for either pkgt.B3Certs or pkgt.B3Certs2,
+// per the request. Returns the response for the latter.
+func (this *CertCacheSuite) serveOCSPPerCert() []byte {
+	now := this.fakeClock.Now()
+	ocsp2, err := fakeOCSPResponseForCert(pkgt.B3Certs2[0], now, now)
+	this.Require().NoError(err, "creating fake OCSP response")
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		var der []byte
+		var err error
+		if req.Method == http.MethodGet {
+			der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(req.URL.Path, "/"))
+		} else {
+			der, err = ioutil.ReadAll(req.Body)
+		}
+		this.Require().NoError(err, "reading OCSP request")
+		ocspReq, err := ocsp.ParseRequest(der)
+		this.Require().NoError(err, "parsing OCSP request")
+		if ocspReq.SerialNumber.Cmp(pkgt.B3Certs2[0].SerialNumber) == 0 {
+			resp.Write(ocsp2)
+		} else {
+			resp.Write(this.fakeOCSP)
+		}
+	}
+	return ocsp2
+}
+
+func (this *CertCacheSuite) TestServesRetiredCertificate() {
+	ocsp2 := this.serveOCSPPerCert()
+	this.handler.CertFile = filepath.Join(this.tempDir, "cert.crt")
+	this.handler.setCerts(pkgt.B3Certs2)
+
+	// Both the new chain and the one it replaced are served, each with
+	// its own OCSP response.
+	for _, test := range []struct {
+		certs []*x509.Certificate
+		ocsp  []byte
+	}{
+		{pkgt.B3Certs, this.fakeOCSP},
+		{pkgt.B3Certs2, ocsp2},
+	} {
+		resp := pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+util.CertName(test.certs[0])).Do()
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		cbor := this.DecodeCBOR(resp.Body)
+		this.Assert().Equal(test.certs[0].Raw, cbor["cert"])
+		this.Assert().Equal(test.ocsp, cbor["ocsp"])
+	}
+	this.Assert().True(this.handler.hasCertName(pkgt.CertName))
+
+	// Until all the SXGs signed with the old chain have expired.
+	this.fakeClock.SecondsSince0 += retiredCertLifetime + time.Second
+	resp := pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName).Do()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.handler.maintainServedChains()
+	this.Assert().Empty(this.handler.retired)
+}
+
+func (this *CertCacheSuite) TestServesRetiredCertificateAfterRestart() {
+	this.serveOCSPPerCert()
+	this.handler.CertFile = filepath.Join(this.tempDir, "cert.crt")
+	this.handler.setCerts(pkgt.B3Certs2)
+
+	// A new CertCache, e.g. after a restart or on another replica, loads
+	// the renewed CertFile, but still serves the chain it replaced.
+	certCache := New(pkgt.B3Certs2, nil, []string{"example.com"}, this.handler.CertFile, "newcert.crt",
+		filepath.Join(this.tempDir, "ocsp"), nil, this.fakeClock.Now)
+	certCache.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{this.ocspServer.URL}, nil
+	}
+	this.Require().NoError(certCache.Init(), "initializing new CertCache")
+	defer certCache.Stop()
+	handler := mux.New(certCache, nil, nil, nil, nil, nil)
+	resp := pkgt.NewRequest(this.T(), handler, "/amppkg/cert/"+pkgt.CertName).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(pkgt.B3Certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+
+	// Until all the SXGs signed with the old chain have expired, when it's
+	// removed from the file too.
+	this.fakeClock.SecondsSince0 += retiredCertLifetime + time.Second
+	certCache.maintainServedChains()
+	chains, _, err := readRetiredFile(this.handler.retiredFilePath())
+	this.Require().NoError(err)
+	this.Assert().Empty(chains)
+}
+
+func (this *CertCacheSuite) TestPublishesRenewalCertificate() {
+	ocsp2 := this.serveOCSPPerCert()
+	renewalName := util.CertName(pkgt.B3Certs2[0])
+	this.handler.NewCertFile = filepath.Join(this.tempDir, "newcert.crt")
+	this.handler.setNewCerts(pkgt.B3Certs2)
+
+	resp := pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("<"+renewalName+`>;rel="prefetch"`, resp.Header.Get("Link"))
+
+	resp = pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+renewalName).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	cbor := this.DecodeCBOR(resp.Body)
+	this.Assert().Equal(pkgt.B3Certs2[0].Raw, cbor["cert"])
+	this.Assert().Equal(ocsp2, cbor["ocsp"])
+
+	this.handler.setNewCerts(nil)
+	resp = pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName).Do()
+	this.Assert().Equal("", resp.Header.Get("Link"))
+	resp = pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/"+renewalName).Do()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
 func (this *CertCacheSuite) TestCertCacheIsHealthy() {
 	this.Assert().NoError(this.handler.IsHealthy())
 }
@@ -232,6 +365,155 @@ func (this *CertCacheSuite) TestCertCacheIsNotHealthy() {
 	this.Assert().Error(this.handler.IsHealthy())
 }
 
+func (this *CertCacheSuite) TestRevokedCertIsNotHealthy() {
+	// After the cached OCSP's midpoint, the responder reports the cert revoked.
+	this.fakeClock.SecondsSince0 += 4 * 24 * time.Hour
+	var err error
+	this.fakeOCSP, err = fakeRevokedOCSPResponseForCert(pkgt.B3Certs[0], this.fakeClock.Now())
+	this.Require().NoError(err, "creating revoked OCSP response")
+	this.Require().True(this.ocspServerCalled(func() {
+		_, _, err := this.handler.readOCSP(true)
+		this.Assert().Contains(errorFrom(err), "certificate revoked")
+	}))
+
+	this.Assert().Contains(errorFrom(this.handler.IsHealthy()), "OCSP reports cert "+pkgt.CertName+" revoked")
+	this.Assert().Equal(1.0, testutil.ToFloat64(promCertRevoked.WithLabelValues(pkgt.CertName)))
+
+	// The revoked response is cached, so that other replicas stop signing
+	// too, without asking the responder.
+	this.Assert().False(this.ocspServerCalled(func() {
+		_, err = this.New()
+		this.Assert().Contains(errorFrom(err), "certificate revoked")
+	}))
+}
+
+func (this *CertCacheSuite) TestRevokedCertIsReissued() {
+	this.handler.CertFile = filepath.Join(this.tempDir, "cert.crt")
+	this.handler.reissueCert = func() ([]*x509.Certificate, error) {
+		return pkgt.B3Certs2, nil
+	}
+	this.fakeClock.SecondsSince0 += 4 * 24 * time.Hour
+	var err error
+	this.fakeOCSP, err = fakeRevokedOCSPResponseForCert(pkgt.B3Certs[0], this.fakeClock.Now())
+	this.Require().NoError(err, "creating revoked OCSP response")
+	this.serveOCSPPerCert()
+
+	// Health checks don't replace the cert themselves.
+	this.Assert().Contains(errorFrom(this.handler.IsHealthy()), "certificate revoked")
+	this.Assert().Contains(errorFrom(this.handler.IsHealthy()), "certificate revoked")
+	this.Assert().Equal(pkgt.B3Certs[0], this.handler.GetLatestCert())
+
+	// The next background OCSP update does.
+	this.Require().NoError(this.handler.updateOCSP())
+	this.Assert().Equal(pkgt.B3Certs2[0], this.handler.GetLatestCert())
+	this.Assert().NoError(this.handler.IsHealthy())
+	this.Assert().Equal(0, testutil.CollectAndCount(promCertRevoked))
+	// The revoked chain isn't served alongside its replacement.
+	this.Assert().False(this.handler.hasCertName(pkgt.CertName))
+}
+
+// Advances the clock past the cached OCSP response's midpoint, so that the
+// next readOCSP fetches a new one.
+func (this *CertCacheSuite) passOCSPMidpoint() {
+	this.fakeClock.SecondsSince0 += 4 * 24 * time.Hour
+	now := this.fakeClock.Now()
+	var err error
+	this.fakeOCSP, err = FakeOCSPResponse(now, now)
+	this.Require().NoError(err, "creating fake OCSP response")
+}
+
+func (this *CertCacheSuite) TestOCSPResponderFailover() {
+	down := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		http.Error(resp, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	this.handler.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{down.URL, this.ocspServer.URL}, nil
+	}
+	this.passOCSPMidpoint()
+
+	this.Require().True(this.ocspServerCalled(func() {
+		ocspBytes, _, err := this.handler.readOCSP(true)
+		this.Require().NoError(err)
+		this.Assert().Equal(this.fakeOCSP, ocspBytes)
+	}))
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(down.URL, "GET", "http_error")))
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(down.URL, "POST", "http_error")))
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(this.ocspServer.URL, "GET", "success")))
+
+	// The cache records the responder that answered.
+	cached, err := ioutil.ReadFile(filepath.Join(this.tempDir, "ocsp"))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(cached), "\nResponder: "+this.ocspServer.URL+"\n")
+}
+
+func (this *CertCacheSuite) TestOCSPFallsBackToPOST() {
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		this.Assert().Equal("application/ocsp-request", req.Header.Get("Content-Type"))
+		this.ocspServerWasCalled = true
+		resp.Write(this.fakeOCSP)
+	}
+	this.passOCSPMidpoint()
+
+	this.Require().True(this.ocspServerCalled(func() {
+		ocspBytes, _, err := this.handler.readOCSP(true)
+		this.Require().NoError(err)
+		this.Assert().Equal(this.fakeOCSP, ocspBytes)
+	}))
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(this.ocspServer.URL, "GET", "http_error")))
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(this.ocspServer.URL, "POST", "success")))
+}
+
+func (this *CertCacheSuite) TestOCSPFetchThroughProxy() {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		proxiedHost = req.URL.Host
+		resp.Write(this.fakeOCSP)
+	}))
+	defer proxy.Close()
+	this.Require().NoError(this.handler.setOCSPFetch(&util.OCSPFetchConfig{Proxy: proxy.URL, Timeout: time.Minute}))
+	this.handler.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{"http://ocsp.example.invalid"}, nil
+	}
+	this.passOCSPMidpoint()
+
+	ocspBytes, _, err := this.handler.readOCSP(true)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.fakeOCSP, ocspBytes)
+	this.Assert().Equal("ocsp.example.invalid", proxiedHost)
+}
+
+func (this *CertCacheSuite) TestOCSPFetchWithCABundle() {
+	responder := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(this.fakeOCSP)
+	}))
+	defer responder.Close()
+	this.handler.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{responder.URL}, nil
+	}
+	this.passOCSPMidpoint()
+
+	// The responder's cert isn't trusted by default.
+	_, _, err := this.handler.readOCSP(true)
+	this.Require().NoError(err)
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(responder.URL, "GET", "request_error")))
+
+	caBundle := filepath.Join(this.tempDir, "ca.pem")
+	this.Require().NoError(ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: responder.Certificate().Raw,
+	}), 0600))
+	this.Require().NoError(this.handler.setOCSPFetch(&util.OCSPFetchConfig{CABundle: caBundle, Timeout: time.Minute}))
+	ocspBytes, _, err := this.handler.readOCSP(true)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.fakeOCSP, ocspBytes)
+	this.Assert().Equal(1.0, testutil.ToFloat64(promOCSPRequests.WithLabelValues(responder.URL, "GET", "success")))
+}
+
 func (this *CertCacheSuite) TestServes404OnMissingCertificate() {
 	resp := pkgt.NewRequest(this.T(), this.mux(), "/amppkg/cert/lalala").Do()
 	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
@@ -407,6 +689,109 @@ func (this *CertCacheSuite) TestPopulateCertCache() {
 	this.Assert().Equal(pkgt.B3Certs[0], certCache.GetLatestCert())
 }
 
+func (this *CertCacheSuite) TestPopulateCertCacheNoCoveredDomain() {
+	_, err := PopulateCertCache(
+		&util.Config{
+			CertFile:  "../../testdata/b3/fullchain.cert",
+			KeyFile:   "../../testdata/b3/server.privkey",
+			OCSPCache: "/tmp/ocsp",
+			URLSet: []util.URLSet{{
+				Sign: &util.URLPattern{Domain: "amppackageexample2.com"},
+			}},
+		},
+		pkgt.B3Key,
+		nil,
+		true,
+		false)
+	this.Assert().EqualError(err, "checking ../../testdata/b3/fullchain.cert: certificate does not cover any URLSet.Sign.Domain")
+}
+
+func (this *CertCacheSuite) TestMultiCertCacheHealthIsPerChain() {
+	now := this.fakeClock.Now()
+	ocsp2, err := fakeRevokedOCSPResponseForCert(pkgt.B3Certs2[0], now)
+	this.Require().NoError(err, "creating revoked OCSP response")
+	ocspServer2 := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(ocsp2)
+	}))
+	defer ocspServer2.Close()
+
+	certCache2 := New(pkgt.B3Certs2, nil, []string{"amppackageexample2.com"}, "cert2.crt", "newcert2.crt",
+		filepath.Join(this.tempDir, "ocsp2"), nil, this.fakeClock.Now)
+	certCache2.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{ocspServer2.URL}, nil
+	}
+	this.Require().Error(certCache2.Init(), "initializing revoked CertCache")
+	defer certCache2.Stop()
+
+	urlSets := []util.URLSet{
+		{Sign: &util.URLPattern{Domain: "amppackageexample.com"}},
+		{Sign: &util.URLPattern{Domain: "www.amppackageexample2.com"}},
+	}
+	multi, err := NewMultiCertCache([]*CertCache{this.handler, certCache2}, urlSets)
+	this.Require().NoError(err)
+	this.Assert().Contains(errorFrom(multi.IsHealthy()), "certificate revoked")
+	// Only the revoked chain's domains stop being signed.
+	this.Assert().NoError(multi.IsHealthyFor("amppackageexample.com"))
+	this.Assert().Contains(errorFrom(multi.IsHealthyFor("www.amppackageexample2.com")), "certificate revoked")
+	this.Assert().Contains(errorFrom(multi.IsHealthyFor("example.com")), "no cert chain covers example.com")
+}
+
+func (this *CertCacheSuite) TestMultiCertCache() {
+	now := this.fakeClock.Now()
+	ocsp2, err := fakeOCSPResponseForCert(pkgt.B3Certs2[0], now, now)
+	this.Require().NoError(err, "creating fake OCSP response")
+	ocspServer2 := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(ocsp2)
+	}))
+	defer ocspServer2.Close()
+
+	certCache2 := New(pkgt.B3Certs2, nil, []string{"amppackageexample2.com"}, "cert2.crt", "newcert2.crt",
+		filepath.Join(this.tempDir, "ocsp2"), nil, this.fakeClock.Now)
+	certCache2.extractOCSPServers = func(*x509.Certificate) ([]string, error) {
+		return []string{ocspServer2.URL}, nil
+	}
+	this.Require().NoError(certCache2.Init(), "initializing second CertCache")
+	defer certCache2.Stop()
+
+	urlSets := []util.URLSet{
+		{Sign: &util.URLPattern{Domain: "amppackageexample.com"}},
+		{Sign: &util.URLPattern{Domain: "www.amppackageexample2.com"}},
+	}
+	multi, err := NewMultiCertCache([]*CertCache{this.handler, certCache2}, urlSets)
+	this.Require().NoError(err)
+	this.Assert().NoError(multi.IsHealthy())
+	this.Assert().Equal(this.handler, multi.ForDomain("amppackageexample.com"))
+	this.Assert().Equal(certCache2, multi.ForDomain("www.amppackageexample2.com"))
+	this.Assert().Nil(multi.ForDomain("example.com"))
+
+	// Each chain is served at its own URL, with its own OCSP response.
+	handler := mux.New(multi, nil, nil, nil, nil, nil)
+	for _, test := range []struct {
+		certs []*x509.Certificate
+		ocsp  []byte
+	}{
+		{pkgt.B3Certs, this.fakeOCSP},
+		{pkgt.B3Certs2, ocsp2},
+	} {
+		resp := pkgt.NewRequest(this.T(), handler, "/amppkg/cert/"+util.CertName(test.certs[0])).Do()
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		cbor := this.DecodeCBOR(resp.Body)
+		this.Assert().Equal(test.certs[0].Raw, cbor["cert"])
+		this.Assert().Equal(test.ocsp, cbor["ocsp"])
+	}
+	resp := pkgt.NewRequest(this.T(), handler, "/amppkg/cert/lalala").Do()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *CertCacheSuite) TestMultiCertCacheUncoveredDomain() {
+	urlSets := []util.URLSet{
+		{Sign: &util.URLPattern{Domain: "amppackageexample.com"}},
+		{Sign: &util.URLPattern{Domain: "amppackageexample2.com"}},
+	}
+	_, err := NewMultiCertCache([]*CertCache{this.handler}, urlSets)
+	this.Assert().EqualError(err, "no cert chain covers domain amppackageexample2.com")
+}
+
 func TestCertCacheSuite(t *testing.T) {
 	suite.Run(t, new(CertCacheSuite))
 }
@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/certloader"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// How long a cert chain is served after it's replaced by a renewal. SXGs signed
+// with it may live for up to util.MaxSxgLifetime, and other replicas, which
+// only check for the renewal every certCheckInterval, may keep signing with it
+// for that long after this one switches.
+const retiredCertLifetime = util.MaxSxgLifetime + certCheckInterval
+
+// A cert chain, other than the current one, that's served at its own cert-url:
+// either one that was replaced by a renewal, and must stay verifiable until the
+// SXGs signed with it expire, or the pending renewal, published before the
+// switch so that caches can prefetch it. Each has its own OCSP cache, next to
+// the current chain's.
+type servedChain struct {
+	certName string
+	certs    []*x509.Certificate
+	// The chain is no longer served after this time.
+	until        time.Time
+	ocspFile     Updateable
+	ocspFilePath string
+}
+
+func (this *CertCache) newServedChain(certs []*x509.Certificate, until time.Time) *servedChain {
+	certName := util.CertName(certs[0])
+	ocspFilePath := this.ocspFilePath + "." + certName
+	return &servedChain{
+		certName:     certName,
+		certs:        certs,
+		until:        until,
+		ocspFile:     this.newOCSPFile(ocspFilePath),
+		ocspFilePath: ocspFilePath,
+	}
+}
+
+// Keeps serving the given chain, which is being replaced, until the SXGs
+// signed with it have expired (or it has).
+func (this *CertCache) retire(certs []*x509.Certificate) {
+	now := this.timeNow()
+	until := now.Add(retiredCertLifetime)
+	if notAfter := certs[0].NotAfter; notAfter.Before(until) {
+		until = notAfter
+	}
+	if !until.After(now) {
+		return
+	}
+	chain := this.newServedChain(certs, until)
+
+	this.retiredMu.Lock()
+	defer this.retiredMu.Unlock()
+	retired := []*servedChain{}
+	for _, other := range this.retired {
+		if other.certName != chain.certName {
+			retired = append(retired, other)
+		}
+	}
+	log.Printf("Serving retired cert %s until %v", chain.certName, until)
+	this.retired = append(retired, chain)
+	this.saveRetired()
+}
+
+// The file that retired chains are persisted in, so that they're still served
+// after a restart, and by replicas that only load the renewed CertFile. Each
+// chain is a series of PEM certificates, the first of which has a
+// Retired-Until header.
+func (this *CertCache) retiredFilePath() string {
+	return this.CertFile + ".retired"
+}
+
+const retiredUntilHeader = "Retired-Until"
+
+// Returns the chains in the retired file, and when each is served until.
+func readRetiredFile(path string) ([][]*x509.Certificate, []time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s", path)
+	}
+	var chains [][]*x509.Certificate
+	var untils []time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parsing certificate in %s", path)
+		}
+		if value, ok := block.Headers[retiredUntilHeader]; ok {
+			until, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "parsing %s in %s", retiredUntilHeader, path)
+			}
+			chains = append(chains, nil)
+			untils = append(untils, until)
+		} else if len(chains) == 0 {
+			return nil, nil, errors.Errorf("missing %s in %s", retiredUntilHeader, path)
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], cert)
+	}
+	return chains, untils, nil
+}
+
+// Writes the retired chains to the retired file, merged with any written by
+// other replicas that share it. Must be called with retiredMu held.
+func (this *CertCache) saveRetired() {
+	if this.CertFile == "" {
+		return
+	}
+	path := this.retiredFilePath()
+	now := this.timeNow()
+	chains, untils, err := readRetiredFile(path)
+	if err != nil {
+		log.Println("Overwriting retired certs file:", err)
+		chains, untils = nil, nil
+	}
+	var buf bytes.Buffer
+	written := map[string]bool{}
+	write := func(certs []*x509.Certificate, until time.Time) {
+		certName := util.CertName(certs[0])
+		if written[certName] || now.After(until) {
+			return
+		}
+		written[certName] = true
+		for i, cert := range certs {
+			block := &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
+			if i == 0 {
+				block.Headers = map[string]string{retiredUntilHeader: until.UTC().Format(time.RFC3339)}
+			}
+			pem.Encode(&buf, block)
+		}
+	}
+	for _, chain := range this.retired {
+		write(chain.certs, chain.until)
+	}
+	for i, certs := range chains {
+		write(certs, untils[i])
+	}
+	if err := writeFileAtomically(path, buf.Bytes()); err != nil {
+		log.Printf("Unable to write retired certs to file %s: %s", path, err)
+	}
+}
+
+// Serves the unexpired chains in the retired file, other than the current one.
+func (this *CertCache) loadRetired() {
+	if this.CertFile == "" {
+		return
+	}
+	chains, untils, err := readRetiredFile(this.retiredFilePath())
+	if err != nil {
+		log.Println("Unable to load retired certs:", err)
+		return
+	}
+	if len(chains) == 0 {
+		return
+	}
+	now := this.timeNow()
+	this.certsMu.RLock()
+	currentName := this.certName
+	this.certsMu.RUnlock()
+	this.retiredMu.Lock()
+	defer this.retiredMu.Unlock()
+	served := map[string]bool{currentName: true}
+	for _, chain := range this.retired {
+		served[chain.certName] = true
+	}
+	for i, certs := range chains {
+		certName := util.CertName(certs[0])
+		if served[certName] || now.After(untils[i]) {
+			continue
+		}
+		served[certName] = true
+		log.Printf("Serving retired cert %s until %v", certName, untils[i])
+		this.retired = append(this.retired, this.newServedChain(certs, untils[i]))
+	}
+}
+
+// Returns the pending renewal chain, if any.
+func (this *CertCache) getRenewalChain() *servedChain {
+	this.renewedCertsMu.RLock()
+	defer this.renewedCertsMu.RUnlock()
+	return this.renewal
+}
+
+// Returns the retired or renewal chain of the given name, if it's currently
+// served and isn't the current chain.
+func (this *CertCache) servedChainNamed(certName string) *servedChain {
+	if certName == "" {
+		return nil
+	}
+	this.certsMu.RLock()
+	isCurrent := certName == this.certName
+	this.certsMu.RUnlock()
+	if isCurrent {
+		return nil
+	}
+	if renewal := this.getRenewalChain(); renewal != nil && renewal.certName == certName {
+		return renewal
+	}
+	now := this.timeNow()
+	this.retiredMu.RLock()
+	defer this.retiredMu.RUnlock()
+	for _, chain := range this.retired {
+		if chain.certName == certName && !now.After(chain.until) {
+			return chain
+		}
+	}
+	return nil
+}
+
+// Returns true if the chain's OCSP response is missing, invalid, or past its
+// midpoint. Unlike shouldUpdateOCSP, this doesn't honor the responder's HTTP
+// cache headers, which aren't tracked per chain.
+func (this *CertCache) shouldUpdateChainOCSP(chain *servedChain, ocspBytes []byte) bool {
+	if len(ocspBytes) == 0 {
+		return true
+	}
+	resp, err := ocsp.ParseResponseForCert(ocspBytes, chain.certs[0], this.findIssuerUsingCerts(chain.certs))
+	if err != nil {
+		log.Printf("Invalid OCSP for cert %s: %s", chain.certName, err)
+		return true
+	}
+	return this.timeNow().After(this.ocspMidpoint(resp))
+}
+
+// Returns the chain's OCSP response, refreshing it if necessary.
+func (this *CertCache) readChainOCSP(chain *servedChain) ([]byte, error) {
+	ctx := context.Background()
+	ocspBytes, err := chain.ocspFile.Read(ctx, func(ocspBytes []byte) bool {
+		return this.shouldUpdateChainOCSP(chain, ocspBytes)
+	}, func(orig []byte) ([]byte, string) {
+		var ocspUpdateAfter time.Time
+		return this.fetchOCSP(ctx, orig, chain.certs, &ocspUpdateAfter, false)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "updating OCSP cache for cert %s", chain.certName)
+	}
+	if len(ocspBytes) == 0 {
+		return nil, errors.Errorf("missing OCSP response for cert %s", chain.certName)
+	}
+	return ocspBytes, nil
+}
+
+// Stops serving retired chains whose SXGs have all expired, and refreshes the
+// OCSP responses of the rest, and of the renewal chain.
+func (this *CertCache) maintainServedChains() {
+	now := this.timeNow()
+	var chains []*servedChain
+	this.retiredMu.Lock()
+	retired := []*servedChain{}
+	for _, chain := range this.retired {
+		if now.After(chain.until) {
+			log.Printf("No longer serving retired cert %s", chain.certName)
+			certloader.RemoveFile(chain.ocspFilePath)
+			continue
+		}
+		retired = append(retired, chain)
+	}
+	if len(retired) < len(this.retired) {
+		this.retired = retired
+		this.saveRetired()
+	}
+	chains = append(chains, retired...)
+	this.retiredMu.Unlock()
+
+	if renewal := this.getRenewalChain(); renewal != nil {
+		chains = append(chains, renewal)
+	}
+	for _, chain := range chains {
+		if _, err := this.readChainOCSP(chain); err != nil {
+			log.Println("Warning: OCSP update failed. Cached response may expire:", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The first line of a LocalFile. Files without it predate the envelope, and
+// are read as is.
+const localFileMagic = "AMPPKG-OCSP 1\n"
+
+// The format of a LocalFile: a header with the time the contents were fetched,
+// the OCSP responder they were fetched from, and their length and checksum,
+// followed by a blank line and the contents. For example:
+//
+//	AMPPKG-OCSP 1
+//	Fetched: 2021-08-01T00:00:00Z
+//	Responder: http://ocsp.example.com
+//	Length: 1234
+//	SHA-256: <the base64-encoded SHA-256 of the response>
+//
+//	<the DER-encoded OCSP response>
+//
+// The checksum allows detecting files that were corrupted, e.g. by a crash
+// mid-write before writes were atomic, or by the storage device. The other
+// fields are for the benefit of operators.
+type localFileEnvelope struct {
+	fetched   time.Time
+	responder string
+	contents  []byte
+}
+
+func (this *localFileEnvelope) encode() []byte {
+	checksum := sha256.Sum256(this.contents)
+	var buf bytes.Buffer
+	buf.WriteString(localFileMagic)
+	buf.WriteString("Fetched: " + this.fetched.UTC().Format(time.RFC3339) + "\n")
+	if this.responder != "" {
+		buf.WriteString("Responder: " + this.responder + "\n")
+	}
+	buf.WriteString("Length: " + strconv.Itoa(len(this.contents)) + "\n")
+	buf.WriteString("SHA-256: " + base64.StdEncoding.EncodeToString(checksum[:]) + "\n")
+	buf.WriteString("\n")
+	buf.Write(this.contents)
+	return buf.Bytes()
+}
+
+func decodeLocalFileEnvelope(data []byte) (*localFileEnvelope, error) {
+	if !bytes.HasPrefix(data, []byte(localFileMagic)) {
+		return &localFileEnvelope{contents: data}, nil
+	}
+	end := bytes.Index(data, []byte("\n\n"))
+	if end < 0 {
+		return nil, errors.New("truncated header")
+	}
+	envelope := localFileEnvelope{contents: data[end+2:]}
+	length := -1
+	var checksum string
+	for _, line := range strings.Split(string(data[len(localFileMagic):end]), "\n") {
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			return nil, errors.Errorf("malformed header line %q", line)
+		}
+		name, value := line[:colon], line[colon+2:]
+		switch name {
+		case "Fetched":
+			fetched, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing Fetched")
+			}
+			envelope.fetched = fetched
+		case "Responder":
+			envelope.responder = value
+		case "Length":
+			var err error
+			if length, err = strconv.Atoi(value); err != nil {
+				return nil, errors.Wrap(err, "parsing Length")
+			}
+		case "SHA-256":
+			checksum = value
+		}
+	}
+	if length != len(envelope.contents) {
+		return nil, errors.Errorf("contents are %d bytes; want %d", len(envelope.contents), length)
+	}
+	actual := sha256.Sum256(envelope.contents)
+	if checksum != base64.StdEncoding.EncodeToString(actual[:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return &envelope, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// MultiCertCache serves several independent cert chains, e.g. one per
+// publisher domain. Each chain is backed by its own CertCache, and thus has
+// its own OCSP cache and renewal lifecycle.
+type MultiCertCache struct {
+	caches []*CertCache
+}
+
+// Returns a MultiCertCache over the given caches, which must be non-empty.
+// Returns an error if any of the urlSets has a Sign.Domain that isn't covered
+// by any of the caches' certificates. (Caches with no certificate loaded, as
+// may happen in development mode, are not considered.)
+func NewMultiCertCache(caches []*CertCache, urlSets []util.URLSet) (*MultiCertCache, error) {
+	if len(caches) == 0 {
+		return nil, errors.New("no cert chains specified")
+	}
+	this := &MultiCertCache{caches}
+	anyLoaded := false
+	for _, cache := range caches {
+		if cache.hasCert() {
+			anyLoaded = true
+		}
+	}
+	if anyLoaded {
+		for _, urlSet := range urlSets {
+			if this.ForDomain(urlSet.Sign.Domain) == nil {
+				return nil, errors.Errorf("no cert chain covers domain %s", urlSet.Sign.Domain)
+			}
+		}
+	}
+	return this, nil
+}
+
+// Calls Init() on each of the caches. All are initialized, even if some fail;
+// the first error is returned.
+func (this *MultiCertCache) Init() error {
+	var firstErr error
+	for _, cache := range this.caches {
+		if err := cache.Init(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "initializing %s", cache.CertFile)
+		}
+	}
+	return firstErr
+}
+
+// Stops the background goroutines of each of the caches. Returns true if any
+// of them were running.
+func (this *MultiCertCache) Stop() bool {
+	stopped := false
+	for _, cache := range this.caches {
+		if cache.Stop() {
+			stopped = true
+		}
+	}
+	return stopped
+}
+
+// Caches returns the underlying caches, in config order.
+func (this *MultiCertCache) Caches() []*CertCache {
+	return this.caches
+}
+
+// ForDomain returns the first cache whose current leaf certificate covers the
+// given domain, or nil if none do.
+func (this *MultiCertCache) ForDomain(domain string) *CertCache {
+	for _, cache := range this.caches {
+		if cert := cache.getCert(); cert != nil && cert.VerifyHostname(domain) == nil {
+			return cache
+		}
+	}
+	return nil
+}
+
+// GetLatestCert returns the latest cert of the first chain. Use ForDomain to
+// find the cert for a particular domain.
+func (this *MultiCertCache) GetLatestCert() *x509.Certificate {
+	return this.caches[0].GetLatestCert()
+}
+
+// IsHealthy returns nil iff all of the chains are healthy. It's reported by
+// /healthz; whether to sign is decided per host, by IsHealthyFor.
+func (this *MultiCertCache) IsHealthy() error {
+	for _, cache := range this.caches {
+		if err := cache.IsHealthy(); err != nil {
+			return errors.Wrapf(err, "cert chain %s", cache.CertFile)
+		}
+	}
+	return nil
+}
+
+// IsHealthyFor returns nil iff all of the chains whose current certificate
+// covers the given host are healthy, so that the packager keeps signing for
+// other domains while one chain lacks a valid OCSP response.
+func (this *MultiCertCache) IsHealthyFor(host string) error {
+	covered := false
+	for _, cache := range this.caches {
+		if cert := cache.getCert(); cert == nil || cert.VerifyHostname(host) != nil {
+			continue
+		}
+		covered = true
+		if err := cache.IsHealthy(); err != nil {
+			return errors.Wrapf(err, "cert chain %s", cache.CertFile)
+		}
+	}
+	if !covered {
+		return errors.Errorf("no cert chain covers %s", host)
+	}
+	return nil
+}
+
+// ServeHTTP serves each chain at /amppkg/cert/<name>, where name is the
+// CertName of the chain's current leaf certificate.
+func (this *MultiCertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	certName := mux.Params(req)["certName"]
+	for _, cache := range this.caches {
+		if cache.hasCertName(certName) {
+			cache.ServeHTTP(resp, req)
+			return
+		}
+	}
+	http.NotFound(resp, req)
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promOCSPRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "amppackager",
+		Subsystem: "certcache",
+		Name:      "ocsp_requests_total",
+		Help:      "Total number of requests to OCSP responders - by responder URL, method and result (success, request_error, http_error or invalid_response).",
+	},
+	[]string{"responder", "method", "result"},
+)
+
+var promOCSPRequestLatency = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "amppackager",
+		Subsystem: "certcache",
+		Name:      "ocsp_request_duration_seconds",
+		Help:      "Latencies (in seconds) of requests to OCSP responders, until the response body is read - by responder URL and method.",
+		Buckets:   prometheus.DefBuckets,
+	},
+	[]string{"responder", "method"},
+)
+
+// Sends OCSP requests per the given config, rather than with the default
+// client. Must be called before Init.
+func (this *CertCache) setOCSPFetch(config *util.OCSPFetchConfig) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return errors.Wrap(err, "parsing Proxy")
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if config.CABundle != "" {
+		pem, err := ioutil.ReadFile(config.CABundle)
+		if err != nil {
+			return errors.Wrap(err, "reading CABundle")
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			log.Println("Unable to load system CA certificates; trusting only CABundle:", err)
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates found in CABundle %s", config.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	this.client = http.Client{Transport: transport, Timeout: config.Timeout}
+	return nil
+}
+
+// Sends the given request to the given OCSP responder, and validates the
+// response for cert. Returns the response and its cache expiry.
+func (this *CertCache) fetchOCSPFrom(ocspServer string, httpReq *http.Request, cert, issuer *x509.Certificate) ([]byte, time.Time, error) {
+	result := "request_error"
+	defer func() {
+		promOCSPRequests.WithLabelValues(ocspServer, httpReq.Method, result).Inc()
+	}()
+
+	start := time.Now()
+	httpResp, err := this.client.Do(httpReq)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "issuing OCSP request")
+	}
+	defer httpResp.Body.Close()
+	respBytes, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseBytes))
+	promOCSPRequestLatency.WithLabelValues(ocspServer, httpReq.Method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "reading OCSP response")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		result = "http_error"
+		return nil, time.Time{}, errors.Errorf("OCSP responder returned status %d", httpResp.StatusCode)
+	}
+	if err := this.validateOCSPResponse(respBytes, cert, issuer); err != nil {
+		result = "invalid_response"
+		return nil, time.Time{}, err
+	}
+	result = "success"
+
+	// If cache-control headers indicate a response that is not ever
+	// cacheable, then ignore them. Otherwise, allow them to indicate an
+	// expiry earlier than we'd usually follow.
+	return respBytes, this.httpExpiry(httpReq, httpResp), nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The timeout for a Redis command, if the context has no deadline.
+const redisTimeout = 10 * time.Second
+
+func newRedisStorage(config *util.OCSPStorageConfig) (storageFactory, error) {
+	return redisStorage(&respClient{config: config.Redis}, config.Redis.KeyPrefix, config.LeaseDuration), nil
+}
+
+// Returns a storageFactory for files stored via the given client, under keys
+// with the given prefix.
+func redisStorage(client redisClient, keyPrefix string, leaseDuration time.Duration) storageFactory {
+	return func(path string) Updateable {
+		// The hash tag keeps both keys in the same slot, so that the
+		// scripts below work on Redis Cluster.
+		key := keyPrefix + "{" + remoteKey(path) + "}"
+		return &Chained{first: &InMemory{}, second: &leasedFile{
+			name:          key,
+			remote:        &redisFile{client, key, key + ":lease"},
+			leaseDuration: leaseDuration,
+		}}
+	}
+}
+
+// Returns the key of the remote object for the OCSP cache at the given path.
+func remoteKey(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// A file stored at key, whose lease is stored at leaseKey.
+type redisFile struct {
+	client   redisClient
+	key      string
+	leaseKey string
+}
+
+// Writes the file only if the lease is still held by ARGV[1], so that a
+// replica whose lease expired mid-update can't overwrite a newer response.
+const redisPutScript = `
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2])
+	return 1
+end
+return 0`
+
+const redisReleaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+func (this *redisFile) get(ctx context.Context) ([]byte, string, error) {
+	reply, err := this.client.do(ctx, "GET", this.key)
+	if err != nil {
+		return nil, "", err
+	}
+	if reply == nil {
+		return nil, "", nil
+	}
+	contents, ok := reply.(string)
+	if !ok {
+		return nil, "", errors.Errorf("unexpected reply to GET: %v", reply)
+	}
+	return []byte(contents), "", nil
+}
+
+func (this *redisFile) acquire(ctx context.Context, duration time.Duration) (string, error) {
+	token, err := newLeaseToken()
+	if err != nil {
+		return "", err
+	}
+	reply, err := this.client.do(ctx, "SET", this.leaseKey, token, "NX", "PX", strconv.FormatInt(int64(duration/time.Millisecond), 10))
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		// Held by another replica.
+		return "", nil
+	}
+	return token, nil
+}
+
+func (this *redisFile) put(ctx context.Context, token string, version string, contents []byte) error {
+	reply, err := this.client.do(ctx, "EVAL", redisPutScript, "2", this.key, this.leaseKey, token, string(contents))
+	if err != nil {
+		return err
+	}
+	if reply != int64(1) {
+		return errors.New("lease expired before write")
+	}
+	return nil
+}
+
+func (this *redisFile) release(ctx context.Context, token string) error {
+	_, err := this.client.do(ctx, "EVAL", redisReleaseScript, "1", this.leaseKey, token)
+	return err
+}
+
+// Sends Redis commands.
+type redisClient interface {
+	// Sends the given command and returns its reply: a string, an int64,
+	// nil, or a []interface{} of those.
+	do(ctx context.Context, args ...string) (interface{}, error)
+}
+
+// A minimal client for the Redis protocol (RESP), sufficient for the few
+// commands above. As these are only sent when an OCSP response needs
+// refreshing, each is sent on its own connection, rather than pooling them.
+type respClient struct {
+	config *util.RedisStorageConfig
+}
+
+// An error reply from the server.
+type redisError string
+
+func (this redisError) Error() string { return "redis: " + string(this) }
+
+func (this *respClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if this.config.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", this.config.Addr, &tls.Config{})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", this.config.Addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to %s", this.config.Addr)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, errors.Wrap(err, "setting deadline")
+	}
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	if this.config.Password != "" {
+		if _, err := redisRoundTrip(r, w, "AUTH", this.config.Password); err != nil {
+			return nil, errors.Wrap(err, "authenticating")
+		}
+	}
+	if this.config.DB != 0 {
+		if _, err := redisRoundTrip(r, w, "SELECT", strconv.Itoa(this.config.DB)); err != nil {
+			return nil, errors.Wrap(err, "selecting database")
+		}
+	}
+	reply, err := redisRoundTrip(r, w, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sending %s", args[0])
+	}
+	return reply, nil
+}
+
+func redisRoundTrip(r *bufio.Reader, w *bufio.Writer, args ...string) (interface{}, error) {
+	if err := writeRedisCommand(w, args); err != nil {
+		return nil, err
+	}
+	reply, err := readRedisReply(r)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := reply.(redisError); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Writes the command as an array of bulk strings.
+func writeRedisCommand(w *bufio.Writer, args []string) error {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.Errorf("malformed reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing bulk string length %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing array length %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, size)
+		for i := range elems {
+			if elems[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	default:
+		return nil, errors.Errorf("unexpected reply %q", line)
+	}
+}
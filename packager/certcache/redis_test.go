@@ -0,0 +1,249 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isEmpty(contents []byte) bool { return len(contents) == 0 }
+
+// A fake redisClient, which interprets the commands and scripts sent by
+// redisFile against a map. Leases never expire.
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{data: map[string]string{}}
+}
+
+func (this *fakeRedis) get(key string) (string, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	value, ok := this.data[key]
+	return value, ok
+}
+
+func (this *fakeRedis) set(key string, value string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.data[key] = value
+}
+
+func (this *fakeRedis) do(ctx context.Context, args ...string) (interface{}, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	switch {
+	case args[0] == "GET":
+		if value, ok := this.data[args[1]]; ok {
+			return value, nil
+		}
+		return nil, nil
+	case args[0] == "SET":
+		if len(args) > 3 && args[3] == "NX" {
+			if _, ok := this.data[args[1]]; ok {
+				return nil, nil
+			}
+		}
+		this.data[args[1]] = args[2]
+		return "OK", nil
+	case args[0] == "EVAL" && args[1] == redisPutScript:
+		if this.data[args[4]] != args[5] {
+			return int64(0), nil
+		}
+		this.data[args[3]] = args[6]
+		return int64(1), nil
+	case args[0] == "EVAL" && args[1] == redisReleaseScript:
+		if this.data[args[3]] != args[4] {
+			return int64(0), nil
+		}
+		delete(this.data, args[3])
+		return int64(1), nil
+	}
+	return nil, errors.Errorf("unsupported command %q", args[0])
+}
+
+// Returns a new replica's view of the OCSP cache at /tmp/ocsp on the given
+// server, without the in-memory copy in front of it.
+func newRedisFile(server *fakeRedis) Updateable {
+	return redisStorage(server, "amppackager:", time.Minute)("/tmp/ocsp").(*Chained).second
+}
+
+func TestRedisStorage(t *testing.T) {
+	server := newFakeRedis()
+	file := newRedisFile(server)
+
+	contents, err := file.Read(context.Background(), isEmpty, func([]byte) ([]byte, string) { return []byte("ocsp"), "" })
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+	stored, _ := server.get("amppackager:{tmp/ocsp}")
+	assert.Equal(t, "ocsp", stored)
+	_, leased := server.get("amppackager:{tmp/ocsp}:lease")
+	assert.False(t, leased)
+
+	// Another replica reads it without updating.
+	contents, err = newRedisFile(server).Read(context.Background(), isEmpty, func([]byte) ([]byte, string) {
+		t.Error("unexpected update")
+		return nil, ""
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+}
+
+func TestRedisStorageUsesStaleContentsWhileLeased(t *testing.T) {
+	server := newFakeRedis()
+	server.set("amppackager:{tmp/ocsp}", "stale")
+	server.set("amppackager:{tmp/ocsp}:lease", "other replica")
+
+	contents, err := newRedisFile(server).Read(context.Background(), func(contents []byte) bool {
+		return string(contents) != "fresh"
+	}, func([]byte) ([]byte, string) {
+		t.Error("unexpected update")
+		return nil, ""
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "stale", string(contents))
+}
+
+func TestRedisStorageLeaseExpiredBeforeWrite(t *testing.T) {
+	server := newFakeRedis()
+
+	_, err := newRedisFile(server).Read(context.Background(), isEmpty, func([]byte) ([]byte, string) {
+		// Our lease expires, and another replica takes it over.
+		server.set("amppackager:{tmp/ocsp}:lease", "other replica")
+		return []byte("ocsp"), ""
+	})
+	assert.Contains(t, errorFrom(err), "lease expired before write")
+	_, stored := server.get("amppackager:{tmp/ocsp}")
+	assert.False(t, stored)
+	// The other replica's lease is untouched.
+	lease, _ := server.get("amppackager:{tmp/ocsp}:lease")
+	assert.Equal(t, "other replica", lease)
+}
+
+func TestRedisStorageUpdatesOnce(t *testing.T) {
+	server := newFakeRedis()
+
+	var updates int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		file := newRedisFile(server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			contents, err := file.Read(context.Background(), isEmpty, func([]byte) ([]byte, string) {
+				atomic.AddInt32(&updates, 1)
+				time.Sleep(100 * time.Millisecond)
+				return []byte("ocsp"), ""
+			})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "ocsp", string(contents))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&updates))
+}
+
+// Serves a single connection, answering each command in turn with the
+// corresponding raw reply. Returns the address to connect to, and a channel
+// of the commands received.
+func serveRESP(t *testing.T, replies ...string) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	received := make(chan []string, len(replies))
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range replies {
+			command, err := readRedisReply(r)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range command.([]interface{}) {
+				args = append(args, arg.(string))
+			}
+			received <- args
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestRESPClient(t *testing.T) {
+	addr, received := serveRESP(t, "+OK\r\n", "+OK\r\n", "$4\r\nocsp\r\n")
+	client := &respClient{&util.RedisStorageConfig{Addr: addr, Password: "secret", DB: 2}}
+	reply, err := client.do(context.Background(), "GET", "key")
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", reply)
+	assert.Equal(t, []string{"AUTH", "secret"}, <-received)
+	assert.Equal(t, []string{"SELECT", "2"}, <-received)
+	assert.Equal(t, []string{"GET", "key"}, <-received)
+}
+
+func TestRESPClientErrorReply(t *testing.T) {
+	addr, _ := serveRESP(t, "-NOAUTH Authentication required.\r\n")
+	client := &respClient{&util.RedisStorageConfig{Addr: addr}}
+	_, err := client.do(context.Background(), "GET", "key")
+	assert.Contains(t, errorFrom(err), "NOAUTH")
+}
+
+func TestReadRedisReply(t *testing.T) {
+	for raw, expected := range map[string]interface{}{
+		"+OK\r\n":                 "OK",
+		"-ERR wrong type\r\n":     redisError("ERR wrong type"),
+		":1\r\n":                  int64(1),
+		"$4\r\noc\r\n\r\n":        "oc\r\n",
+		"$-1\r\n":                 nil,
+		"*2\r\n$1\r\na\r\n:2\r\n": []interface{}{"a", int64(2)},
+		"*-1\r\n":                 nil,
+	} {
+		reply, err := readRedisReply(bufio.NewReader(strings.NewReader(raw)))
+		if assert.NoError(t, err, "%q", raw) {
+			assert.Equal(t, expected, reply, "%q", raw)
+		}
+	}
+	_, err := readRedisReply(bufio.NewReader(strings.NewReader("?\r\n")))
+	assert.Error(t, err)
+}
+
+func errorFrom(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"log"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promCertRevoked = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "amppackager",
+		Subsystem: "certcache",
+		Name:      "cert_revoked",
+		Help:      "Set to 1 while the current cert is reported revoked by its OCSP responder, and so isn't used to sign - by cert name.",
+	},
+	[]string{"cert_name"},
+)
+
+// The cause of the error returned by isHealthy if the OCSP response reports
+// the cert revoked.
+var errCertRevoked = errors.New("certificate revoked")
+
+// Records that the OCSP responder reports the cert of the given name revoked,
+// per the given error from isHealthy. Signing stops at once, as isHealthy
+// fails; this raises the alarm the first time. If auto-renewal is configured,
+// updateOCSP or updateCertIfNecessary then replaces the cert.
+func (this *CertCache) setRevoked(certName string, err error) {
+	this.revokedMu.Lock()
+	isNew := this.revokedCertName != certName
+	this.revokedCertName = certName
+	this.revokedMu.Unlock()
+	if !isNew {
+		return
+	}
+	log.Printf("ALERT: %s; no longer signing with it.", err)
+	promCertRevoked.WithLabelValues(certName).Set(1)
+}
+
+// Returns true if the cert of the given name has been reported revoked.
+func (this *CertCache) isRevokedName(certName string) bool {
+	this.revokedMu.RLock()
+	defer this.revokedMu.RUnlock()
+	return this.revokedCertName != "" && this.revokedCertName == certName
+}
+
+// Returns true if the current cert has been reported revoked.
+func (this *CertCache) isRevoked() bool {
+	this.certsMu.RLock()
+	defer this.certsMu.RUnlock()
+	return this.isRevokedName(this.certName)
+}
+
+// Replaces the current cert, which was revoked, with the pending renewal if
+// any, or else a newly issued one, and fetches its OCSP response. As the new
+// cert has the same key, this doesn't help if the cert was revoked because its
+// key was compromised; that requires replacing the KeyFile.
+func (this *CertCache) replaceRevokedCert() error {
+	this.reissueMu.Lock()
+	defer this.reissueMu.Unlock()
+	if !this.isRevoked() {
+		// Already replaced.
+		return nil
+	}
+	this.revokedMu.RLock()
+	revokedCertName := this.revokedCertName
+	this.revokedMu.RUnlock()
+
+	this.renewedCertsMu.RLock()
+	certs := this.renewedCerts
+	this.renewedCertsMu.RUnlock()
+	if certs != nil && util.CertName(certs[0]) != revokedCertName {
+		log.Println("Replacing revoked cert with the pending renewal.")
+		this.setNewCerts(nil)
+	} else {
+		log.Println("Requesting a new cert from the CA to replace the revoked cert.")
+		var err error
+		if certs, err = this.reissueCert(); err != nil {
+			return errors.Wrap(err, "reissuing revoked cert")
+		}
+	}
+	this.setCerts(certs)
+
+	if _, _, err := this.readOCSP(false); err != nil {
+		return errors.Wrap(err, "fetching OCSP for replacement cert")
+	}
+	return nil
+}
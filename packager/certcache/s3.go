@@ -0,0 +1,322 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+func newS3Storage(config *util.OCSPStorageConfig) (storageFactory, error) {
+	client, err := newS3Client(config.S3)
+	if err != nil {
+		return nil, err
+	}
+	return func(path string) Updateable {
+		key := config.S3.KeyPrefix + remoteKey(path)
+		return &Chained{first: &InMemory{}, second: &leasedFile{
+			name:          config.S3.Bucket + "/" + key,
+			remote:        &s3File{client, key, key + ".lease"},
+			leaseDuration: config.LeaseDuration,
+		}}
+	}, nil
+}
+
+// A file stored at key, whose lease is stored at leaseKey. The lease object
+// contains a random token and its expiry; it's taken with a conditional PUT,
+// and its ETag identifies the holder. The file itself is also written with a
+// conditional PUT, so that a replica whose lease expired mid-update can't
+// overwrite a newer response. This relies on the store supporting If-Match
+// and If-None-Match on PUT, as S3 does.
+type s3File struct {
+	client   *s3Client
+	key      string
+	leaseKey string
+}
+
+func (this *s3File) get(ctx context.Context) ([]byte, string, error) {
+	resp, body, err := this.client.do(ctx, http.MethodGet, this.key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, resp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return nil, "", nil
+	default:
+		return nil, "", s3StatusError(resp, body)
+	}
+}
+
+func (this *s3File) acquire(ctx context.Context, duration time.Duration) (string, error) {
+	token, err := newLeaseToken()
+	if err != nil {
+		return "", err
+	}
+	expiry := time.Now().Add(duration).UnixNano() / int64(time.Millisecond)
+	lease := []byte(token + " " + strconv.FormatInt(expiry, 10))
+
+	header := http.Header{"If-None-Match": {"*"}}
+	resp, body, err := this.client.do(ctx, http.MethodPut, this.leaseKey, header, lease)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Header.Get("ETag"), nil
+	}
+	if !s3PreconditionFailed(resp) {
+		return "", s3StatusError(resp, body)
+	}
+
+	// Another replica holds, or held, the lease. Take it over if expired.
+	resp, body, err = this.client.do(ctx, http.MethodGet, this.leaseKey, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Released in the meantime; the caller will try again.
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", s3StatusError(resp, body)
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 2 {
+		if heldUntil, err := strconv.ParseInt(fields[1], 10, 64); err == nil && time.Now().UnixNano()/int64(time.Millisecond) < heldUntil {
+			return "", nil
+		}
+	}
+	header = http.Header{"If-Match": {resp.Header.Get("ETag")}}
+	resp, body, err = this.client.do(ctx, http.MethodPut, this.leaseKey, header, lease)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Header.Get("ETag"), nil
+	}
+	if s3PreconditionFailed(resp) {
+		// Another replica took it over first.
+		return "", nil
+	}
+	return "", s3StatusError(resp, body)
+}
+
+func (this *s3File) put(ctx context.Context, token string, version string, contents []byte) error {
+	resp, body, err := this.client.do(ctx, http.MethodHead, this.leaseKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != token {
+		return errors.New("lease expired before write")
+	}
+	header := http.Header{"If-Match": {version}}
+	if version == "" {
+		header = http.Header{"If-None-Match": {"*"}}
+	}
+	resp, body, err = this.client.do(ctx, http.MethodPut, this.key, header, contents)
+	if err != nil {
+		return err
+	}
+	if s3PreconditionFailed(resp) {
+		return errors.New("modified by another replica")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3StatusError(resp, body)
+	}
+	return nil
+}
+
+func (this *s3File) release(ctx context.Context, token string) error {
+	header := http.Header{"If-Match": {token}}
+	resp, body, err := this.client.do(ctx, http.MethodDelete, this.leaseKey, header, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotFound, s3PreconditionFailed(resp):
+		return nil
+	default:
+		return s3StatusError(resp, body)
+	}
+}
+
+// S3 returns 409 rather than 412 if a conflicting conditional write is in
+// progress.
+func s3PreconditionFailed(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict
+}
+
+func s3StatusError(resp *http.Response, body []byte) error {
+	const maxBody = 200
+	if len(body) > maxBody {
+		body = body[:maxBody]
+	}
+	return errors.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, body)
+}
+
+// A minimal client for the S3 API, sufficient for the few requests above.
+type s3Client struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	client          http.Client
+	timeNow         func() time.Time
+}
+
+func newS3Client(config *util.S3StorageConfig) (*s3Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing S3 endpoint")
+	}
+	client := &s3Client{
+		endpoint:        endpoint,
+		region:          config.Region,
+		bucket:          config.Bucket,
+		accessKeyID:     config.AccessKeyID,
+		secretAccessKey: config.SecretAccessKey,
+		client:          http.Client{Timeout: 60 * time.Second},
+		timeNow:         time.Now,
+	}
+	if client.accessKeyID == "" {
+		client.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		client.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		client.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if client.accessKeyID == "" || client.secretAccessKey == "" {
+		return nil, errors.New("missing S3 credentials")
+	}
+	return client, nil
+}
+
+// Returns the escaping of s per S3's canonical URI, which leaves only the
+// unreserved characters of RFC 3986 as is.
+func s3Escape(s string) string {
+	var ret strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			ret.WriteByte(c)
+		} else {
+			ret.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return ret.String()
+}
+
+// Sends a request for the given key and returns the response, with its body
+// read.
+func (this *s3Client) do(ctx context.Context, method string, key string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := *this.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + this.bucket + "/" + key
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	this.sign(req, body, this.timeNow())
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%s %s", method, u.String())
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s %s", method, u.String())
+	}
+	return resp, respBody, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Signs the request per
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+// All of its headers are signed.
+func (this *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if this.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", this.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + this.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+this.secretAccessKey), date)
+	key = hmacSHA256(key, this.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+this.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
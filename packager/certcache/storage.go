@@ -1,12 +1,15 @@
 package certcache
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/gofrs/flock"
 	"github.com/pkg/errors"
@@ -19,8 +22,9 @@ import (
 type Updateable interface {
 	// Reads the contents of the file. Calls isExpired(contents); if true,
 	// then it calls update() and writes the returned contents back to the
-	// file.
-	Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) []byte) ([]byte, error)
+	// file. update() also returns the URL of the OCSP responder that the
+	// contents were fetched from, if any, for Updateables that record it.
+	Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error)
 }
 
 // Uses the OS's file locking mechanisms to obtain shared/exclusive locks to
@@ -55,12 +59,21 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-func (this *LocalFile) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) []byte) ([]byte, error) {
+// How long LocalFile.Read waits for the file lock, e.g. while another process
+// updates the file, unless ctx has an earlier deadline.
+const localFileLockTimeout = 2 * time.Minute
+
+// How often LocalFile.Read retries taking the file lock.
+const localFileLockRetryDelay = 100 * time.Millisecond
+
+func (this *LocalFile) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error) {
+	lockCtx, cancel := context.WithTimeout(ctx, localFileLockTimeout)
+	defer cancel()
 	// Use independent .lock file; necessary on Windows to avoid "The process cannot
 	// access the file because another process has locked a portion of the file."
 	lockPath := this.path + ".lock"
 	lock := flock.New(lockPath)
-	locked, err := lock.TryRLock()
+	locked, err := lock.TryRLockContext(lockCtx, localFileLockRetryDelay)
 	if err != nil {
 		return nil, errors.Wrapf(err, "obtaining shared lock for %s", lockPath)
 	}
@@ -73,24 +86,11 @@ func (this *LocalFile) Read(ctx context.Context, isExpired func([]byte) bool, up
 		}
 	}()
 
-	// Check whether OCSP cache file exists.
-	pathExists, err := exists(this.path)
+	// If the cache file exists, read it and check freshness. Note that
+	// zero-length contents are considered "expired" by isExpired().
+	contents, err := this.read()
 	if err != nil {
-		return nil, errors.Wrapf(err, "checking file exists %s", this.path)
-	}
-
-	// Initialize empty contents.
-	var contents []byte
-
-	// If cache file exists, read it and check freshness. Note that zero-length
-	// contents are considered "expired" by isExpired(). If an attempt is made
-	// to read the file before it exists on Windows, error "The system cannot
-	// find the file specified." is thrown.
-	if pathExists {
-		contents, err = ioutil.ReadFile(this.path)
-		if err != nil {
-			return nil, errors.Wrapf(err, "reading %s", this.path)
-		}
+		return nil, err
 	}
 
 	// At first glance, this looks like "broken" double-checked locking, as in
@@ -111,7 +111,7 @@ func (this *LocalFile) Read(ctx context.Context, isExpired func([]byte) bool, up
 				return nil, errors.Wrapf(err, "Error unlocking %s", lockPath)
 			}
 		}
-		locked, err = lock.TryLock()
+		locked, err = lock.TryLockContext(lockCtx, localFileLockRetryDelay)
 		if err != nil {
 			return nil, errors.Wrapf(err, "obtaining exclusive lock for %s", lockPath)
 		}
@@ -122,23 +122,103 @@ func (this *LocalFile) Read(ctx context.Context, isExpired func([]byte) bool, up
 		// Reread the file while in write-lock, to make the
 		// read-modify-write atomic, and thus reduce the chance of
 		// multiple calls to update() in parallel.
-		if pathExists {
-			contents, err := ioutil.ReadFile(this.path)
-			if err != nil {
-				return nil, errors.Wrapf(err, "rereading %s", this.path)
-			}
-			if !isExpired(contents) {
-				return contents, nil
-			}
+		contents, err = this.read()
+		if err != nil {
+			return nil, errors.Wrap(err, "rereading")
+		}
+		if !isExpired(contents) {
+			return contents, nil
 		}
 
-		contents = update(contents)
-		// TODO(twifkak): Should I write to a tempfile in the same dir and move into place, instead?
-		if err = ioutil.WriteFile(this.path, contents, 0600); err != nil {
+		newContents, responder := update(contents)
+		if bytes.Equal(newContents, contents) {
+			// The update failed; keep the original fetch metadata.
+			return contents, nil
+		}
+		envelope := &localFileEnvelope{
+			fetched:   time.Now(),
+			responder: responder,
+			contents:  newContents,
+		}
+		if err = writeFileAtomically(this.path, envelope.encode()); err != nil {
 			return nil, errors.Wrapf(err, "writing %s", this.path)
 		}
-		return contents, nil
+		return newContents, nil
+	}
+}
+
+// Returns the contents of the file, or nil if it doesn't exist or is corrupt.
+// Corrupt files are renamed with a .corrupt extension, for later inspection,
+// so that the next update replaces them.
+func (this *LocalFile) read() ([]byte, error) {
+	// Check whether OCSP cache file exists. If an attempt is made to read
+	// the file before it exists on Windows, error "The system cannot find
+	// the file specified." is thrown.
+	pathExists, err := exists(this.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checking file exists %s", this.path)
+	}
+	if !pathExists {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", this.path)
+	}
+	envelope, err := decodeLocalFileEnvelope(data)
+	if err != nil {
+		quarantinePath := this.path + ".corrupt"
+		log.Printf("Quarantining corrupt %s to %s: %s", this.path, quarantinePath, err)
+		// As the lock is held, nobody is writing the file, though
+		// other readers may also try to rename it.
+		if err := os.Rename(this.path, quarantinePath); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "quarantining %s", this.path)
+		}
+		return nil, nil
+	}
+	return envelope.contents, nil
+}
+
+// Writes the file via a tempfile in the same directory, so that a crash
+// mid-write doesn't leave a truncated file in its place.
+func writeFileAtomically(path string, data []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating tempfile")
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		if tempFile != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+		}
+	}()
+	if _, err := tempFile.Write(data); err != nil {
+		return errors.Wrapf(err, "writing %s", tempPath)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return errors.Wrapf(err, "syncing %s", tempPath)
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", tempPath)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return errors.Wrapf(err, "renaming %s", tempPath)
+	}
+	tempFile = nil
+	// Persist the rename. Directories can't be synced on Windows, where
+	// it's unnecessary.
+	if runtime.GOOS != "windows" {
+		dir, err := os.Open(filepath.Dir(path))
+		if err != nil {
+			return errors.Wrap(err, "opening parent directory")
+		}
+		defer dir.Close()
+		if err := dir.Sync(); err != nil {
+			return errors.Wrap(err, "syncing parent directory")
+		}
 	}
+	return nil
 }
 
 // Represents an in-memory copy of a file.
@@ -153,7 +233,7 @@ func (this *InMemory) read() []byte {
 	return this.contents
 }
 
-func (this *InMemory) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) []byte) ([]byte, error) {
+func (this *InMemory) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error) {
 	contents := this.read()
 	// The note above about double-checked locking applies here.
 	if !isExpired(contents) {
@@ -164,7 +244,7 @@ func (this *InMemory) Read(ctx context.Context, isExpired func([]byte) bool, upd
 	if !isExpired(this.contents) {
 		return this.contents, nil
 	}
-	this.contents = update(this.contents)
+	this.contents, _ = update(this.contents)
 	return this.contents, nil
 }
 
@@ -175,13 +255,13 @@ type Chained struct {
 	first, second Updateable
 }
 
-func (this *Chained) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) []byte) ([]byte, error) {
-	return this.first.Read(ctx, isExpired, func([]byte) []byte {
+func (this *Chained) Read(ctx context.Context, isExpired func([]byte) bool, update func([]byte) ([]byte, string)) ([]byte, error) {
+	return this.first.Read(ctx, isExpired, func([]byte) ([]byte, string) {
 		contents, err := this.second.Read(ctx, isExpired, update)
 		if err != nil {
 			log.Printf("%+v", err)
-			return nil
+			return nil, ""
 		}
-		return contents
+		return contents, ""
 	})
 }
@@ -0,0 +1,159 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func noUpdate(t *testing.T) func([]byte) ([]byte, string) {
+	return func([]byte) ([]byte, string) {
+		t.Error("unexpected update")
+		return nil, ""
+	}
+}
+
+func TestLocalFileWritesEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &LocalFile{path: filepath.Join(dir, "ocsp")}
+
+	contents, err := file.Read(context.Background(), isEmpty, func([]byte) ([]byte, string) {
+		return []byte("ocsp"), "http://ocsp.example.com"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+
+	data, err := ioutil.ReadFile(file.path)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "AMPPKG-OCSP 1\nFetched: "))
+	assert.Contains(t, string(data), "\nResponder: http://ocsp.example.com\nLength: 4\n")
+	assert.True(t, strings.HasSuffix(string(data), "\n\nocsp"))
+	// The tempfile was renamed into place.
+	names, err := filepath.Glob(filepath.Join(dir, "ocsp*"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{file.path, file.path + ".lock"}, names)
+
+	contents, err = file.Read(context.Background(), isEmpty, noUpdate(t))
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+}
+
+func TestLocalFileReadsFileWithoutEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &LocalFile{path: filepath.Join(dir, "ocsp")}
+	require.NoError(t, ioutil.WriteFile(file.path, []byte("ocsp"), 0600))
+
+	contents, err := file.Read(context.Background(), isEmpty, noUpdate(t))
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+}
+
+func TestLocalFileQuarantinesCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &LocalFile{path: filepath.Join(dir, "ocsp")}
+
+	for _, corrupt := range []string{
+		// Truncated.
+		"AMPPKG-OCSP 1\nFetched: 2021-08-01T00:00:00Z\nLength: 4\nSHA-256: uRMGfwf9QTVKxkQCv3tbXTsoYu1Wfb9361LbknfbW+U=\n\noc",
+		"AMPPKG-OCSP 1\nFetched: 2021-08-01T00:00:00Z\nLen",
+		// Bit flip.
+		"AMPPKG-OCSP 1\nFetched: 2021-08-01T00:00:00Z\nLength: 4\nSHA-256: uRMGfwf9QTVKxkQCv3tbXTsoYu1Wfb9361LbknfbW+U=\n\nocsq",
+	} {
+		require.NoError(t, ioutil.WriteFile(file.path, []byte(corrupt), 0600))
+
+		contents, err := file.Read(context.Background(), isEmpty, func(orig []byte) ([]byte, string) {
+			assert.Empty(t, orig)
+			return []byte("ocsp"), ""
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "ocsp", string(contents))
+
+		quarantined, err := ioutil.ReadFile(file.path + ".corrupt")
+		require.NoError(t, err)
+		assert.Equal(t, corrupt, string(quarantined))
+		contents, err = file.Read(context.Background(), isEmpty, noUpdate(t))
+		require.NoError(t, err)
+		assert.Equal(t, "ocsp", string(contents))
+	}
+}
+
+func TestLocalFileWaitsForLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := &LocalFile{path: filepath.Join(dir, "ocsp")}
+
+	// Another process is updating the file.
+	lock := flock.New(file.path + ".lock")
+	require.NoError(t, lock.Lock())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = file.Read(ctx, isEmpty, noUpdate(t))
+	assert.Contains(t, errorFrom(err), "obtaining shared lock")
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ioutil.WriteFile(file.path, []byte("ocsp"), 0600)
+		lock.Unlock()
+	}()
+	contents, err := file.Read(context.Background(), isEmpty, noUpdate(t))
+	require.NoError(t, err)
+	assert.Equal(t, "ocsp", string(contents))
+}
+
+func TestLocalFileUpdatesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var updates int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		file := &LocalFile{path: filepath.Join(dir, "ocsp")}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			contents, err := file.Read(context.Background(), isEmpty, func([]byte) ([]byte, string) {
+				atomic.AddInt32(&updates, 1)
+				time.Sleep(100 * time.Millisecond)
+				return []byte("ocsp"), ""
+			})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "ocsp", string(contents))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&updates))
+}
@@ -70,6 +70,9 @@ type routingRule struct {
 type mux struct {
 	routingMatrix []routingRule
 	defaultRule   routingRule
+	// If true, the default rule accepts requests of any method, not just
+	// those in allowedMethods.
+	defaultRuleAnyMethod bool
 }
 
 // return404 is a URL Path Suffix Validator that always returns 404.
@@ -92,6 +95,10 @@ func expectSignerQuery(suffix string, req *http.Request, params *map[string]stri
 	}
 }
 
+// acceptAnySuffix is a URL Path Suffix Validator that accepts any suffix.
+func acceptAnySuffix(suffix string, req *http.Request, params *map[string]string, errorMsg *string, errorCode *int) {
+}
+
 // expectCertQuery is a URL Path Suffix Validator specific to cert requests.
 func expectCertQuery(suffix string, req *http.Request, params *map[string]string, errorMsg *string, errorCode *int) {
 	unescaped, err := url.PathUnescape(suffix)
@@ -103,7 +110,7 @@ func expectCertQuery(suffix string, req *http.Request, params *map[string]string
 }
 
 // New is the main entry point. Use the return value for http.Server.Handler.
-func New(certCache http.Handler, signer http.Handler, validityMap http.Handler, healthz http.Handler, metrics http.Handler) http.Handler {
+func New(certCache http.Handler, signer http.Handler, explainer http.Handler, validityMap http.Handler, healthz http.Handler, metrics http.Handler) http.Handler {
 	return &mux{
 		// Note that the order of rules in the matrix matters: the first
 		// matching rule will be applied, so the rule for “/priv/doc/” precedes
@@ -112,12 +119,32 @@ func New(certCache http.Handler, signer http.Handler, validityMap http.Handler,
 		[]routingRule{
 			{util.SignerURLPrefix + "/", expectSignerQuery, signer, "signer"},
 			{util.SignerURLPrefix, expectNoSuffix, signer, "signer"},
+			{util.ExplainURLPrefix + "/", expectSignerQuery, explainer, "explainer"},
+			{util.ExplainURLPrefix, expectNoSuffix, explainer, "explainer"},
 			{util.CertURLPrefix + "/", expectCertQuery, certCache, "certCache"},
 			{util.ValidityMapPath, expectNoSuffix, validityMap, "validityMap"},
 			{util.HealthzPath, expectNoSuffix, healthz, "healthz"},
 			{util.MetricsPath, expectNoSuffix, metrics, "metrics"},
 		},
 		/* defaultRule= */ routingRule{"", return404, nil, "handler_not_assigned"},
+		/* defaultRuleAnyMethod= */ false,
+	}
+}
+
+// NewFrontEnd returns a mux for running the packager as a transparent front end
+// to the origin (see signer.FrontEnd). It serves the packager's own resources
+// as New does, except for the /priv/ ones, and passes every other request, of
+// any method, to frontEnd.
+func NewFrontEnd(certCache http.Handler, frontEnd http.Handler, validityMap http.Handler, healthz http.Handler, metrics http.Handler) http.Handler {
+	return &mux{
+		[]routingRule{
+			{util.CertURLPrefix + "/", expectCertQuery, certCache, "certCache"},
+			{util.ValidityMapPath, expectNoSuffix, validityMap, "validityMap"},
+			{util.HealthzPath, expectNoSuffix, healthz, "healthz"},
+			{util.MetricsPath, expectNoSuffix, metrics, "metrics"},
+		},
+		/* defaultRule= */ routingRule{"", acceptAnySuffix, frontEnd, "frontEnd"},
+		/* defaultRuleAnyMethod= */ true,
 	}
 }
 
@@ -164,14 +191,16 @@ func (this *mux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	anyMethod := false
 	if matchingRule == nil {
 		matchingRule = &this.defaultRule
+		anyMethod = this.defaultRuleAnyMethod
 	}
 
 	errorMsg := ""
 	errorCode := 0
 	// Validate HTTP method and params, parse params and attach them to req.
-	if !allowedMethods[req.Method] {
+	if !anyMethod && !allowedMethods[req.Method] {
 		errorMsg, errorCode = "405 method not allowed", http.StatusMethodNotAllowed
 	} else {
 		params := map[string]string{}
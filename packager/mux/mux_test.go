@@ -100,6 +100,16 @@ func TestServeHTTPSuccess(t *testing.T) {
 			testURL:       `$HOST/priv/doc/$FETCH%2A\?amp=1%2A\`,
 			expectHandler: `signer`,
 			expectParams:  map[string]string{`signURL`: `$FETCH%2A%5C?amp=1%2A\`},
+		}, {
+			testName:      `Explainer - with query, regular`,
+			testURL:       `$HOST/priv/explain?fetch=$FETCH&sign=$SIGN`,
+			expectHandler: `explainer`,
+			expectParams:  map[string]string{},
+		}, {
+			testName:      `Explainer - with path and query, regular`,
+			testURL:       `$HOST/priv/explain/$FETCH?amp=1`,
+			expectHandler: `explainer`,
+			expectParams:  map[string]string{`signURL`: `$FETCH?amp=1`},
 		}, {
 			testName:      `Cert - empty`,
 			testURL:       `$HOST/amppkg/cert/`,
@@ -136,7 +146,7 @@ func TestServeHTTPSuccess(t *testing.T) {
 		testName := tt.testName
 		t.Run(testName, func(t *testing.T) {
 			// Defer validation to ensure it does happen.
-			mocks := map[string](*mockedHandler){"signer": &mockedHandler{}, "healthz": &mockedHandler{}, "cert": &mockedHandler{}, "validityMap": &mockedHandler{}, "metrics": &mockedHandler{}}
+			mocks := map[string](*mockedHandler){"signer": &mockedHandler{}, "explainer": &mockedHandler{}, "healthz": &mockedHandler{}, "cert": &mockedHandler{}, "validityMap": &mockedHandler{}, "metrics": &mockedHandler{}}
 			var actualResp *http.Response
 			defer func() {
 				// Expect no errors.
@@ -159,7 +169,7 @@ func TestServeHTTPSuccess(t *testing.T) {
 			expectMockedHandler.On("ServeHTTP", tt.expectParams)
 
 			// Run.
-			mux := New(mocks["cert"], mocks["signer"], mocks["validityMap"], mocks["healthz"], mocks["metrics"])
+			mux := New(mocks["cert"], mocks["signer"], mocks["explainer"], mocks["validityMap"], mocks["healthz"], mocks["metrics"])
 			actualResp = pkgt.NewRequest(t, mux, tt.testURL).Do()
 		})
 	}
@@ -179,8 +189,8 @@ func expectError(t *testing.T, url string, expectErrorMessage string, expectErro
 		mockedHandler.AssertExpectations(t)
 	}()
 
-	// Initialize mux with 4 identical mocked handlers, because no calls are expect to any of them.
-	mux := New(mockedHandler, mockedHandler, mockedHandler, mockedHandler, mockedHandler)
+	// Initialize mux with 6 identical mocked handlers, because no calls are expect to any of them.
+	mux := New(mockedHandler, mockedHandler, mockedHandler, mockedHandler, mockedHandler, mockedHandler)
 
 	// Run and extract error.
 	actualResp = pkgt.NewRequest(t, mux, url).SetBody(body).Do()
@@ -196,6 +206,7 @@ func TestServeHTTPexpect404s(t *testing.T) {
 	}{
 		{"No such endpoint                      ", "$HOST/abc"},
 		{"Signer - unexpected extra char        ", "$HOST/priv/doc1"},
+		{"Explainer - unexpected extra char     ", "$HOST/priv/explain1"},
 		{"Cert - no closing slash               ", "$HOST/amppkg/cert"},
 		{"ValidityMap - unexpected closing slash", "$HOST/amppkg/validity/"},
 		{"Healthz - unexpected closing slash    ", "$HOST/healthz/"},
@@ -214,6 +225,46 @@ func TestServeHTTPexpect405(t *testing.T) {
 	expectError(t, expand("$HOST/healthz"), "405 method not allowed\n", http.StatusMethodNotAllowed, body)
 }
 
+func TestFrontEnd(t *testing.T) {
+	for _, tt := range []struct {
+		method        string
+		url           string
+		expectHandler string
+		expectParams  map[string]string
+	}{
+		{"GET", "$HOST/some_page?amp=1", "frontEnd", map[string]string{}},
+		{"POST", "$HOST/form", "frontEnd", map[string]string{}},
+		{"GET", "$HOST/priv/doc?sign=$SIGN", "frontEnd", map[string]string{}},
+		{"GET", "$HOST/amppkg/cert/$CERT", "cert", map[string]string{"certName": "$CERT"}},
+		{"GET", "$HOST/amppkg/validity", "validityMap", map[string]string{}},
+		{"GET", "$HOST/healthz", "healthz", map[string]string{}},
+	} {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			mocks := map[string]*mockedHandler{"frontEnd": {}, "cert": {}, "validityMap": {}, "healthz": {}, "metrics": {}}
+			for k, v := range tt.expectParams {
+				tt.expectParams[k] = expand(v)
+			}
+			mocks[tt.expectHandler].On("ServeHTTP", tt.expectParams)
+
+			mux := NewFrontEnd(mocks["cert"], mocks["frontEnd"], mocks["validityMap"], mocks["healthz"], mocks["metrics"])
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, httptest.NewRequest(tt.method, expand(tt.url), nil))
+			assert.Equal(t, http.StatusOK, resp.Code)
+			for _, mockedHandler := range mocks {
+				mockedHandler.AssertExpectations(t)
+			}
+		})
+	}
+
+	// The packager's own resources still only accept GET and HEAD.
+	mockedHandler := new(mockedHandler)
+	mux := NewFrontEnd(mockedHandler, mockedHandler, mockedHandler, mockedHandler, mockedHandler)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest("POST", expand("$HOST/healthz"), nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	mockedHandler.AssertExpectations(t)
+}
+
 func TestParamsIncorrectValueType(t *testing.T) {
 	req := httptest.NewRequest("", "http://abc.com", nil)
 
@@ -318,7 +369,7 @@ func TestPrometheusMetricRequestsLatency(t *testing.T) {
 					http.Error(w, "404 page not found", 404)
 				}
 			}))
-			mux := New(mockHandler, mockHandler, mockHandler, mockHandler, mockHandler)
+			mux := New(mockHandler, mockHandler, mockHandler, mockHandler, mockHandler, mockHandler)
 			pkgt.NewRequest(t, mux, expand(req.urlTemplate)).Do()
 
 		}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promCoalescedRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "coalesced_requests_total",
+		Help:      "Total number of requests served with the SXG packaged for an identical concurrent request, rather than fetching and packaging it themselves.",
+	},
+	[]string{},
+)
+
+// inflightGroup tracks in-progress packaging of SXGs, so that concurrent
+// identical requests can share the result of one fetch, transform, and sign.
+// This is similar to golang.org/x/sync/singleflight, except that the leader
+// streams its own response rather than returning a value, and publishes the
+// SXG (if any) to the waiters as soon as it's available.
+type inflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done chan struct{}
+	once sync.Once
+	// Only valid after done is closed. Nil if the leader didn't produce an
+	// SXG, in which case waiters must handle the request themselves.
+	sxg []byte
+	// The outer ETag of sxg, if any.
+	etag string
+	// The number of requests waiting on this call. Guarded by
+	// inflightGroup.mu. Exposed for testing.
+	waiters int
+}
+
+// join returns the in-progress call for the given key, and whether the caller
+// is its leader. The leader must call finish exactly once (or more; only the
+// first has any effect); other callers should wait on done.
+func (this *inflightGroup) join(key string) (*inflightCall, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if call, ok := this.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+	if this.calls == nil {
+		this.calls = map[string]*inflightCall{}
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	this.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's SXG (empty if it didn't produce one) and its
+// outer ETag to the waiters, and removes the call from the group, so that
+// subsequent requests start a new one. The SXG is copied only if there are
+// waiters, as the leader may reuse its buffers once it's written.
+func (this *inflightGroup) finish(key string, call *inflightCall, sxg serializedSXG, etag string) {
+	call.once.Do(func() {
+		this.mu.Lock()
+		if this.calls[key] == call {
+			delete(this.calls, key)
+		}
+		waiters := call.waiters
+		this.mu.Unlock()
+		if waiters > 0 {
+			call.sxg = sxg.Bytes()
+		}
+		call.etag = etag
+		close(call.done)
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/andybalholm/brotli"
+)
+
+// Returns the Content-Encoding to use for a response to a request with the
+// given Accept-Encoding header, or "" for identity. Brotli is preferred over
+// gzip when both are equally acceptable, as it compresses HTML better.
+func negotiateContentEncoding(acceptEncoding string) string {
+	qvalues := map[string]float64{}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qvalues[coding] = q
+	}
+	qvalue := func(coding string) float64 {
+		if q, ok := qvalues[coding]; ok {
+			return q
+		}
+		if q, ok := qvalues["*"]; ok {
+			return q
+		}
+		return 0
+	}
+	if br, gz := qvalue("br"), qvalue("gzip"); br > 0 && br >= gz {
+		return "br"
+	} else if gz > 0 {
+		return "gzip"
+	}
+	return ""
+}
+
+// Responses with these status codes have no body, so are never compressed.
+func bodyAllowedForStatus(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// compressingResponseWriter compresses the response body per the negotiated
+// Content-Encoding. It's applied to the outer response (i.e. the SXG as a
+// whole, or the unsigned proxied response), so it never affects what's signed.
+// Responses that already have a Content-Encoding (e.g. proxied responses that
+// decodeResponseBody couldn't decode) are passed through as-is.
+//
+// Close must be called once the handler is done writing.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	config   *util.CompressionConfig
+	encoding string
+	// Non-nil iff the response is being compressed.
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func newCompressingResponseWriter(resp http.ResponseWriter, req *http.Request, config *util.CompressionConfig) *compressingResponseWriter {
+	return &compressingResponseWriter{
+		ResponseWriter: resp,
+		config:         config,
+		encoding:       negotiateContentEncoding(GetJoined(req.Header, "Accept-Encoding")),
+	}
+}
+
+func (this *compressingResponseWriter) WriteHeader(status int) {
+	if this.wroteHeader {
+		// Let the underlying ResponseWriter log the superfluous call.
+		this.ResponseWriter.WriteHeader(status)
+		return
+	}
+	this.wroteHeader = true
+	header := this.Header()
+	// The choice of Content-Encoding depends on Accept-Encoding, whether or
+	// not this response is compressed. Upstream Vary headers may have
+	// replaced the signer's, so this is checked last.
+	if !headerContainsToken(header, "Vary", "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if this.encoding != "" && bodyAllowedForStatus(status) && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", this.encoding)
+		header.Del("Content-Length")
+		// The compressed representation differs byte-for-byte, so a strong
+		// validator no longer applies, per
+		// https://tools.ietf.org/html/rfc7232#section-2.1.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		this.encoder = this.newEncoder()
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *compressingResponseWriter) newEncoder() io.WriteCloser {
+	switch this.encoding {
+	case "br":
+		return brotli.NewWriterLevel(this.ResponseWriter, this.config.BrotliLevel)
+	default:
+		// The level is validated by util.ReadConfig.
+		encoder, err := gzip.NewWriterLevel(this.ResponseWriter, this.config.GzipLevel)
+		if err != nil {
+			encoder = gzip.NewWriter(this.ResponseWriter)
+		}
+		return encoder
+	}
+}
+
+func (this *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !this.wroteHeader {
+		this.WriteHeader(http.StatusOK)
+	}
+	if this.encoder != nil {
+		return this.encoder.Write(b)
+	}
+	return this.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, so that streamed proxy responses aren't held
+// up by the encoder's buffer.
+func (this *compressingResponseWriter) Flush() {
+	if flusher, ok := this.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes any buffered compressed data and the compression trailer.
+func (this *compressingResponseWriter) Close() error {
+	if this.encoder == nil {
+		return nil
+	}
+	return this.encoder.Close()
+}
+
+// Returns true if the comma-separated values of the named header include the
+// given token, case-insensitively.
+func headerContainsToken(h http.Header, name string, token string) bool {
+	for _, value := range strings.Split(GetJoined(h, name), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
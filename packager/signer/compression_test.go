@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCompressionConfig = &util.CompressionConfig{GzipLevel: 6, BrotliLevel: 5}
+
+// Decodes the body of resp per its Content-Encoding.
+func decodedBodyOf(t *testing.T, resp *http.Response) []byte {
+	require.NoError(t, decodeResponseBody(resp))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return body
+}
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	assert.Equal(t, "", negotiateContentEncoding(""))
+	assert.Equal(t, "", negotiateContentEncoding("identity"))
+	assert.Equal(t, "", negotiateContentEncoding("deflate, zstd"))
+	assert.Equal(t, "gzip", negotiateContentEncoding("gzip"))
+	assert.Equal(t, "gzip", negotiateContentEncoding("GZIP;q=0.5"))
+	assert.Equal(t, "br", negotiateContentEncoding("gzip, deflate, br"))
+	assert.Equal(t, "gzip", negotiateContentEncoding("gzip, br;q=0.9"))
+	assert.Equal(t, "gzip", negotiateContentEncoding("gzip, br;q=0"))
+	assert.Equal(t, "", negotiateContentEncoding("gzip;q=0, br;q=0"))
+	assert.Equal(t, "br", negotiateContentEncoding("*"))
+	assert.Equal(t, "gzip", negotiateContentEncoding("*, br;q=0"))
+}
+
+func compress(t *testing.T, acceptEncoding string, write func(http.ResponseWriter)) *http.Response {
+	req := httptest.NewRequest("", "/", nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	rec := httptest.NewRecorder()
+	compressor := newCompressingResponseWriter(rec, req, testCompressionConfig)
+	write(compressor)
+	require.NoError(t, compressor.Close())
+	return rec.Result()
+}
+
+func TestCompressingResponseWriter(t *testing.T) {
+	for _, encoding := range []string{"gzip", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			resp := compress(t, encoding, func(resp http.ResponseWriter) {
+				resp.Header().Set("Content-Length", "1234")
+				resp.Header().Set("ETag", `"abc"`)
+				resp.Header().Set("Vary", "Accept")
+				resp.Write(fakeBody)
+			})
+			assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, []string{"Accept", "Accept-Encoding"}, resp.Header["Vary"])
+			assert.Empty(t, resp.Header.Get("Content-Length"))
+			assert.Equal(t, `W/"abc"`, resp.Header.Get("ETag"))
+			assert.Equal(t, fakeBody, decodedBodyOf(t, resp))
+		})
+	}
+}
+
+func TestCompressingResponseWriterIdentity(t *testing.T) {
+	resp := compress(t, "", func(resp http.ResponseWriter) {
+		resp.Header().Set("ETag", `"abc"`)
+		resp.Write(fakeBody)
+	})
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, `"abc"`, resp.Header.Get("ETag"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fakeBody, body)
+}
+
+func TestCompressingResponseWriterAlreadyEncoded(t *testing.T) {
+	resp := compress(t, "gzip", func(resp http.ResponseWriter) {
+		resp.Header().Set("Content-Encoding", "zstd")
+		resp.Header().Set("Vary", "accept-encoding")
+		resp.Write(fakeBody)
+	})
+	assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"accept-encoding"}, resp.Header["Vary"])
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fakeBody, body)
+}
+
+func TestCompressingResponseWriterNotModified(t *testing.T) {
+	resp := compress(t, "gzip", func(resp http.ResponseWriter) {
+		resp.WriteHeader(http.StatusNotModified)
+	})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
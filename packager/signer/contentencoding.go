@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The Accept-Encoding request header sent to the origin. Setting it explicitly
+// disables http.Transport's transparent gzip decoding, so every encoding
+// listed here must be handled by decodeResponseBody.
+const upstreamAcceptEncoding = "br, gzip, deflate"
+
+var promUpstreamContentEncodings = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "upstream_content_encodings_total",
+		Help:      "Total number of compressed gateway responses from AMP document server, by Content-Encoding: br, gzip, deflate, or unsupported (proxied as-is).",
+	},
+	[]string{"encoding"},
+)
+
+// A decoded response body, which closes the decoders along with the original
+// body.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (this *decodedBody) Close() error {
+	var ret error
+	for _, closer := range this.closers {
+		if err := closer.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// The Content-Encodings that newDecoder supports.
+var supportedContentCodings = map[string]bool{
+	"br":      true,
+	"gzip":    true,
+	"x-gzip":  true,
+	"deflate": true,
+}
+
+// Returns a reader that decodes the given Content-Encoding.
+func newDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewReader(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Per https://tools.ietf.org/html/rfc7230#section-4.2.2, this is
+		// zlib-wrapped, but some servers send raw deflate, so sniff it.
+		buffered := bufio.NewReader(r)
+		if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	}
+	return nil, errors.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+// Per https://tools.ietf.org/html/rfc1950#section-2.2, the compression method
+// must be 8 (deflate), and the two header bytes must be a multiple of 31.
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// Returns the codings listed in the Content-Encoding header, in the order they
+// were applied, ignoring identity.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, value := range h["Content-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// decodeResponseBody replaces resp.Body with its decoding per the
+// Content-Encoding header, and removes that header along with Content-Length,
+// so that the transformer and signer operate on the identity encoding. If any
+// of the codings is unsupported, resp is left unchanged; validateFetch rejects
+// it, so it is proxied as-is.
+func decodeResponseBody(resp *http.Response) error {
+	codings := contentCodings(resp.Header)
+	if len(codings) == 0 {
+		return nil
+	}
+	// Responses to a 304 or 204 have no body to decode.
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	for _, coding := range codings {
+		if !supportedContentCodings[coding] {
+			promUpstreamContentEncodings.WithLabelValues("unsupported").Inc()
+			return nil
+		}
+	}
+	body := &decodedBody{resp.Body, []io.Closer{resp.Body}}
+	// Codings are listed in the order they were applied, so undo them in
+	// reverse.
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(codings[i], body.Reader)
+		if err != nil {
+			return errors.Wrapf(err, "decoding %s", codings[i])
+		}
+		if closer, ok := decoder.(io.Closer); ok {
+			body.closers = append([]io.Closer{closer}, body.closers...)
+		}
+		body.Reader = decoder
+		promUpstreamContentEncodings.WithLabelValues(strings.TrimPrefix(codings[i], "x-")).Inc()
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Encodes body with the given Content-Encoding. "raw-deflate" produces deflate
+// without the zlib wrapper, as sent by some servers.
+func encode(t *testing.T, encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		var err error
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		require.NoError(t, err)
+	default:
+		t.Fatalf("unknown encoding %s", encoding)
+	}
+	_, err := w.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func newEncodedResponse(encoding string, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Encoding": {encoding}, "Content-Length": {"1234"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: 1234,
+	}
+}
+
+func TestContentCodings(t *testing.T) {
+	assert.Nil(t, contentCodings(http.Header{}))
+	assert.Nil(t, contentCodings(http.Header{"Content-Encoding": {"identity"}}))
+	assert.Equal(t, []string{"gzip", "br"}, contentCodings(http.Header{"Content-Encoding": {"GZip, identity,br"}}))
+	assert.Equal(t, []string{"deflate", "gzip"}, contentCodings(http.Header{"Content-Encoding": {"deflate", "gzip"}}))
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	for _, encoding := range []string{"br", "gzip", "deflate", "raw-deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			headerValue := encoding
+			if encoding == "raw-deflate" {
+				headerValue = "deflate"
+			}
+			resp := newEncodedResponse(headerValue, encode(t, encoding, fakeBody))
+			require.NoError(t, decodeResponseBody(resp))
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.NoError(t, resp.Body.Close())
+			assert.Equal(t, fakeBody, body)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"))
+			assert.Empty(t, resp.Header.Get("Content-Length"))
+			assert.Equal(t, int64(-1), resp.ContentLength)
+		})
+	}
+}
+
+func TestDecodeResponseBodyMultipleCodings(t *testing.T) {
+	resp := newEncodedResponse("gzip, br", encode(t, "br", encode(t, "gzip", fakeBody)))
+	require.NoError(t, decodeResponseBody(resp))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fakeBody, body)
+}
+
+func TestDecodeResponseBodyUnsupported(t *testing.T) {
+	resp := newEncodedResponse("gzip, zstd", fakeBody)
+	require.NoError(t, decodeResponseBody(resp))
+	assert.Equal(t, "gzip, zstd", resp.Header.Get("Content-Encoding"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fakeBody, body)
+}
+
+func TestDecodeResponseBodyNotModified(t *testing.T) {
+	resp := newEncodedResponse("gzip", nil)
+	resp.StatusCode = http.StatusNotModified
+	require.NoError(t, decodeResponseBody(resp))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+}
+
+func TestDecodeResponseBodyInvalid(t *testing.T) {
+	assert.Error(t, decodeResponseBody(newEncodedResponse("gzip", fakeBody)))
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The signer sets its own ETag on SXG responses, so that clients such as AMP
+// caches can revalidate them. It's derived from the inner (upstream) ETag,
+// along with everything else that affects the SXG (see sxgCacheKey) and the
+// time until which the SXG may be reused (see sxgFreshUntil), so that it stops
+// matching when the cert, RTV, or transform version rotates, or when the
+// signature nears expiry.
+//
+// It has the form W/"amppkg.<until>.<inner>.<hash>", where until is that time
+// in Unix seconds, inner is the base64url-encoded inner ETag, and hash covers
+// the rest.
+// The inner ETag is embedded so that it can be forwarded to the origin, to
+// check that the document is unchanged. It's weak, as re-signing the same
+// document results in different bytes.
+const outerETagPrefix = `W/"amppkg.`
+
+// Returns the outer ETag for an SXG packaged in the given context (per
+// sxgCacheKey) from an upstream response with the given ETag, and which may be
+// reused until the given time. Returns "" if the upstream response has no
+// ETag.
+func outerETag(context string, innerETag string, freshUntil time.Time) string {
+	if innerETag == "" {
+		return ""
+	}
+	untilUnix := strconv.FormatInt(freshUntil.Unix(), 10)
+	return outerETagPrefix + untilUnix + "." + base64.RawURLEncoding.EncodeToString([]byte(innerETag)) +
+		"." + outerETagHash(context, innerETag, untilUnix) + `"`
+}
+
+func outerETagHash(context string, innerETag string, untilUnix string) string {
+	hash := sha256.Sum256([]byte(lengthPrefixedJoin([]string{context, innerETag, untilUnix})))
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
+}
+
+// Parses the given entity-tag. isOuter is true if it has the form of one issued
+// by outerETag. If it was issued for the given context, and the SXG may still be
+// reused (i.e. it would still be served from the SXG cache), then its inner
+// ETag is returned; otherwise, "".
+func parseOuterETag(tag string, context string, now time.Time) (innerETag string, isOuter bool) {
+	if !strings.HasPrefix(tag, outerETagPrefix) || !strings.HasSuffix(tag, `"`) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(tag, outerETagPrefix), `"`), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	until, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	inner, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	if parts[2] != outerETagHash(context, string(inner), parts[0]) ||
+		!now.Before(time.Unix(until, 0)) {
+		return "", true
+	}
+	return string(inner), true
+}
+
+// Splits the given If-None-Match header value into its entity-tags, per
+// https://tools.ietf.org/html/rfc7232#section-3.2. Quoted commas are allowed,
+// so this can't simply split on commas. A malformed remainder is returned as
+// the last element.
+func splitEntityTags(value string) []string {
+	var ret []string
+	for {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			return ret
+		}
+		if value[0] == '*' {
+			ret = append(ret, "*")
+			value = value[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(value, "W/") {
+			start = 2
+		}
+		if len(value) <= start || value[start] != '"' {
+			return append(ret, strings.TrimSpace(value))
+		}
+		end := strings.IndexByte(value[start+1:], '"')
+		if end < 0 {
+			return append(ret, strings.TrimSpace(value))
+		}
+		end += start + 2
+		ret = append(ret, value[:end])
+		value = value[end:]
+	}
+}
+
+// Rewrites the If-None-Match header of the given request, to be forwarded to
+// the origin: outer ETags still valid for the given context are replaced by
+// their inner ETags, and stale ones are removed, so that the document is
+// packaged anew. Returns the rewritten request (or req, if it has no outer
+// ETags), and a map from each replacement inner ETag to its outer ETag.
+//
+// The origin is asked even if the SXG cache has a valid entry for the outer
+// ETag. A valid signature only says the document was current when it was
+// signed, so answering from the entry would hide changes to the document for
+// up to the signature lifetime, i.e. days. For the same reason, SXGCache
+// revalidates its entries on every use. The revalidation is conditional, so
+// it's cheap when the document is unchanged.
+func translateIfNoneMatch(req *http.Request, context string, now time.Time) (*http.Request, map[string]string) {
+	value := GetJoined(req.Header, "If-None-Match")
+	if !strings.Contains(value, outerETagPrefix) {
+		return req, nil
+	}
+	var tags []string
+	outerETags := map[string]string{}
+	for _, tag := range splitEntityTags(value) {
+		inner, isOuter := parseOuterETag(tag, context, now)
+		switch {
+		case !isOuter:
+			tags = append(tags, tag)
+		case inner != "":
+			tags = append(tags, inner)
+			outerETags[inner] = tag
+		}
+	}
+	ret := req.Clone(req.Context())
+	if len(tags) == 0 {
+		ret.Header.Del("If-None-Match")
+	} else {
+		ret.Header.Set("If-None-Match", strings.Join(tags, ", "))
+	}
+	return ret, outerETags
+}
+
+// Returns the outer ETag that the origin confirmed to be current, by responding
+// as given to a request translated by translateIfNoneMatch, or "" if none. It
+// may confirm one either with a 304, or with a 200 with the same inner ETag
+// (e.g. if it ignores conditional requests). The origin may omit the ETag from
+// a 304, in which case it's unambiguous only if a single ETag was translated.
+func confirmedOuterETag(outerETags map[string]string, fetchResp *http.Response) string {
+	upstreamETag := fetchResp.Header.Get("ETag")
+	if outer, ok := outerETags[upstreamETag]; ok {
+		return outer
+	}
+	if fetchResp.StatusCode == http.StatusNotModified && upstreamETag == "" && len(outerETags) == 1 {
+		for _, outer := range outerETags {
+			return outer
+		}
+	}
+	return ""
+}
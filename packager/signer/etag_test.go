@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var etagNow = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func TestOuterETag(t *testing.T) {
+	freshUntil := etagNow.Add(2 * 24 * time.Hour)
+	etag := outerETag("context", `"v1"`, freshUntil)
+	assert.Regexp(t, `^W/"amppkg\.[0-9]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+"$`, etag)
+
+	inner, isOuter := parseOuterETag(etag, "context", etagNow)
+	assert.True(t, isOuter)
+	assert.Equal(t, `"v1"`, inner)
+
+	// A rotated cert, RTV, or transform version changes the context.
+	inner, isOuter = parseOuterETag(etag, "rotated", etagNow)
+	assert.True(t, isOuter)
+	assert.Empty(t, inner)
+
+	// The signature is too close to expiry.
+	inner, isOuter = parseOuterETag(etag, "context", freshUntil)
+	assert.True(t, isOuter)
+	assert.Empty(t, inner)
+
+	_, isOuter = parseOuterETag(`"v1"`, "context", etagNow)
+	assert.False(t, isOuter)
+	assert.Empty(t, outerETag("context", "", freshUntil))
+}
+
+func TestSplitEntityTags(t *testing.T) {
+	assert.Equal(t, []string{`"a"`, `W/"b,c"`, "*", `"d"`}, splitEntityTags(` "a",W/"b,c" , *,"d"`))
+	assert.Equal(t, []string{`"a"`, `bad "e"`}, splitEntityTags(`"a", bad "e"`))
+	assert.Empty(t, splitEntityTags(""))
+}
+
+func TestTranslateIfNoneMatch(t *testing.T) {
+	freshUntil := etagNow.Add(2 * 24 * time.Hour)
+	current := outerETag("context", `"v2"`, freshUntil)
+	stale := outerETag("rotated", `"v1"`, freshUntil)
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"other", `+stale+", "+current)
+
+	translated, outerETags := translateIfNoneMatch(req, "context", etagNow)
+	assert.Equal(t, `"other", "v2"`, translated.Header.Get("If-None-Match"))
+	assert.Equal(t, map[string]string{`"v2"`: current}, outerETags)
+	// The original request is unchanged.
+	assert.Contains(t, req.Header.Get("If-None-Match"), current)
+
+	req.Header.Set("If-None-Match", stale)
+	translated, outerETags = translateIfNoneMatch(req, "context", etagNow)
+	assert.Empty(t, translated.Header.Get("If-None-Match"))
+	assert.Empty(t, outerETags)
+
+	req.Header.Set("If-None-Match", `"other"`)
+	translated, outerETags = translateIfNoneMatch(req, "context", etagNow)
+	assert.Equal(t, req, translated)
+	assert.Nil(t, outerETags)
+}
+
+func TestConfirmedOuterETag(t *testing.T) {
+	outerETags := map[string]string{`"v1"`: "outer1"}
+	assert.Equal(t, "outer1", confirmedOuterETag(outerETags, &http.Response{StatusCode: 304, Header: http.Header{"Etag": {`"v1"`}}}))
+	assert.Equal(t, "outer1", confirmedOuterETag(outerETags, &http.Response{StatusCode: 200, Header: http.Header{"Etag": {`"v1"`}}}))
+	assert.Equal(t, "outer1", confirmedOuterETag(outerETags, &http.Response{StatusCode: 304, Header: http.Header{}}))
+	assert.Empty(t, confirmedOuterETag(outerETags, &http.Response{StatusCode: 200, Header: http.Header{}}))
+	assert.Empty(t, confirmedOuterETag(outerETags, &http.Response{StatusCode: 304, Header: http.Header{"Etag": {`"v2"`}}}))
+	assert.Empty(t, confirmedOuterETag(nil, &http.Response{StatusCode: 304, Header: http.Header{}}))
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/transformer"
+	rpb "github.com/ampproject/amppackager/transformer/request"
+	"github.com/pkg/errors"
+)
+
+// The decisions reported by the explainer. The first three match the status
+// label of documents_total.
+const (
+	decisionSigned            = "signed"
+	decisionProxiedUnsigned   = "proxied unsigned"
+	decisionOptimizedUnsigned = "optimized unsigned"
+	// The signer would respond with an HTTP error, e.g. because the URLs
+	// don't match any URLSet, or the fetch failed.
+	decisionError = "error"
+)
+
+// Explanation describes how the Signer would handle a request, step by step.
+// Fields are omitted for steps that weren't reached.
+type Explanation struct {
+	SignURL  string `json:"signURL,omitempty"`
+	FetchURL string `json:"fetchURL,omitempty"`
+	// If the fetch was redirected, the sign URL corresponding to the last
+	// hop, against which the document's relative URLs are resolved.
+	DocumentURL string `json:"documentURL,omitempty"`
+	// The outcome of matching the URLs against each URLSet, in config
+	// order. The first match is used.
+	URLSets []URLSetMatch `json:"urlSets,omitempty"`
+	// The transform and SXG versions negotiated from the request headers.
+	TransformVersion int64  `json:"transformVersion,omitempty"`
+	SXGVersion       string `json:"sxgVersion,omitempty"`
+	// The upstream response, after decoding its Content-Encoding.
+	StatusCode      int         `json:"statusCode,omitempty"`
+	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
+	// The output of the transformer.
+	Preloads   []*rpb.Metadata_Preload `json:"preloads,omitempty"`
+	MaxAgeSecs *int32                  `json:"maxAgeSecs,omitempty"`
+	LinkHeader string                  `json:"linkHeader,omitempty"`
+	// The headers that would be signed, including the mutated
+	// Content-Security-Policy.
+	SignedHeaders         http.Header `json:"signedHeaders,omitempty"`
+	ContentSecurityPolicy string      `json:"contentSecurityPolicy,omitempty"`
+	Date                  *time.Time  `json:"date,omitempty"`
+	Expires               *time.Time  `json:"expires,omitempty"`
+	// One of "signed", "proxied unsigned", "optimized unsigned" (for
+	// URLSets with Optimize), or "error".
+	Decision string `json:"decision"`
+	// For "proxied unsigned" and "optimized unsigned", the reason label of
+	// documents_total.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// URLSetMatch describes whether the requested URLs match a URLSet.
+type URLSetMatch struct {
+	SignDomain string `json:"signDomain"`
+	Matched    bool   `json:"matched"`
+	Error      string `json:"error,omitempty"`
+}
+
+// explainer is an http.Handler that runs the signer's pipeline on the
+// requested URLs, and responds with an Explanation as JSON, rather than with
+// an SXG. It accepts the same parameters as the signer.
+type explainer struct {
+	signer *Signer
+}
+
+// NewExplainer returns an http.Handler that explains how the given signer
+// would package the requested URL. Like the signer, it should be kept private.
+func NewExplainer(signer *Signer) http.Handler {
+	return &explainer{signer}
+}
+
+func (this *explainer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	fetch, sign, httpErr := requestedURLs(req)
+	if httpErr != nil {
+		httpErr.LogAndRespond(resp)
+		return
+	}
+	fetchURL, signURL, httpErr := parseFetchAndSignURLs(fetch, sign)
+	if httpErr != nil {
+		httpErr.LogAndRespond(resp)
+		return
+	}
+
+	explanation := this.explain(req, fetchURL, signURL)
+
+	body, err := json.MarshalIndent(explanation, "", "  ")
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error encoding explanation: ", err).LogAndRespond(resp)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := resp.Write(body); err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
+
+// Mirrors Signer.ServeHTTP, stopping at the first step that decides not to
+// sign, but without side effects such as caching, coalescing, or metrics.
+func (this *explainer) explain(req *http.Request, fetchURL, signURL *url.URL) *Explanation {
+	ret := &Explanation{SignURL: signURL.String()}
+	unsigned := func(err error) *Explanation {
+		ret.Decision = decisionProxiedUnsigned
+		ret.Reason = string(reasonOf(err))
+		ret.Error = err.Error()
+		return ret
+	}
+	failed := func(err error) *Explanation {
+		ret.Decision = decisionError
+		ret.Error = err.Error()
+		return ret
+	}
+
+	var urlSet *util.URLSet
+	for i := range this.signer.urlSets {
+		match := URLSetMatch{SignDomain: this.signer.urlSets[i].Sign.Domain}
+		if err := urlsMatch(fetchURL, signURL, this.signer.urlSets[i]); err != nil {
+			match.Error = err.Error()
+		} else if urlSet == nil {
+			match.Matched = true
+			urlSet = &this.signer.urlSets[i]
+		}
+		ret.URLSets = append(ret.URLSets, match)
+	}
+	if urlSet == nil {
+		return failed(errors.New("fetch/sign URLs do not match config"))
+	}
+	if fetchURL == nil {
+		fetchURL = signURL
+	}
+	ret.FetchURL = fetchURL.String()
+
+	params := &SXGParams{signURL: signURL, urlSet: urlSet}
+	packagingErr := this.signer.packagingParams(req, params)
+	ret.TransformVersion = params.transformVersion
+	ret.SXGVersion = string(params.sxgVersion)
+
+	// Explain an unconditional fetch, as the signer would package it.
+	unconditionalReq := req.Clone(req.Context())
+	for header := range util.ConditionalRequestHeaders {
+		unconditionalReq.Header.Del(header)
+	}
+	fetchReq, fetchResp, _, httpErr := this.signer.fetchURL(fetchURL, signURL, urlSet, unconditionalReq, nil)
+	if httpErr != nil {
+		return failed(httpErr)
+	}
+	docURL := documentURL(fetchURL, signURL, fetchReq.URL)
+	if docURL != signURL {
+		ret.DocumentURL = docURL.String()
+	}
+	defer func() {
+		if err := fetchResp.Body.Close(); err != nil {
+			log.Println("Error closing fetchResp body:", err)
+		}
+	}()
+	ret.StatusCode = fetchResp.StatusCode
+	ret.ResponseHeaders = fetchResp.Header.Clone()
+
+	if packagingErr != nil {
+		if urlSet.Optimize && this.wouldOptimize(fetchResp, docURL) {
+			ret = unsigned(packagingErr)
+			ret.Decision = decisionOptimizedUnsigned
+			return ret
+		}
+		return unsigned(packagingErr)
+	}
+	if fetchResp.StatusCode != http.StatusOK {
+		return unsigned(newUnsignedError(reasonStatusCode, errors.Errorf("status code %d is unrecognized", fetchResp.StatusCode)))
+	}
+	if err := validatePackageable(fetchReq, fetchResp, urlSet); err != nil {
+		return unsigned(err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, maxSignableBodyLength))
+	if err != nil {
+		return failed(errors.Wrap(err, "reading body"))
+	}
+	if len(body) == maxSignableBodyLength {
+		return unsigned(newUnsignedError(reasonTooLarge, errors.Errorf("the document size hit the limit of %d bytes", maxSignableBodyLength)))
+	}
+
+	r := getTransformerRequest(this.signer.rtvCache, docURL.String())
+	r.Version = params.transformVersion
+	var transformed bytes.Buffer
+	metadata, err := transformer.ProcessBytes(&transformed, r, body)
+	if err != nil {
+		return unsigned(newUnsignedError(reasonTransformerError, err))
+	}
+	ret.Preloads = metadata.Preloads
+	ret.MaxAgeSecs = &metadata.MaxAgeSecs
+	linkHeader, err := formatLinkHeader(metadata.Preloads)
+	if err != nil {
+		return unsigned(newUnsignedError(reasonLinkHeader, err))
+	}
+	ret.LinkHeader = linkHeader
+
+	header := fetchResp.Header.Clone()
+	this.signer.mutateSignedHeaders(header, linkHeader, transformed.Len(), signURL)
+	ret.SignedHeaders = header
+	ret.ContentSecurityPolicy = header.Get("Content-Security-Policy")
+
+	now := this.signer.timeNow()
+	date, expires, err := signatureLifetime(now, urlSet.Sign, fetchResp.Header, metadata.MaxAgeSecs)
+	ret.Date, ret.Expires = &date, &expires
+	if err != nil {
+		return unsigned(err)
+	}
+
+	ret.Decision = decisionSigned
+	return ret
+}
+
+// Mirrors Signer.optimize, returning true if it would serve fetchResp as
+// transformed HTML, rather than proxy it as is.
+func (this *explainer) wouldOptimize(fetchResp *http.Response, docURL *url.URL) bool {
+	if fetchResp.StatusCode != http.StatusOK || validateHTML(fetchResp) != nil {
+		return false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, maxSignableBodyLength))
+	if err != nil || len(body) == maxSignableBodyLength {
+		return false
+	}
+	r := getTransformerRequest(this.signer.rtvCache, docURL.String())
+	r.Config = rpb.Request_CUSTOM
+	r.Transformers = optimizerTransformers
+	_, err = transformer.ProcessBytes(ioutil.Discard, r, body)
+	return err == nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// frontEnd serves requests for the publisher's own URLs, e.g.
+// https://example.com/amp/story.html, rather than /priv/doc URLs, so that the
+// packager can sit directly behind the publisher's edge, without the edge
+// rewriting URLs. The sign URL is that of the request itself, with the https
+// scheme; if it matches a URLSet, the request is a GET or HEAD, and the client
+// accepts SXGs (or the URLSet has Optimize set), it's passed to the signer as if
+// requested via /priv/doc. All other requests, e.g. from browsers that don't
+// accept SXGs, are reverse-proxied to the origin as is, as the signer's fetch
+// doesn't forward their cookies and other headers.
+//
+// As the Host is client-controlled, requests are only served if it's one of
+// the configured hosts. Otherwise, anyone able to reach the packager could
+// have it sign their own documents' URLs, e.g. by requesting
+// https://example.com/ with "Host: attacker.com" of an origin that serves
+// virtual hosts.
+type frontEnd struct {
+	signer *Signer
+	hosts  map[string]bool
+	proxy  *httputil.ReverseProxy
+}
+
+// NewFrontEnd returns a handler that serves documents from the given signer,
+// per the given config. It configures the signer to fetch documents from
+// config.Origin, so the signer shouldn't be served other than through it.
+func NewFrontEnd(signer *Signer, config *util.FrontEndConfig) (http.Handler, error) {
+	origin, err := url.Parse(config.Origin)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Origin")
+	}
+	origin.Path = ""
+	signer.frontEndOrigin = origin
+
+	hosts := map[string]bool{}
+	for _, host := range config.Hosts {
+		hosts[strings.ToLower(host)] = true
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = origin.Scheme
+			req.URL.Host = origin.Host
+			// req.Host is left as is, so the origin sees the requested host.
+			xfh := req.Host
+			if oldXFH := req.Header.Get("X-Forwarded-Host"); oldXFH != "" {
+				xfh = oldXFH + "," + xfh
+			}
+			req.Header.Set("X-Forwarded-Host", xfh)
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// Don't let http.Transport add its own.
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		// The same transport the signer fetches with; nil means
+		// http.DefaultTransport.
+		Transport: signer.client.Transport,
+	}
+	return &frontEnd{signer, hosts, proxy}, nil
+}
+
+// Returns the host that req is addressed to, lowercased and without the default
+// port, if it's one of the configured hosts.
+func (this *frontEnd) requestedHost(req *http.Request) (string, bool) {
+	host := strings.TrimSuffix(strings.ToLower(req.Host), ":443")
+	return host, this.hosts[host]
+}
+
+// Returns the sign URL of the given request to host. As in the mux, it's built
+// from EscapedPath rather than RequestURI, which can take absolute-form.
+func frontEndSignURL(host string, req *http.Request) string {
+	sign := "https://" + host + req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		sign += "?" + req.URL.RawQuery
+	}
+	return sign
+}
+
+func (this *frontEnd) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	host, ok := this.requestedHost(req)
+	if !ok {
+		util.NewHTTPError(http.StatusMisdirectedRequest, "Unrecognized Host: ", req.Host).LogAndRespond(resp)
+		return
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		sign := frontEndSignURL(host, req)
+		_, signURL, urlSet, err := parseURLs("", sign, this.signer.urlSets)
+		if err == nil && (urlSet.Optimize || this.signer.packagingParams(req, &SXGParams{signURL: signURL}) == nil) {
+			this.signer.ServeHTTP(resp, mux.WithParams(req, map[string]string{"signURL": sign}))
+			return
+		}
+	}
+	this.proxy.ServeHTTP(resp, req)
+}
+
+// Returns the URL to fetch the given sign URL from, on the front end's origin.
+func frontEndFetchURL(origin *url.URL, sign *url.URL) *url.URL {
+	ret := *sign
+	ret.Scheme = origin.Scheme
+	ret.Host = origin.Host
+	return &ret
+}
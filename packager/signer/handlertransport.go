@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// HandlerTransport returns an http.RoundTripper that serves each request
+// in-process by the given handler, for use as Options.FetchTransport.
+// This allows embedding the packager in the same binary as the document
+// server, without a network hop. The response body is streamed as the
+// handler writes it.
+func HandlerTransport(handler http.Handler) http.RoundTripper {
+	return &handlerTransport{handler}
+}
+
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (this *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Make req look like one received by an http.Server.
+	serverReq := req.Clone(req.Context())
+	serverReq.RequestURI = req.URL.RequestURI()
+	if serverReq.Host == "" {
+		serverReq.Host = req.URL.Host
+	}
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+
+	bodyReader, bodyWriter := io.Pipe()
+	writer := &pipeResponseWriter{
+		req:    req,
+		header: http.Header{},
+		body:   bodyWriter,
+		resp:   make(chan *http.Response, 1),
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// ErrAbortHandler deliberately aborts the response,
+				// e.g. by proxyResponse, so isn't logged as a panic.
+				if r != http.ErrAbortHandler {
+					log.Printf("Panic serving %q in-process: %v\n", req.URL, r)
+				}
+				writer.fail(errors.Errorf("handler panicked: %v", r))
+				return
+			}
+			// Send the response if the handler didn't write anything.
+			writer.WriteHeader(http.StatusOK)
+			bodyWriter.Close()
+		}()
+		this.handler.ServeHTTP(writer, serverReq)
+	}()
+
+	select {
+	case resp := <-writer.resp:
+		if resp == nil {
+			return nil, writer.err
+		}
+		resp.Body = bodyReader
+		return resp, nil
+	case <-req.Context().Done():
+		// Unblock any writes by the handler.
+		bodyReader.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+}
+
+// pipeResponseWriter is an http.ResponseWriter that sends the response, once
+// its header is written, on the resp channel, with the body streamed through a
+// pipe.
+type pipeResponseWriter struct {
+	req    *http.Request
+	header http.Header
+	body   *io.PipeWriter
+	// Receives the response, or nil if the handler failed before writing
+	// its header, in which case err is set.
+	resp        chan *http.Response
+	err         error
+	mu          sync.Mutex
+	wroteHeader bool
+}
+
+func (this *pipeResponseWriter) Header() http.Header {
+	return this.header
+}
+
+func (this *pipeResponseWriter) WriteHeader(status int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.wroteHeader {
+		return
+	}
+	this.wroteHeader = true
+	this.resp <- &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        this.header.Clone(),
+		ContentLength: -1,
+		Request:       this.req,
+	}
+}
+
+func (this *pipeResponseWriter) Write(b []byte) (int, error) {
+	this.WriteHeader(http.StatusOK)
+	return this.body.Write(b)
+}
+
+// Flush implements http.Flusher. Writes are unbuffered, so there's nothing to
+// do.
+func (this *pipeResponseWriter) Flush() {}
+
+// Aborts the response with the given error: RoundTrip returns it if the header
+// wasn't yet written, else reading the body does.
+func (this *pipeResponseWriter) fail(err error) {
+	this.mu.Lock()
+	if !this.wroteHeader {
+		this.wroteHeader = true
+		this.err = err
+		this.resp <- nil
+	}
+	this.mu.Unlock()
+	this.body.CloseWithError(err)
+}
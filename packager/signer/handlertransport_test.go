@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerTransport(t *testing.T) {
+	var served *http.Request
+	transport := HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		served = req
+		resp.Header().Set("Content-Type", "text/html")
+		resp.WriteHeader(http.StatusCreated)
+		resp.Write([]byte("hello "))
+		resp.(http.Flusher).Flush()
+		resp.Write([]byte("world"))
+	}))
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/amp/page.html?q=1", nil)
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "201 Created", resp.Status)
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "/amp/page.html?q=1", served.RequestURI)
+	assert.Equal(t, "example.com", served.Host)
+}
+
+func TestHandlerTransportNoWrite(t *testing.T) {
+	transport := HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestHandlerTransportPanic(t *testing.T) {
+	transport := HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}))
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	assert.EqualError(t, err, "handler panicked: oops")
+
+	transport = HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("partial"))
+		panic("oops")
+	}))
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.EqualError(t, err, "handler panicked: oops")
+}
+
+func TestHandlerTransportCanceled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	transport := HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	cancel()
+	_, err = transport.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.Canceled, err)
+}
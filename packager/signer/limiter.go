@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promSigningRequests = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "signing_requests",
+		Help:      "Number of requests currently transforming and signing a document. Only reported if [Concurrency] is configured.",
+	},
+	[]string{},
+)
+
+var promQueuedRequests = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "queued_requests",
+		Help:      "Number of requests waiting to transform and sign a document, because [Concurrency] MaxSigning are already doing so.",
+	},
+	[]string{},
+)
+
+var promSigningMemoryBytes = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "signing_memory_bytes",
+		Help:      "Estimated memory used by requests transforming and signing a document. Only reported if [Concurrency] MaxMemoryBytes is configured.",
+	},
+	[]string{},
+)
+
+var promShedRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "shed_requests_total",
+		Help:      "Total number of requests that weren't signed because of [Concurrency] limits, by cause: queue_full, queue_timeout, or memory.",
+	},
+	[]string{"cause"},
+)
+
+// The estimated peak memory used to transform and sign a document, as a
+// multiple of its size. Besides the body itself, this accounts for the parsed
+// DOM, the transformed HTML (which is MI-encoded in place), and the copy of the
+// serialized exchange kept by the SXG cache, if any.
+const signingMemoryPerByte = 5
+
+// signLimiter limits the number of documents transformed and signed at once,
+// and the memory used to do so, per a ConcurrencyConfig. Requests over the
+// limit wait in a bounded queue, and are shed if it's full or they time out.
+type signLimiter struct {
+	config *util.ConcurrencyConfig
+	// Holds a value per request currently signing.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	queued int
+	memory int64
+}
+
+func newSignLimiter(config *util.ConcurrencyConfig) *signLimiter {
+	return &signLimiter{
+		config: config,
+		slots:  make(chan struct{}, config.MaxSigning),
+	}
+}
+
+func (this *signLimiter) shed(cause string, err error) error {
+	promShedRequests.WithLabelValues(cause).Inc()
+	return newUnsignedError(reasonOverloaded, err)
+}
+
+// acquire waits for a slot to sign a document in, and returns a function that
+// releases it. It returns an error instead if the queue is full, or the wait
+// times out or ctx is done.
+func (this *signLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() {
+		<-this.slots
+		promSigningRequests.WithLabelValues().Dec()
+	}
+	select {
+	case this.slots <- struct{}{}:
+		promSigningRequests.WithLabelValues().Inc()
+		return release, nil
+	default:
+	}
+
+	this.mu.Lock()
+	if this.queued >= this.config.MaxQueued {
+		this.mu.Unlock()
+		return nil, this.shed("queue_full", errors.Errorf("%d requests are already waiting to sign", this.config.MaxQueued))
+	}
+	this.queued++
+	this.mu.Unlock()
+	promQueuedRequests.WithLabelValues().Inc()
+	defer func() {
+		this.mu.Lock()
+		this.queued--
+		this.mu.Unlock()
+		promQueuedRequests.WithLabelValues().Dec()
+	}()
+
+	timer := time.NewTimer(this.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case this.slots <- struct{}{}:
+		promSigningRequests.WithLabelValues().Inc()
+		return release, nil
+	case <-timer.C:
+		return nil, this.shed("queue_timeout", errors.Errorf("timed out after %s waiting to sign", this.config.QueueTimeout))
+	case <-ctx.Done():
+		return nil, newUnsignedError(reasonOverloaded, errors.Wrap(ctx.Err(), "waiting to sign"))
+	}
+}
+
+// reserveMemory reserves the estimated memory to sign a document of the given
+// size, and returns a function that releases it. It returns an error instead
+// if that would exceed MaxMemoryBytes. A document is admitted regardless if no
+// others are reserved, so that documents larger than the budget can still be
+// signed when idle.
+func (this *signLimiter) reserveMemory(size int) (func(), error) {
+	if this.config.MaxMemoryBytes == 0 {
+		return func() {}, nil
+	}
+	bytes := int64(size) * signingMemoryPerByte
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.memory > 0 && this.memory+bytes > this.config.MaxMemoryBytes {
+		return nil, this.shed("memory", errors.Errorf("signing %d bytes would exceed MaxMemoryBytes", size))
+	}
+	this.memory += bytes
+	promSigningMemoryBytes.WithLabelValues().Add(float64(bytes))
+	return func() {
+		this.mu.Lock()
+		this.memory -= bytes
+		this.mu.Unlock()
+		promSigningMemoryBytes.WithLabelValues().Sub(float64(bytes))
+	}, nil
+}
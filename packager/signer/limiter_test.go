@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignLimiterQueues(t *testing.T) {
+	limiter := newSignLimiter(&util.ConcurrencyConfig{MaxSigning: 1, MaxQueued: 1, QueueTimeout: time.Minute})
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, promtest.ToFloat64(promSigningRequests.WithLabelValues()))
+
+	acquired := make(chan func())
+	go func() {
+		release, err := limiter.acquire(context.Background())
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	// Wait for the second request to be queued.
+	for promtest.ToFloat64(promQueuedRequests.WithLabelValues()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full.
+	before := promtest.ToFloat64(promShedRequests.WithLabelValues("queue_full"))
+	_, err = limiter.acquire(context.Background())
+	assert.Equal(t, reasonOverloaded, reasonOf(err))
+	assert.Equal(t, before+1, promtest.ToFloat64(promShedRequests.WithLabelValues("queue_full")))
+
+	release()
+	(<-acquired)()
+	assert.Equal(t, 0.0, promtest.ToFloat64(promSigningRequests.WithLabelValues()))
+	assert.Equal(t, 0.0, promtest.ToFloat64(promQueuedRequests.WithLabelValues()))
+}
+
+func TestSignLimiterQueueTimeout(t *testing.T) {
+	limiter := newSignLimiter(&util.ConcurrencyConfig{MaxSigning: 1, MaxQueued: 1, QueueTimeout: time.Millisecond})
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+
+	before := promtest.ToFloat64(promShedRequests.WithLabelValues("queue_timeout"))
+	_, err = limiter.acquire(context.Background())
+	assert.Equal(t, reasonOverloaded, reasonOf(err))
+	assert.Equal(t, before+1, promtest.ToFloat64(promShedRequests.WithLabelValues("queue_timeout")))
+}
+
+func TestSignLimiterMemory(t *testing.T) {
+	limiter := newSignLimiter(&util.ConcurrencyConfig{MaxSigning: 4, MaxQueued: 4, QueueTimeout: time.Second, MaxMemoryBytes: 100 * signingMemoryPerByte})
+	// Documents larger than the budget are admitted when idle.
+	release, err := limiter.reserveMemory(200)
+	require.NoError(t, err)
+	assert.Equal(t, float64(200*signingMemoryPerByte), promtest.ToFloat64(promSigningMemoryBytes.WithLabelValues()))
+	_, err = limiter.reserveMemory(1)
+	assert.Equal(t, reasonOverloaded, reasonOf(err))
+	release()
+
+	release, err = limiter.reserveMemory(60)
+	require.NoError(t, err)
+	_, err = limiter.reserveMemory(60)
+	assert.Equal(t, reasonOverloaded, reasonOf(err))
+	release2, err := limiter.reserveMemory(40)
+	require.NoError(t, err)
+	release()
+	release2()
+	assert.Equal(t, 0.0, promtest.ToFloat64(promSigningMemoryBytes.WithLabelValues()))
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/transformer"
+	rpb "github.com/ampproject/amppackager/transformer/request"
+)
+
+// The transformers run in optimizer mode (see util.URLSet.Optimize), by name.
+// These are those of the DEFAULT config, in the same order, less those that
+// prepare a document to be served from an AMP cache: AbsoluteURL and
+// URLRewrite, which point its URLs at the origin and the cache respectively,
+// and StripJS. TransformedIdentifier is replaced by SelfTransformedIdentifier,
+// as the document is served by its publisher.
+var optimizerTransformers = []string{
+	"nodecleanup",
+	"stripscriptcomments",
+	"linktag",
+	"ampboilerplate",
+	"unusedextensions",
+	"serversiderendering",
+	"ampruntimecss",
+	"selftransformedidentifier",
+	"preloadimage",
+	"reorderhead",
+}
+
+// optimize serves fetchResp, which won't be signed for the given reason, as
+// transformed HTML per optimizerTransformers. If it isn't an AMP document, or
+// can't be transformed, it's proxied as is.
+func (this *Signer) optimize(resp http.ResponseWriter, req *http.Request, fetchResp *http.Response, params *SXGParams, reason unsignedReason) {
+	switch fetchResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		// The client's copy of the optimized document is still current.
+		optimizeHeader(fetchResp.Header)
+		this.proxyUnconsumed(resp, fetchResp, reason)
+		return
+	default:
+		this.proxyUnconsumed(resp, fetchResp, reason)
+		return
+	}
+	if err := validateHTML(fetchResp); err != nil {
+		log.Println("Not optimizing because", err)
+		this.proxyUnconsumed(resp, fetchResp, reason)
+		return
+	}
+	// Transforming is about as expensive as signing, so is subject to the
+	// same limits. Documents over them are proxied as is, regardless of the
+	// Shed config, as they're still servable.
+	if this.limiter != nil {
+		release, err := this.limiter.acquire(req.Context())
+		if err != nil {
+			log.Println("Not optimizing because overloaded:", err)
+			this.proxyUnconsumed(resp, fetchResp, reason)
+			return
+		}
+		defer release()
+	}
+
+	body := getBuffer()
+	defer putBuffer(body)
+	if err := readBody(body, fetchResp.Body, fetchResp.ContentLength, maxSignableBodyLength); err != nil {
+		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp)
+		return
+	}
+	if body.Len() == maxSignableBodyLength {
+		log.Println("Not optimizing because the document size hit the limit of", maxSignableBodyLength, "bytes")
+		this.proxyPartiallyConsumed(resp, fetchResp, body.Bytes(), reason)
+		return
+	}
+	if this.limiter != nil {
+		release, err := this.limiter.reserveMemory(body.Len())
+		if err != nil {
+			log.Println("Not optimizing because overloaded:", err)
+			this.proxyConsumed(resp, consumedFetchResp{fetchResp, body.Bytes()}, reason)
+			return
+		}
+		defer release()
+	}
+
+	r := getTransformerRequest(this.rtvCache, params.documentURL.String())
+	r.Config = rpb.Request_CUSTOM
+	r.Transformers = optimizerTransformers
+	transformed := getBuffer()
+	defer putBuffer(transformed)
+	if _, err := transformer.ProcessBytes(transformed, r, body.Bytes()); err != nil {
+		log.Println("Not optimizing due to transformer error:", err)
+		this.proxyConsumed(resp, consumedFetchResp{fetchResp, body.Bytes()}, reason)
+		return
+	}
+
+	optimized := *fetchResp
+	optimized.Header = fetchResp.Header.Clone()
+	optimizeHeader(optimized.Header)
+	optimized.Header.Set("Content-Length", strconv.Itoa(transformed.Len()))
+	optimized.ContentLength = int64(transformed.Len())
+	if this.debug {
+		resp.Header().Set("AMP-Packager-Reason", string(reason))
+	}
+	promDocumentsSignedVsUnsigned.WithLabelValues("optimized unsigned", string(reason)).Inc()
+	proxyResponse(resp, &optimized, transformed.Bytes(), nil)
+}
+
+// Mutates the given upstream response headers into those of the optimized
+// document. The transformed HTML is semantically equivalent to the original,
+// but differs byte-for-byte, so a strong ETag is weakened, per
+// https://tools.ietf.org/html/rfc7232#section-2.1. Conditional requests with it
+// still match the origin's, as If-None-Match uses the weak comparison.
+func optimizeHeader(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
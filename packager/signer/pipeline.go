@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/pkg/errors"
+)
+
+// The document passes through the signer in as few copies as possible: the
+// upstream body is read into one buffer, the transformer prints into another,
+// that one is MI-encoded in place, and the exchange is written to the response
+// as its (small) prefix followed by that buffer. Both buffers are pooled.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. It must not be used afterwards, nor any
+// slices of its contents.
+func putBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readBody reads r, up to limit bytes, into buf. If contentLength is known and
+// within the limit, buf is sized up front so that it needn't grow while reading.
+func readBody(buf *bytes.Buffer, r io.Reader, contentLength int64, limit int64) error {
+	if contentLength > 0 && contentLength <= limit {
+		// ReadFrom grows the buffer whenever less than MinRead is free.
+		buf.Grow(int(contentLength) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(io.LimitReader(r, limit))
+	return err
+}
+
+// miEncodeExchange MI-encodes payload as the exchange's payload, as does
+// Exchange.MiEncodePayload. For mi-sha256-03, it does so in place, reusing
+// payload's buffer rather than copying it, so the exchange's payload is only
+// valid as long as the buffer is.
+func miEncodeExchange(exchange *signedexchange.Exchange, payload *bytes.Buffer, recordSize int) error {
+	enc := exchange.Version.MiceEncoding()
+	if enc != mice.Draft03Encoding || payload.Len() == 0 {
+		exchange.Payload = payload.Bytes()
+		return exchange.MiEncodePayload(recordSize)
+	}
+	if exchange.ResponseHeaders.Get(enc.DigestHeaderName()) != "" {
+		return errors.Errorf("response already has %q header", enc.DigestHeaderName())
+	}
+	encoded, proof := miEncodeInPlace(payload, recordSize)
+	exchange.Payload = encoded
+	exchange.ResponseHeaders.Add("Content-Encoding", enc.ContentEncoding())
+	exchange.ResponseHeaders.Add(enc.DigestHeaderName(), enc.FormatDigestHeader(proof))
+	return nil
+}
+
+// The bytes appended to each record before hashing it, per
+// https://tools.ietf.org/html/draft-thomson-http-mice-03#section-2.1.
+var miLastRecord, miNotLastRecord = []byte{0}, []byte{1}
+
+// miEncodeInPlace encodes the non-empty contents of buf per
+// https://tools.ietf.org/html/draft-thomson-http-mice-03, and returns the
+// encoding (backed by buf's storage) and its top-level proof. The encoding is
+// the record size, followed by the records, each but the first preceded by the
+// proof of the rest. Proofs are computed from the last record backwards, so
+// each record is moved to its final offset in the same pass, last one first;
+// as records only move towards the end, none is overwritten before it's moved.
+func miEncodeInPlace(buf *bytes.Buffer, recordSize int) ([]byte, []byte) {
+	n := buf.Len()
+	numRecords := (n + recordSize - 1) / recordSize
+	extra := 8 + (numRecords-1)*sha256.Size
+	buf.Grow(extra)
+	out := buf.Bytes()[:n+extra]
+
+	h := sha256.New()
+	var proof [sha256.Size]byte
+	for rec := numRecords - 1; rec >= 0; rec-- {
+		start := rec * recordSize
+		end := start + recordSize
+		if end > n {
+			end = n
+		}
+		h.Reset()
+		h.Write(out[start:end])
+		if rec == numRecords-1 {
+			h.Write(miLastRecord)
+		} else {
+			h.Write(proof[:])
+			h.Write(miNotLastRecord)
+		}
+		h.Sum(proof[:0])
+
+		dest := 8 + start + rec*sha256.Size
+		copy(out[dest:], out[start:end])
+		if rec > 0 {
+			copy(out[dest-sha256.Size:dest], proof[:])
+		}
+	}
+	binary.BigEndian.PutUint64(out[:8], uint64(recordSize))
+	return out, proof[:]
+}
+
+// serializedSXG is a serialized exchange, split into its prefix (everything
+// through the signed headers) and its MI-encoded payload, so that the payload
+// needn't be copied in order to write it.
+type serializedSXG struct {
+	prefix  []byte
+	payload []byte
+}
+
+// serializeExchange serializes the exchange, leaving its payload in place.
+func serializeExchange(exchange *signedexchange.Exchange) (serializedSXG, error) {
+	payload := exchange.Payload
+	exchange.Payload = nil
+	defer func() { exchange.Payload = payload }()
+	var prefix bytes.Buffer
+	if err := exchange.Write(&prefix); err != nil {
+		return serializedSXG{}, err
+	}
+	return serializedSXG{prefix.Bytes(), payload}, nil
+}
+
+// Bytes returns the exchange as a single slice. This copies it, unless it's
+// already one, e.g. because it was served from a cache.
+func (this serializedSXG) Bytes() []byte {
+	if len(this.payload) == 0 {
+		return this.prefix
+	}
+	ret := make([]byte, 0, len(this.prefix)+len(this.payload))
+	return append(append(ret, this.prefix...), this.payload...)
+}
+
+func (this serializedSXG) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(this.prefix)
+	if err != nil || len(this.payload) == 0 {
+		return int64(n), err
+	}
+	m, err := w.Write(this.payload)
+	return int64(n + m), err
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	"github.com/ampproject/amppackager/packager/rtv"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/util"
+	rpb "github.com/ampproject/amppackager/transformer/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiEncodeInPlace(t *testing.T) {
+	const recordSize = 16
+	for _, size := range []int{1, recordSize - 1, recordSize, recordSize + 1, 3*recordSize + 5, 4 * recordSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			payload := make([]byte, size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			var expected bytes.Buffer
+			expectedDigest, err := mice.Draft03Encoding.Encode(&expected, payload, recordSize)
+			require.NoError(t, err)
+
+			buf := bytes.NewBuffer(append([]byte{}, payload...))
+			encoded, proof := miEncodeInPlace(buf, recordSize)
+			assert.Equal(t, expected.Bytes(), encoded)
+			assert.Equal(t, expectedDigest, mice.Draft03Encoding.FormatDigestHeader(proof))
+		})
+	}
+}
+
+func TestMiEncodeExchange(t *testing.T) {
+	for _, ver := range []version.Version{version.Version1b1, version.Version1b3} {
+		for _, payload := range []string{"", "<html amp>"} {
+			t.Run(fmt.Sprintf("%s/%q", ver, payload), func(t *testing.T) {
+				expected := signedexchange.NewExchange(ver, "https://example.com/", "GET", http.Header{}, 200, http.Header{}, []byte(payload))
+				require.NoError(t, expected.MiEncodePayload(miRecordSize))
+
+				exchange := signedexchange.NewExchange(ver, "https://example.com/", "GET", http.Header{}, 200, http.Header{}, nil)
+				require.NoError(t, miEncodeExchange(exchange, bytes.NewBufferString(payload), miRecordSize))
+				assert.Equal(t, expected.ResponseHeaders, exchange.ResponseHeaders)
+				assert.Equal(t, expected.Payload, exchange.Payload)
+
+				var expectedSXG bytes.Buffer
+				require.NoError(t, expected.Write(&expectedSXG))
+				sxg, err := serializeExchange(exchange)
+				require.NoError(t, err)
+				assert.Equal(t, expectedSXG.Bytes(), sxg.Bytes())
+				var written bytes.Buffer
+				_, err = sxg.WriteTo(&written)
+				require.NoError(t, err)
+				assert.Equal(t, expectedSXG.Bytes(), written.Bytes())
+			})
+		}
+	}
+}
+
+func TestMiEncodeExchangeExistingDigest(t *testing.T) {
+	exchange := signedexchange.NewExchange(version.Version1b3, "https://example.com/", "GET", http.Header{}, 200, http.Header{"Digest": {"foo"}}, nil)
+	assert.Error(t, miEncodeExchange(exchange, bytes.NewBufferString("<html amp>"), miRecordSize))
+}
+
+func TestReadBody(t *testing.T) {
+	body := strings.Repeat("a", 10000)
+	for _, contentLength := range []int64{-1, 0, int64(len(body)), 1 << 30} {
+		buf := getBuffer()
+		require.NoError(t, readBody(buf, strings.NewReader(body), contentLength, 1<<20))
+		assert.Equal(t, body, buf.String())
+		putBuffer(buf)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, readBody(&buf, strings.NewReader(body), int64(len(body)), 100))
+	assert.Equal(t, body[:100], buf.String())
+}
+
+// A representative AMP document of roughly the given size.
+func benchmarkDocument(size int) []byte {
+	var doc bytes.Buffer
+	doc.WriteString(`<!doctype html><html ⚡><head><meta charset="utf-8"><link rel="canonical" href="https://example.com/"><meta name="viewport" content="width=device-width"><script async src="https://cdn.ampproject.org/v0.js"></script><style amp-boilerplate>body{visibility:hidden}</style><title>Benchmark</title></head><body>`)
+	for i := 0; doc.Len() < size; i++ {
+		fmt.Fprintf(&doc, `<p id="p%d">Paragraph %d, with <a href="/page/%d">a link</a> and <b>some</b> <i>formatting</i>.</p>`, i, i, i)
+	}
+	doc.WriteString(`</body></html>`)
+	return doc.Bytes()
+}
+
+func BenchmarkMiEncode(b *testing.B) {
+	payload := benchmarkDocument(500 << 10)
+	b.Run("InPlace", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			buf := getBuffer()
+			buf.Write(payload)
+			miEncodeInPlace(buf, miRecordSize)
+			putBuffer(buf)
+		}
+	})
+	b.Run("Vendored", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			exchange := signedexchange.NewExchange(version.Version1b3, "https://example.com/", "GET", http.Header{}, 200, http.Header{}, []byte(payload))
+			if err := exchange.MiEncodePayload(miRecordSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Measures allocations per request for fetching, transforming, and signing
+// documents of various sizes, end to end.
+func BenchmarkServeHTTP(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(orig func(*rtv.RTVCache, string) *rpb.Request) { getTransformerRequest = orig }(getTransformerRequest)
+	defer func(orig func(*rtv.RTVCache) string) { getRTV = orig }(getRTV)
+	// Apply the default transforms, but without an RTV cache to query.
+	getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+		return &rpb.Request{DocumentUrl: u, Rtv: "1234",
+			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
+	}
+	getRTV = func(r *rtv.RTVCache) string {
+		return "1234"
+	}
+	for _, size := range []int{10 << 10, 100 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			doc := benchmarkDocument(size)
+			transport := HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.Header().Set("Content-Type", "text/html")
+				resp.Header().Set("Content-Length", fmt.Sprint(len(doc)))
+				resp.Write(doc)
+			}))
+			urlSets := []util.URLSet{{
+				Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+			}}
+			signer, err := New(Options{
+				Certs:          []CertKey{{CertHandler: fakeCertHandler{}, Key: pkgt.Key}},
+				URLSets:        urlSets,
+				RTVCache:       &rtv.RTVCache{},
+				ShouldPackage:  func(string) error { return nil },
+				RequireHeaders: true,
+				FetchTransport: transport,
+			})
+			require.NoError(b, err)
+			target := "/priv/doc?sign=" + url.QueryEscape("https://example.com/amp/doc.html")
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("GET", target, nil)
+				for name, values := range header {
+					req.Header.Set(name, values[0])
+				}
+				resp := httptest.NewRecorder()
+				signer.ServeHTTP(resp, req)
+				if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "application/signed-exchange;v=b3" {
+					b.Fatalf("unexpected response: %d %s", resp.Code, resp.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// The response half of a reverse proxy, modeled on that of
+// httputil.ReverseProxy. The request half is fetchURL; the two share the
+// fetched response, so that the signer can fall back to proxying a document
+// after deciding not to sign it, even if it's already read some of the body.
+
+// proxyResponse writes the upstream response to resp. consumedPrefix is the
+// part of its body already read, if any, and unconsumedSuffix the rest (nil if
+// it's been read in full). It:
+//  - strips hop-by-hop headers, including those listed in Connection,
+//  - forwards trailers, announcing them in the Trailer header,
+//  - flushes after each write if the response is streamed, i.e. of unknown
+//    length or an event stream, so that it isn't held up by buffering, and
+//  - aborts the response if reading the body fails after the header was
+//    written, so that the client sees it as truncated rather than complete.
+// It returns false if the response wasn't written in full.
+func proxyResponse(resp http.ResponseWriter, fetchResp *http.Response, consumedPrefix []byte, unconsumedSuffix io.Reader) bool {
+	header := fetchResp.Header.Clone()
+	util.RemoveHopByHopHeaders(header)
+	for k, v := range header {
+		resp.Header()[k] = v
+	}
+	announcedTrailers := len(fetchResp.Trailer)
+	if announcedTrailers > 0 {
+		trailers := make([]string, 0, announcedTrailers)
+		for k := range fetchResp.Trailer {
+			trailers = append(trailers, k)
+		}
+		resp.Header().Add("Trailer", strings.Join(trailers, ", "))
+	}
+	resp.WriteHeader(fetchResp.StatusCode)
+
+	flusher, canFlush := resp.(http.Flusher)
+	streamed := canFlush && isStreamed(fetchResp)
+	if streamed || (canFlush && announcedTrailers > 0) {
+		// Send the header now, rather than wait for the first write.
+		flusher.Flush()
+	}
+
+	if len(consumedPrefix) > 0 {
+		if _, err := resp.Write(consumedPrefix); err != nil {
+			log.Println("Error writing response:", err)
+			return false
+		}
+		if streamed {
+			flusher.Flush()
+		}
+	}
+	if unconsumedSuffix != nil {
+		upstream := &upstreamReader{Reader: unconsumedSuffix}
+		var bytesCopied int64
+		var err error
+		if streamed {
+			bytesCopied, err = copyFlushing(resp, flusher, upstream)
+		} else {
+			bytesCopied, err = io.Copy(resp, upstream)
+		}
+		if upstream.err != nil {
+			log.Printf("Error reading response body, %d bytes into stream: %s\n", int64(len(consumedPrefix))+bytesCopied, upstream.err)
+			abortResponse(fetchResp)
+			return false
+		}
+		if err != nil {
+			log.Println("Error writing response:", err)
+			return false
+		}
+	}
+
+	// Trailers are only populated once the body has been read in full.
+	if len(fetchResp.Trailer) == announcedTrailers {
+		for k, v := range fetchResp.Trailer {
+			resp.Header()[k] = v
+		}
+	} else {
+		for k, v := range fetchResp.Trailer {
+			resp.Header()[http.TrailerPrefix+k] = v
+		}
+	}
+	return true
+}
+
+// Returns true if the response should be flushed as it's received, as it may
+// be produced gradually by the origin.
+func isStreamed(fetchResp *http.Response) bool {
+	if fetchResp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(fetchResp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// upstreamReader records errors reading the upstream body, so that they can be
+// distinguished from errors writing the response.
+type upstreamReader struct {
+	io.Reader
+	err error
+}
+
+func (this *upstreamReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		this.err = err
+	}
+	return n, err
+}
+
+// copyFlushing is like io.Copy, but flushes after each write.
+func copyFlushing(dst io.Writer, flusher http.Flusher, src io.Reader) (int64, error) {
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			m, err := dst.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+			flusher.Flush()
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// abortResponse aborts the response to the request that fetchResp was fetched
+// on behalf of, once its header has been written. Panicking with
+// http.ErrAbortHandler causes the http.Server to close the connection (or reset
+// the stream) without logging a stack trace. This is only done if the request
+// came from an http.Server, as other callers, e.g. tests using an
+// httptest.ResponseRecorder, wouldn't recover from it.
+func abortResponse(fetchResp *http.Response) {
+	if fetchResp.Request != nil && fetchResp.Request.Context().Value(http.ServerContextKey) != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// A body that returns its chunks one Read at a time, then sets the given
+// trailers on resp (as http.Transport does once the body is read in full), then
+// returns err, or io.EOF if nil.
+type chunkedBody struct {
+	chunks   []string
+	resp     *http.Response
+	trailers http.Header
+	err      error
+}
+
+func (this *chunkedBody) Read(p []byte) (int, error) {
+	if len(this.chunks) == 0 {
+		for k, v := range this.trailers {
+			this.resp.Trailer[k] = v
+		}
+		if this.err != nil {
+			return 0, this.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, this.chunks[0])
+	this.chunks[0] = this.chunks[0][n:]
+	if this.chunks[0] == "" {
+		this.chunks = this.chunks[1:]
+	}
+	return n, nil
+}
+
+func (this *chunkedBody) Close() error { return nil }
+
+func newChunkedResponse(chunks []string, trailers http.Header, err error) *http.Response {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		ContentLength: -1,
+		Trailer:       http.Header{},
+		Request:       httptest.NewRequest("GET", "https://example.com/", nil),
+	}
+	for k := range trailers {
+		resp.Trailer[k] = nil
+	}
+	resp.Body = &chunkedBody{chunks, resp, trailers, err}
+	return resp
+}
+
+// Records the body written as of each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []string
+}
+
+func (this *flushRecorder) Flush() {
+	this.flushes = append(this.flushes, this.Body.String())
+	this.ResponseRecorder.Flush()
+}
+
+func TestProxyResponseStripsHopByHopHeaders(t *testing.T) {
+	fetchResp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header: http.Header{
+			"Connection":        {"X-Hop, close"},
+			"X-Hop":             {"1"},
+			"Keep-Alive":        {"timeout=5"},
+			"Transfer-Encoding": {"chunked"},
+			"X-Kept":            {"2"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader("body")),
+	}
+	rec := httptest.NewRecorder()
+	assert.True(t, proxyResponse(rec, fetchResp, nil, fetchResp.Body))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, http.Header{"X-Kept": {"2"}}, rec.Header())
+	assert.Equal(t, "body", rec.Body.String())
+	// The upstream response is left as is.
+	assert.Equal(t, "1", fetchResp.Header.Get("X-Hop"))
+}
+
+func TestProxyResponseForwardsTrailers(t *testing.T) {
+	fetchResp := newChunkedResponse([]string{"a", "b"}, http.Header{"X-Checksum": {"ab"}}, nil)
+	rec := httptest.NewRecorder()
+	assert.True(t, proxyResponse(rec, fetchResp, nil, fetchResp.Body))
+	result := rec.Result()
+	assert.Equal(t, []string{"X-Checksum"}, result.Header["Trailer"])
+	body, _ := ioutil.ReadAll(result.Body)
+	assert.Equal(t, "ab", string(body))
+	assert.Equal(t, http.Header{"X-Checksum": {"ab"}}, result.Trailer)
+}
+
+func TestProxyResponseForwardsTrailersOfConsumedBody(t *testing.T) {
+	fetchResp := newChunkedResponse([]string{"a", "b"}, http.Header{"X-Checksum": {"ab"}}, nil)
+	body, _ := ioutil.ReadAll(fetchResp.Body)
+	rec := httptest.NewRecorder()
+	assert.True(t, proxyResponse(rec, fetchResp, body, nil))
+	assert.Equal(t, "ab", rec.Body.String())
+	assert.Equal(t, http.Header{"X-Checksum": {"ab"}}, rec.Result().Trailer)
+}
+
+func TestProxyResponseFlushesStreamed(t *testing.T) {
+	fetchResp := newChunkedResponse([]string{"a", "b", "c"}, nil, nil)
+	n, _ := fetchResp.Body.Read(make([]byte, 1))
+	assert.Equal(t, 1, n)
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	assert.True(t, proxyResponse(rec, fetchResp, []byte("a"), fetchResp.Body))
+	assert.Equal(t, "abc", rec.Body.String())
+	// Once for the header, then after each write.
+	assert.Equal(t, []string{"", "a", "ab", "abc"}, rec.flushes)
+}
+
+func TestProxyResponseFlushesEventStream(t *testing.T) {
+	fetchResp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}},
+		ContentLength: 4,
+		Body:          ioutil.NopCloser(strings.NewReader("data")),
+	}
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	assert.True(t, proxyResponse(rec, fetchResp, nil, fetchResp.Body))
+	assert.Equal(t, []string{"", "data"}, rec.flushes)
+}
+
+func TestProxyResponseDoesNotFlushFixedLength(t *testing.T) {
+	fetchResp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/html"}},
+		ContentLength: 4,
+		Body:          ioutil.NopCloser(strings.NewReader("body")),
+	}
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	assert.True(t, proxyResponse(rec, fetchResp, nil, fetchResp.Body))
+	assert.Empty(t, rec.flushes)
+}
+
+func TestProxyResponseAbortsOnReadError(t *testing.T) {
+	fetchResp := newChunkedResponse([]string{"a"}, nil, errors.New("connection reset"))
+	rec := httptest.NewRecorder()
+	// Not served by an http.Server, so can't be aborted.
+	assert.False(t, proxyResponse(rec, fetchResp, nil, fetchResp.Body))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "a", rec.Body.String())
+
+	fetchResp = newChunkedResponse([]string{"a"}, nil, errors.New("connection reset"))
+	fetchResp.Request = fetchResp.Request.WithContext(context.WithValue(fetchResp.Request.Context(), http.ServerContextKey, &http.Server{}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		proxyResponse(httptest.NewRecorder(), fetchResp, nil, fetchResp.Body)
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// unsignedReason is why a document was proxied unsigned rather than packaged.
+// Its values are used as the reason label of documents_total, and as the value
+// of the AMP-Packager-Reason response header in debug mode, so they must not
+// change.
+type unsignedReason string
+
+const (
+	// The packager is unhealthy, e.g. it has no valid OCSP response.
+	reasonUnhealthy unsignedReason = "unhealthy"
+	// The AMP-Cache-Transform request header is missing or unsatisfiable.
+	reasonAMPCacheTransform unsignedReason = "amp_cache_transform"
+	// The Accept request header prefers HTML or lacks a supported SXG
+	// version.
+	reasonAccept unsignedReason = "accept"
+	// The upstream status code is neither 200 nor 304.
+	reasonStatusCode unsignedReason = "status_code"
+	// The upstream response isn't publicly cacheable.
+	reasonNonCacheable unsignedReason = "non_cacheable"
+	// The upstream response has a Content-Encoding that couldn't be
+	// decoded.
+	reasonContentEncoding unsignedReason = "content_encoding"
+	// The upstream response isn't UTF-8 HTML.
+	reasonContentType unsignedReason = "content_type"
+	// The upstream response has a stateful header, and the URLSet has
+	// ErrorOnStatefulHeaders.
+	reasonStatefulHeader unsignedReason = "stateful_header"
+	// The upstream response has a Variants or Variant-Key header.
+	reasonVariants unsignedReason = "variants"
+	// The upstream body exceeds maxSignableBodyLength.
+	reasonTooLarge unsignedReason = "too_large"
+	// The transformer failed, e.g. because the document isn't valid AMP.
+	reasonTransformerError unsignedReason = "transformer_error"
+	// The document's preloads couldn't be expressed in a Link header.
+	reasonLinkHeader unsignedReason = "link_header"
+	// The signature would already be expired, e.g. due to a short max-age.
+	reasonExpired unsignedReason = "expired"
+	// The URLSet has HonorMaxAge, and the upstream max-age leaves less than
+	// util.MinSxgEffectiveLifetime until the signature expires.
+	reasonShortLifetime unsignedReason = "short_lifetime"
+	// Signing was shed due to the [Concurrency] limits.
+	reasonOverloaded unsignedReason = "overloaded"
+	// An unexpected error occurred while building or signing the exchange.
+	reasonSigningError unsignedReason = "signing_error"
+)
+
+// unsignedError is an error that explains why a document should be proxied
+// unsigned.
+type unsignedError struct {
+	reason unsignedReason
+	error
+}
+
+func newUnsignedError(reason unsignedReason, err error) error {
+	return &unsignedError{reason, err}
+}
+
+// Returns the reason for the given error, which may wrap an unsignedError.
+// Errors without a reason are attributed to a signing error, as they're
+// unexpected.
+func reasonOf(err error) unsignedReason {
+	if unsigned, ok := errors.Cause(err).(*unsignedError); ok {
+		return unsigned.reason
+	}
+	return reasonSigningError
+}
@@ -15,7 +15,6 @@
 package signer
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/x509"
 	"io"
@@ -30,6 +29,7 @@ import (
 	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/version"
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/amp_cache_transform"
 	"github.com/ampproject/amppackager/packager/certcache"
@@ -91,8 +91,14 @@ var statusNotModifiedHeaders = map[string]bool{
 const miRecordSize = 16 << 10
 
 // Overrideable for testing.
-var getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
-	return &rpb.Request{Html: string(s), DocumentUrl: u, Rtv: r.GetRTV(), Css: r.GetCSS(),
+var getRTV = func(r *rtv.RTVCache) string {
+	return r.GetRTV()
+}
+
+// Overrideable for testing. The HTML is passed to transformer.ProcessBytes
+// separately, so isn't set in the request.
+var getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+	return &rpb.Request{DocumentUrl: u, Rtv: r.GetRTV(), Css: r.GetCSS(),
 		AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
 }
 
@@ -116,46 +122,184 @@ func GetJoined(h http.Header, name string) string {
 	}
 }
 
+// CertKey pairs a cert chain with the private key of its leaf certificate.
+type CertKey struct {
+	CertHandler certcache.CertHandler
+	Key         crypto.PrivateKey
+}
+
 type Signer struct {
-	// TODO(twifkak): Support multiple certs. This will require generating
-	// a signature for each one. Note that Chrome only supports 1 signature
-	// at the moment.
-	certHandler certcache.CertHandler
-	// TODO(twifkak): Do we want to allow multiple keys?
-	key                     crypto.PrivateKey
-	client                  *http.Client
+	// The cert chains available for signing, in order of preference. Each
+	// exchange is signed by the first one that covers its sign URL's host,
+	// or by all of them if signWithAllCerts is set. Note that Chrome only
+	// verifies the first signature at the moment.
+	certs            []CertKey
+	signWithAllCerts bool
+	// Fetches documents from URLSets without an Upstream config or
+	// UnixSocket.
+	client *http.Client
+	// Fetches documents from the other URLSets.
+	upstreamClients         map[*util.URLSet]*http.Client
 	urlSets                 []util.URLSet
 	rtvCache                *rtv.RTVCache
-	shouldPackage           func() error
+	shouldPackage           func(host string) error
 	overrideBaseURL         *url.URL
 	requireHeaders          bool
 	forwardedRequestHeaders []string
 	timeNow                 func() time.Time
+	// If nil, every exchange is packaged anew.
+	sxgCache *SXGCache
+	// If nil, responses are never compressed.
+	compression *util.CompressionConfig
+	cspPolicy   *util.CSPConfig
+	// If nil, there's no limit on concurrent signing.
+	limiter *signLimiter
+	// If true, log details of how each document is packaged.
+	debug    bool
+	inflight inflightGroup
+	// If non-nil, documents are fetched from this origin, with the sign
+	// URL's host in the Host header, rather than from the sign URL itself.
+	// Set by NewFrontEnd.
+	frontEndOrigin *url.URL
 }
 
 func noRedirects(req *http.Request, via []*http.Request) error {
 	return http.ErrUseLastResponse
 }
 
-func New(certHandler certcache.CertHandler, key crypto.PrivateKey, urlSets []util.URLSet,
-	rtvCache *rtv.RTVCache, shouldPackage func() error, overrideBaseURL *url.URL,
-	requireHeaders bool, forwardedRequestHeaders []string, timeNow func() time.Time) (*Signer, error) {
+// Options configures a Signer. Certs, URLSets, RTVCache and ShouldPackage are
+// required; the other fields may be left unset.
+type Options struct {
+	// The cert chains available for signing, in order of preference.
+	Certs []CertKey
+	// If true, each exchange is signed by every cert chain that covers its
+	// sign URL's host, rather than just the first.
+	SignWithAllCerts bool
+	URLSets          []util.URLSet
+	RTVCache         *rtv.RTVCache
+	// Returns an error if documents for the given host shouldn't be signed,
+	// e.g. because its cert chain is unhealthy. They're proxied unsigned.
+	ShouldPackage func(host string) error
+	// If set, cert URLs are relative to this, rather than to the sign URL.
+	OverrideBaseURL *url.URL
+	// If true, documents are only signed for requests whose
+	// AMP-Cache-Transform and Accept headers allow an SXG.
+	RequireHeaders bool
+	// Request headers to forward to the origin.
+	ForwardedRequestHeaders []string
+	// Defaults to time.Now.
+	TimeNow func() time.Time
+	// If nil, every exchange is packaged anew.
+	SXGCache *SXGCache
+	// If nil, responses are never compressed.
+	Compression *util.CompressionConfig
+	// If nil, the CSP directives that AMP caches allow are passed through.
+	CSPPolicy *util.CSPConfig
+	// If nil, there's no limit on concurrent signing.
+	Concurrency *util.ConcurrencyConfig
+	// If set, documents are fetched through this (e.g. from an in-process
+	// http.Handler, via HandlerTransport), rather than over the network.
+	// The URLSets' Upstream timeouts and retries still apply, but their
+	// connection settings don't.
+	FetchTransport http.RoundTripper
+	// If true, log details of how each document is packaged.
+	Debug bool
+}
+
+// New returns a Signer configured per the given options.
+func New(options Options) (*Signer, error) {
+	if len(options.Certs) == 0 {
+		return nil, errors.New("must specify at least one cert")
+	}
+	timeNow := options.TimeNow
+	if timeNow == nil {
+		timeNow = time.Now
+	}
+	cspPolicy := options.CSPPolicy
+	if cspPolicy == nil {
+		cspPolicy = defaultCSPConfig
+	}
 	client := http.Client{
 		CheckRedirect: noRedirects,
+		Transport:     options.FetchTransport,
 		// TODO(twifkak): Load-test and see if default transport settings are okay.
-		Timeout: 60 * time.Second,
+		Timeout: defaultFetchTimeout,
+	}
+	urlSets := options.URLSets
+	upstreamClients := map[*util.URLSet]*http.Client{}
+	for i := range urlSets {
+		if needsUpstreamClient(&urlSets[i]) {
+			upstreamClient := newUpstreamClient(&urlSets[i])
+			if options.FetchTransport != nil {
+				upstreamClient.Transport = options.FetchTransport
+			}
+			upstreamClients[&urlSets[i]] = upstreamClient
+		}
 	}
 
-	return &Signer{certHandler, key, &client, urlSets, rtvCache, shouldPackage, overrideBaseURL, requireHeaders, forwardedRequestHeaders, timeNow}, nil
+	var limiter *signLimiter
+	if options.Concurrency != nil {
+		limiter = newSignLimiter(options.Concurrency)
+	}
+
+	return &Signer{
+		certs:                   options.Certs,
+		signWithAllCerts:        options.SignWithAllCerts,
+		client:                  &client,
+		upstreamClients:         upstreamClients,
+		urlSets:                 urlSets,
+		rtvCache:                options.RTVCache,
+		shouldPackage:           options.ShouldPackage,
+		overrideBaseURL:         options.OverrideBaseURL,
+		requireHeaders:          options.RequireHeaders,
+		forwardedRequestHeaders: options.ForwardedRequestHeaders,
+		timeNow:                 timeNow,
+		sxgCache:                options.SXGCache,
+		compression:             options.Compression,
+		cspPolicy:               cspPolicy,
+		limiter:                 limiter,
+		debug:                   options.Debug,
+	}, nil
+}
+
+// Returns the cert chains to sign the given host with: the first one whose
+// leaf certificate covers it (or all of them, if signWithAllCerts), or else
+// the first one. The latter should only happen in development, as
+// NewMultiCertCache verifies that each URLSet's Sign.Domain is covered by
+// some cert.
+func (this *Signer) certKeysFor(host string) []*CertKey {
+	var ret []*CertKey
+	if len(this.certs) > 1 {
+		for i := range this.certs {
+			cert := this.certs[i].CertHandler.GetLatestCert()
+			if cert != nil && cert.VerifyHostname(host) == nil {
+				ret = append(ret, &this.certs[i])
+				if !this.signWithAllCerts {
+					break
+				}
+			}
+		}
+	}
+	if len(ret) == 0 {
+		ret = append(ret, &this.certs[0])
+	}
+	return ret
 }
 
-func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.Request, *http.Response, *util.HTTPError) {
+// Fetches the given URL, per the upstream settings of the given URLSet. If
+// cached is non-nil, it is revalidated via conditional headers; otherwise,
+// those included in serveHTTPReq are forwarded. Redirects are followed per the
+// URLSet's MaxRedirects, in which case the returned request is that of the
+// last hop. Also returns the total number of times the fetches were retried.
+func (this *Signer) fetchURL(fetch *url.URL, sign *url.URL, urlSet *util.URLSet, serveHTTPReq *http.Request, cached *sxgCacheEntry) (*http.Request, *http.Response, int, *util.HTTPError) {
 	ampURL := fetch.String()
 
 	log.Printf("Fetching URL: %q\n", ampURL)
-	req, err := http.NewRequest(http.MethodGet, ampURL, nil)
+	// Bind the fetch to the client's request, so that it's canceled if the
+	// client goes away.
+	req, err := http.NewRequestWithContext(serveHTTPReq.Context(), http.MethodGet, ampURL, nil)
 	if err != nil {
-		return nil, nil, util.NewHTTPError(http.StatusInternalServerError, "Error building request: ", err)
+		return nil, nil, 0, util.NewHTTPError(http.StatusInternalServerError, "Error building request: ", err)
 	}
 	req.Header.Set("User-Agent", userAgent)
 	// copy forwardedRequestHeaders
@@ -166,6 +310,12 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 			req.Header.Set(header, value)
 		}
 	}
+	if this.frontEndOrigin != nil {
+		req.Host = sign.Host
+	}
+	// Negotiate compression explicitly, rather than rely on http.Transport,
+	// which only supports gzip. The response is decoded below.
+	req.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
 	// Golang's HTTP parser appears not to validate the protocol it parses
 	// from the request line, so we do so here.
 	if protocol.MatchString(serveHTTPReq.Proto) {
@@ -187,20 +337,51 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 		}
 		req.Header.Set("X-Forwarded-Host", xfh)
 	}
-	// Set conditional headers that were included in ServeHTTP's Request.
-	for header := range util.ConditionalRequestHeaders {
-		if value := GetJoined(serveHTTPReq.Header, header); value != "" {
-			req.Header.Set(header, value)
+	if cached != nil {
+		cached.setConditionalHeaders(req.Header)
+	} else {
+		// Set conditional headers that were included in ServeHTTP's Request.
+		for header := range util.ConditionalRequestHeaders {
+			if value := GetJoined(serveHTTPReq.Header, header); value != "" {
+				req.Header.Set(header, value)
+			}
 		}
 	}
-	resp, err := this.client.Do(req)
+	client := this.client
+	if upstreamClient, ok := this.upstreamClients[urlSet]; ok {
+		client = upstreamClient
+	}
+	resp, retries, err := doWithRetries(client, req, urlSet.Upstream)
+	for redirects := 0; err == nil && isRedirect(resp.StatusCode) && redirects < urlSet.MaxRedirects; redirects++ {
+		target, targetErr := redirectTarget(req, resp, sign, urlSet, this.frontEndOrigin)
+		if targetErr != nil {
+			log.Printf("Not following redirect from %q: %s\n", req.URL, targetErr)
+			break
+		}
+		log.Printf("Following redirect from %q to %q\n", req.URL, target)
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainedBodyLength))
+		resp.Body.Close()
+		req = req.Clone(req.Context())
+		req.URL = target
+		var hopRetries int
+		resp, hopRetries, err = doWithRetries(client, req, urlSet.Upstream)
+		retries += hopRetries
+	}
 	if err != nil {
-		return nil, nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", err)
+		return nil, nil, retries, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", err)
 	}
 	util.RemoveHopByHopHeaders(resp.Header)
-	return req, resp, nil
+	if err := decodeResponseBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, nil, retries, util.NewHTTPError(http.StatusBadGateway, "Error decoding response: ", err)
+	}
+	return req, resp, retries, nil
 }
 
+// The CSP policy used when none is configured: preserve all of the directives
+// that AMP caches allow, with no extra sources.
+var defaultCSPConfig = &util.CSPConfig{KeepDirectives: util.CSPPassthroughDirectives}
+
 // Some Content-Security-Policy (CSP) configurations have the ability to break
 // AMPHTML document functionality on the AMPHTML Cache if set on the document.
 // This method parses the publisher's provided CSP and mutates it to ensure
@@ -223,6 +404,17 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 // All other CSP directives (see https://w3c.github.io/webappsec-csp/) are
 // stripped from the publisher provided CSP.
 func MutateFetchedContentSecurityPolicy(fetched string) string {
+	return MutateContentSecurityPolicy(fetched, defaultCSPConfig)
+}
+
+// MutateContentSecurityPolicy is like MutateFetchedContentSecurityPolicy, but
+// per the given policy: only its KeepDirectives are passed through, and its
+// extra sources are appended to font-src and style-src.
+func MutateContentSecurityPolicy(fetched string, policy *util.CSPConfig) string {
+	keep := map[string]bool{}
+	for _, directive := range policy.KeepDirectives {
+		keep[directive] = true
+	}
 	directiveTokens := strings.Split(fetched, ";")
 	var newCsp strings.Builder
 	for _, directiveToken := range directiveTokens {
@@ -234,14 +426,22 @@ func MutateFetchedContentSecurityPolicy(fetched string) string {
 			continue
 		}
 		directiveName := strings.ToLower(directiveParts[0])
-		switch directiveName {
 		// Preserve certain directives. The rest are all removed or replaced.
-		case "base-uri", "block-all-mixed-content", "font-src", "form-action",
-			"manifest-src", "referrer", "upgrade-insecure-requests":
-			newCsp.WriteString(trimmed)
-			newCsp.WriteString(";")
-		default:
+		if !keep[directiveName] {
+			continue
 		}
+		if directiveName == "font-src" && len(policy.ExtraFontSrc) > 0 {
+			sources := directiveParts[1:]
+			// 'none' must be the only source, per
+			// https://w3c.github.io/webappsec-csp/#grammardef-serialized-source-list.
+			if len(sources) == 1 && strings.ToLower(sources[0]) == "'none'" {
+				sources = nil
+			}
+			sources = append(sources, policy.ExtraFontSrc...)
+			trimmed = directiveParts[0] + " " + strings.Join(sources, " ")
+		}
+		newCsp.WriteString(trimmed)
+		newCsp.WriteString(";")
 	}
 	// Add missing directives or replace the ones that were removed in some cases
 	// NOTE: After changing this string, please update the permalink in
@@ -286,20 +486,21 @@ var promGatewayRequestsLatency = promauto.NewHistogramVec(
 		Namespace: promNamespace,
 		Subsystem: promSubsystem,
 		Name:      "gateway_duration_seconds",
-		Help:      "Latencies (in seconds) of gateway requests to AMP document server - by HTTP response status code.",
+		Help:      "Latencies (in seconds) of gateway requests to AMP document server, including any retries - by HTTP response status code and number of retries.",
 		Buckets:   prometheus.DefBuckets,
 	},
-	[]string{"code"},
+	[]string{"code", "retries"},
 )
 
-func (this *Signer) fetchURLAndMeasure(fetch *url.URL, serveHTTPReq *http.Request) (*http.Request, *http.Response, *util.HTTPError) {
+func (this *Signer) fetchURLAndMeasure(fetch *url.URL, sign *url.URL, urlSet *util.URLSet, serveHTTPReq *http.Request, cached *sxgCacheEntry) (*http.Request, *http.Response, *util.HTTPError) {
 	startTime := this.timeNow()
 
-	fetchReq, fetchResp, httpErr := this.fetchURL(fetch, serveHTTPReq)
+	fetchReq, fetchResp, retries, httpErr := this.fetchURL(fetch, sign, urlSet, serveHTTPReq, cached)
 	if httpErr == nil {
 		// httpErr is nil, i.e. the gateway request did succeed. Let Prometheus
-		// observe the gateway request and its latency - along with the response code.
-		label := prometheus.Labels{"code": strconv.Itoa(fetchResp.StatusCode)}
+		// observe the gateway request and its latency - along with the response
+		// code of the last attempt, and the number of retries before it.
+		label := prometheus.Labels{"code": strconv.Itoa(fetchResp.StatusCode), "retries": strconv.Itoa(retries)}
 
 		latency := this.timeNow().Sub(startTime)
 		promGatewayRequestsLatency.With(label).Observe(latency.Seconds())
@@ -314,40 +515,172 @@ func (this *Signer) fetchURLAndMeasure(fetch *url.URL, serveHTTPReq *http.Reques
 	return fetchReq, fetchResp, httpErr
 }
 
+// Sets the AMP-Cache-Transform response header value, transform version, and
+// SXG version in params with which to package the response to req, or returns
+// an error explaining why it shouldn't be packaged.
+func (this *Signer) packagingParams(req *http.Request, params *SXGParams) error {
+	if err := this.shouldPackage(params.signURL.Hostname()); err != nil {
+		return newUnsignedError(reasonUnhealthy, errors.Wrap(err, "server is unhealthy; see above log statements"))
+	}
+	if !this.requireHeaders {
+		transformVersion, err := transformer.SelectVersion(nil)
+		if err != nil {
+			return errors.Wrap(err, "of internal SelectVersion error")
+		}
+		params.transformVersion = transformVersion
+		params.sxgVersion = accept.SxgVersion
+		return nil
+	}
+	header_value := GetJoined(req.Header, "AMP-Cache-Transform")
+	act, transformVersion := amp_cache_transform.ShouldSendSXG(header_value)
+	if act == "" {
+		return newUnsignedError(reasonAMPCacheTransform, errors.Errorf("AMP-Cache-Transform request header is invalid: %s", header_value))
+	}
+	acceptHeader := GetJoined(req.Header, "Accept")
+	sxgVersion, ok := accept.Negotiate(acceptHeader)
+	if !ok {
+		return newUnsignedError(reasonAccept, errors.Errorf("Accept request header doesn't prefer a supported application/signed-exchange version over HTML: %s", acceptHeader))
+	}
+	params.ampCacheTransformHeader = act
+	params.transformVersion = transformVersion
+	params.sxgVersion = sxgVersion
+	return nil
+}
+
+func hasConditionalHeaders(req *http.Request) bool {
+	for header := range util.ConditionalRequestHeaders {
+		if GetJoined(req.Header, header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the values of the forwardedRequestHeaders in req, in order. These are
+// sent upstream by fetchURL, so may affect the response.
+func (this *Signer) forwardedHeaderValues(req *http.Request) []string {
+	var values []string
+	for _, header := range this.forwardedRequestHeaders {
+		if http.CanonicalHeaderKey(header) == "Host" {
+			values = append(values, req.Host)
+		} else {
+			values = append(values, GetJoined(req.Header, header))
+		}
+	}
+	return values
+}
+
+// Returns the SXG cache key for the given request. This covers all of the
+// inputs to packaging other than the upstream response, whose validators are
+// stored in the cache entry.
+func (this *Signer) sxgCacheKey(signURL *url.URL, fetchURL *url.URL, req *http.Request, transformVersion int64, sxgVersion version.Version) string {
+	var certNames []string
+	for _, certKey := range this.certKeysFor(signURL.Hostname()) {
+		certNames = append(certNames, util.CertName(certKey.CertHandler.GetLatestCert()))
+	}
+	return sxgCacheKey(signURL.String(), fetchURL.String(), this.forwardedHeaderValues(req), transformVersion, sxgVersion, getRTV(this.rtvCache), certNames)
+}
+
+// Returns the unparsed fetch and sign URLs requested by req, either in its path
+// (e.g. /priv/doc/https://example.com/) or in its query (e.g.
+// /priv/doc?sign=https://example.com/).
+func requestedURLs(req *http.Request) (string, string, *util.HTTPError) {
+	if err := req.ParseForm(); err != nil {
+		return "", "", util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err)
+	}
+	if inPathSignURL := mux.Params(req)["signURL"]; inPathSignURL != "" {
+		return "", inPathSignURL, nil
+	}
+	if len(req.Form["fetch"]) > 1 {
+		return "", "", util.NewHTTPError(http.StatusBadRequest, "More than 1 fetch param")
+	}
+	if len(req.Form["sign"]) != 1 {
+		return "", "", util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param")
+	}
+	return req.FormValue("fetch"), req.FormValue("sign"), nil
+}
+
 func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if this.compression != nil {
+		compressor := newCompressingResponseWriter(resp, req, this.compression)
+		defer func() {
+			if err := compressor.Close(); err != nil {
+				log.Println("Error compressing response:", err)
+			}
+		}()
+		resp = compressor
+	}
 	resp.Header().Add("Vary", "Accept, AMP-Cache-Transform")
 
-	if err := req.ParseForm(); err != nil {
-		util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err).LogAndRespond(resp)
+	fetch, sign, httpErr := requestedURLs(req)
+	if httpErr != nil {
+		httpErr.LogAndRespond(resp)
 		return
 	}
-	var fetch, sign string
-	params := mux.Params(req)
-	if inPathSignURL := params["signURL"]; inPathSignURL != "" {
-		sign = inPathSignURL
-	} else {
-		if len(req.Form["fetch"]) > 1 {
-			util.NewHTTPError(http.StatusBadRequest, "More than 1 fetch param").LogAndRespond(resp)
-			return
-		}
-		if len(req.Form["sign"]) != 1 {
-			util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param").LogAndRespond(resp)
-			return
-		}
-		fetch = req.FormValue("fetch")
-		sign = req.FormValue("sign")
-	}
-	fetchURL, signURL, errorOnStatefulHeaders, httpErr := parseURLs(fetch, sign, this.urlSets)
+	fetchURL, signURL, urlSet, httpErr := parseURLs(fetch, sign, this.urlSets)
 	if httpErr != nil {
 		httpErr.LogAndRespond(resp)
 		return
 	}
+	if this.frontEndOrigin != nil {
+		// The sign URL's host is this packager, so don't fetch from it.
+		fetchURL = frontEndFetchURL(this.frontEndOrigin, signURL)
+	}
+
+	params := &SXGParams{signURL: signURL, urlSet: urlSet}
+	packagingErr := this.packagingParams(req, params)
+
+	var outerETags map[string]string
+	if packagingErr == nil {
+		params.etagContext = this.sxgCacheKey(signURL, fetchURL, req, params.transformVersion, params.sxgVersion)
+		// Replace any outer ETags in If-None-Match with the inner ETags
+		// they were derived from, so that the origin can confirm whether
+		// the document has changed. This also determines whether the
+		// request is conditional, below.
+		req, outerETags = translateIfNoneMatch(req, params.etagContext, this.timeNow())
+	}
+
+	// Only requests that would be packaged unconditionally are coalesced or
+	// cached, as those are the only ones that get identical SXGs.
+	var cached *sxgCacheEntry
+	if packagingErr == nil && !hasConditionalHeaders(req) {
+		key := lengthPrefixedJoin(append([]string{fetchURL.String(), signURL.String(), strconv.FormatInt(params.transformVersion, 10), string(params.sxgVersion)}, this.forwardedHeaderValues(req)...))
+		call, leader := this.inflight.join(key)
+		if leader {
+			params.publish = func(sxg serializedSXG, etag string) { this.inflight.finish(key, call, sxg, etag) }
+			defer params.publish(serializedSXG{}, "")
+		} else {
+			select {
+			case <-call.done:
+			case <-req.Context().Done():
+				log.Println("Request canceled while waiting for identical concurrent request:", req.Context().Err())
+				return
+			}
+			if call.sxg != nil {
+				promCoalescedRequests.WithLabelValues().Inc()
+				this.writeSignedExchange(resp, serializedSXG{prefix: call.sxg}, call.etag, params)
+				return
+			}
+			// The other request wasn't packaged, e.g. because the
+			// origin returned an error. Handle this one independently,
+			// rather than guess whether the same would happen.
+		}
+
+		if this.sxgCache != nil {
+			params.sxgCacheKey = params.etagContext
+			cached = this.sxgCache.Get(params.sxgCacheKey)
+			if cached == nil {
+				promSXGCacheRequests.WithLabelValues("miss").Inc()
+			}
+		}
+	}
 
-	fetchReq, fetchResp, httpErr := this.fetchURLAndMeasure(fetchURL, req)
+	fetchReq, fetchResp, httpErr := this.fetchURLAndMeasure(fetchURL, signURL, urlSet, req, cached)
 	if httpErr != nil {
 		httpErr.LogAndRespond(resp)
 		return
 	}
+	params.documentURL = documentURL(fetchURL, signURL, fetchReq.URL)
 
 	defer func() {
 		if err := fetchResp.Body.Close(); err != nil {
@@ -355,63 +688,51 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
-	if err := this.shouldPackage(); err != nil {
-		log.Println("Not packaging because server is unhealthy; see above log statements.", err)
-		proxyUnconsumed(resp, fetchResp)
+	if packagingErr != nil {
+		log.Println("Not packaging because", packagingErr)
+		if urlSet.Optimize {
+			this.optimize(resp, req, fetchResp, params, reasonOf(packagingErr))
+		} else {
+			this.proxyUnconsumed(resp, fetchResp, reasonOf(packagingErr))
+		}
 		return
 	}
-	var act string
-	var transformVersion int64
-	if this.requireHeaders {
-		header_value := GetJoined(req.Header, "AMP-Cache-Transform")
-		act, transformVersion = amp_cache_transform.ShouldSendSXG(header_value)
-		if act == "" {
-			log.Println("Not packaging because AMP-Cache-Transform request header is invalid:", header_value)
-			proxyUnconsumed(resp, fetchResp)
-			return
-		}
-	} else {
-		var err error
-		transformVersion, err = transformer.SelectVersion(nil)
-		if err != nil {
-			log.Println("Not packaging because of internal SelectVersion error:", err)
-			proxyUnconsumed(resp, fetchResp)
+
+	if cached != nil {
+		// The origin confirmed that the cached SXG is still current.
+		if fetchResp.StatusCode == http.StatusNotModified ||
+			(fetchResp.StatusCode == http.StatusOK && cached.matches(fetchResp.Header)) {
+			promSXGCacheRequests.WithLabelValues("hit").Inc()
+			this.writeSignedExchange(resp, serializedSXG{prefix: cached.SXG}, cached.OuterETag, params)
 			return
 		}
+		promSXGCacheRequests.WithLabelValues("miss").Inc()
 	}
-	if this.requireHeaders && !accept.CanSatisfy(GetJoined(req.Header, "Accept")) {
-		log.Printf("Not packaging because Accept request header lacks application/signed-exchange;v=%s.\n", accept.AcceptedSxgVersion)
-		proxyUnconsumed(resp, fetchResp)
+
+	if outer := confirmedOuterETag(outerETags, fetchResp); outer != "" {
+		// The client's SXG is still current, so needn't be re-signed.
+		this.writeNotModified(resp, outer, params)
 		return
 	}
 
 	switch fetchResp.StatusCode {
 	case 200:
 		// If fetchURL returns an OK status, then validate, munge, and package.
-		if err := validateFetch(fetchReq, fetchResp); err != nil {
+		if err := validatePackageable(fetchReq, fetchResp, urlSet); err != nil {
 			log.Println("Not packaging because of invalid fetch: ", err)
-			proxyUnconsumed(resp, fetchResp)
+			this.proxyUnconsumed(resp, fetchResp, reasonOf(err))
 			return
 		}
-		for header := range statefulResponseHeaders {
-			if errorOnStatefulHeaders && GetJoined(fetchResp.Header, header) != "" {
-				log.Println("Not packaging because ErrorOnStatefulHeaders = True and fetch response contains stateful header: ", header)
-				proxyUnconsumed(resp, fetchResp)
+
+		if this.limiter != nil {
+			release, err := this.limiter.acquire(req.Context())
+			if err != nil {
+				this.shed(resp, fetchResp, nil, err)
 				return
 			}
+			defer release()
 		}
-
-		if fetchResp.Header.Get("Variants") != "" || fetchResp.Header.Get("Variant-Key") != "" ||
-			// Include versioned headers per https://github.com/WICG/webpackage/pull/406.
-			fetchResp.Header.Get("Variants-04") != "" || fetchResp.Header.Get("Variant-Key-04") != "" {
-			// Variants headers (https://tools.ietf.org/html/draft-ietf-httpbis-variants-04) are disallowed by AMP Cache.
-			// We could delete the headers, but it's safest to assume they reflect the downstream server's intent.
-			log.Println("Not packaging because response contains a Variants header.")
-			proxyUnconsumed(resp, fetchResp)
-			return
-		}
-
-		this.consumeAndSign(resp, fetchResp, &SXGParams{signURL, act, transformVersion})
+		this.consumeAndSign(resp, fetchResp, params)
 
 	case 304:
 		// If fetchURL returns a 304, then also return a 304 with appropriate headers.
@@ -424,7 +745,7 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
 	default:
 		log.Printf("Not packaging because status code %d is unrecognized.\n", fetchResp.StatusCode)
-		proxyUnconsumed(resp, fetchResp)
+		this.proxyUnconsumed(resp, fetchResp, reasonStatusCode)
 	}
 }
 
@@ -474,16 +795,29 @@ func formatLinkHeader(preloads []*rpb.Metadata_Preload) (string, error) {
 }
 
 type SXGParams struct {
-	signURL                 *url.URL
+	signURL *url.URL
+	// The URL against which the document's relative URLs are resolved.
+	// Differs from signURL if the fetch was redirected.
+	documentURL             *url.URL
+	urlSet                  *util.URLSet
 	ampCacheTransformHeader string
 	transformVersion        int64
+	sxgVersion              version.Version
+	// If non-empty, the packaged SXG is stored in the SXG cache under this key.
+	sxgCacheKey string
+	// Identifies everything other than the upstream response that affects
+	// the SXG, per sxgCacheKey. Set only if packaging.
+	etagContext string
+	// If non-nil, called with the packaged SXG and its outer ETag, to share
+	// them with identical concurrent requests.
+	publish func(sxg serializedSXG, etag string)
 }
 
 // consumedFetchResp stores the fetch response in memory - including the
 // consumed body, not a stream reader. Signer loads the whole payload in memory
 // in order to be able to sign it, because it's required by signer's
 // serveSignedExchange method, specifically by its underlying calls to
-// transformer.Process and to signedexchange.NewExchange. The former performs
+// transformer.ProcessBytes and to miEncodeExchange. The former performs
 // AMP HTML transforms, which depend on a non-streaming HTML parser. The latter
 // signs it, which requires the whole payload in memory, because MICE requires
 // the sender to process its payload in reverse order
@@ -491,9 +825,8 @@ type SXGParams struct {
 // HTTP reverse proxy, this could be done using range requests, but would be
 // inefficient.
 type consumedFetchResp struct {
-	body       []byte
-	StatusCode int
-	Header     http.Header
+	*http.Response
+	body []byte
 }
 
 // maxSignableBodyLength is the signable payload length limit. If not hit, the
@@ -505,20 +838,30 @@ type consumedFetchResp struct {
 const maxSignableBodyLength = 4 * 1 << 20
 
 func (this *Signer) consumeAndSign(resp http.ResponseWriter, fetchResp *http.Response, params *SXGParams) {
+	body := getBuffer()
+	defer putBuffer(body)
 	// Cap in order to limit per-request memory usage.
-	fetchBodyMaybeCapped, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, maxSignableBodyLength))
-	if err != nil {
+	if err := readBody(body, fetchResp.Body, fetchResp.ContentLength, maxSignableBodyLength); err != nil {
 		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp)
 		return
 	}
+	fetchBodyMaybeCapped := body.Bytes()
 
 	if len(fetchBodyMaybeCapped) == maxSignableBodyLength {
 		// Body was too long and has been capped. Fallback to proxying.
 		log.Println("Not packaging because the document size hit the limit of ", strconv.Itoa(maxSignableBodyLength), " bytes.")
-		proxyPartiallyConsumed(resp, fetchResp, fetchBodyMaybeCapped)
+		this.proxyPartiallyConsumed(resp, fetchResp, fetchBodyMaybeCapped, reasonTooLarge)
 	} else {
 		// Body has been consumed fully. OK to proceed.
-		this.serveSignedExchange(resp, consumedFetchResp{fetchBodyMaybeCapped, fetchResp.StatusCode, fetchResp.Header}, params)
+		if this.limiter != nil {
+			release, err := this.limiter.reserveMemory(len(fetchBodyMaybeCapped))
+			if err != nil {
+				this.shed(resp, fetchResp, fetchBodyMaybeCapped, err)
+				return
+			}
+			defer release()
+		}
+		this.serveSignedExchange(resp, consumedFetchResp{fetchResp, fetchBodyMaybeCapped}, params)
 	}
 
 }
@@ -539,21 +882,23 @@ var promDocumentsSignedVsUnsigned = promauto.NewCounterVec(
 		Namespace: promNamespace,
 		Subsystem: promSubsystem,
 		Name:      "documents_total",
-		Help:      "Total number of successful underlying requests to AMP document server, broken down by status based on the action signer has taken: sign or proxy unsigned.",
+		Help:      "Total number of successful underlying requests to AMP document server, broken down by status based on the action signer has taken: sign or proxy unsigned, and for the latter, the reason.",
 	},
-	[]string{"status"},
+	[]string{"status", "reason"},
 )
 
 // serveSignedExchange does the actual work of transforming, packaging, signing and writing to the response.
 func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp consumedFetchResp, params *SXGParams) {
 	// Perform local transformations, as required by AMP SXG caches, per
 	// docs/cache_requirements.md.
-	r := getTransformerRequest(this.rtvCache, string(fetchResp.body), params.signURL.String())
+	r := getTransformerRequest(this.rtvCache, params.documentURL.String())
 	r.Version = params.transformVersion
-	transformed, metadata, err := transformer.Process(r)
+	transformed := getBuffer()
+	defer putBuffer(transformed)
+	metadata, err := transformer.ProcessBytes(transformed, r, fetchResp.body)
 	if err != nil {
 		log.Println("Not packaging due to transformer error:", err)
-		proxyConsumed(resp, fetchResp)
+		this.proxyConsumed(resp, fetchResp, reasonTransformerError)
 		return
 	}
 
@@ -561,97 +906,167 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp cons
 	linkHeader, err := formatLinkHeader(metadata.Preloads)
 	if err != nil {
 		log.Println("Not packaging due to Link header error:", err)
-		proxyConsumed(resp, fetchResp)
+		this.proxyConsumed(resp, fetchResp, reasonLinkHeader)
 		return
 	}
 
 	// Begin mutations on original fetch response. From this point forward, do
 	// not fall-back to proxy().
+	innerETag := fetchResp.Header.Get("ETag")
+	this.mutateSignedHeaders(fetchResp.Header, linkHeader, transformed.Len(), params.signURL)
 
+	exchange := signedexchange.NewExchange(
+		params.sxgVersion,
+		/*uri=*/ params.signURL.String(),
+		/*method=*/ "GET",
+		http.Header{}, fetchResp.StatusCode, fetchResp.Header, nil)
+	if err := miEncodeExchange(exchange, transformed, miRecordSize); err != nil {
+		log.Printf("Error MI-encoding: %s\n", err)
+		this.proxyConsumed(resp, fetchResp, reasonSigningError)
+		return
+	}
+	now := this.timeNow()
+	validityHRef, err := url.Parse(util.ValidityMapPath)
+	if err != nil {
+		// Won't ever happen because util.ValidityMapPath is a constant.
+		log.Printf("Error building validity href: %s\n", err)
+		this.proxyConsumed(resp, fetchResp, reasonSigningError)
+		return
+	}
+	date, expires, err := signatureLifetime(now, params.urlSet.Sign, fetchResp.Header, metadata.MaxAgeSecs)
+	if err != nil {
+		log.Printf("Not packaging because %s\n", err)
+		this.proxyConsumed(resp, fetchResp, reasonOf(err))
+		return
+	}
+	// AddSignatureHeader replaces any existing signature, so collect one
+	// per cert chain and join them into a single parameterised list, per
+	// https://tools.ietf.org/html/draft-yasskin-http-origin-signed-responses-05#section-3.1.
+	var signatures []string
+	for _, certKey := range this.certKeysFor(params.signURL.Hostname()) {
+		cert := certKey.CertHandler.GetLatestCert()
+		certURL, err := this.genCertURL(cert, params.signURL)
+		if err != nil {
+			log.Printf("Error building cert URL: %s\n", err)
+			this.proxyConsumed(resp, fetchResp, reasonSigningError)
+			return
+		}
+		signer := signedexchange.Signer{
+			Date:        date,
+			Expires:     expires,
+			Certs:       []*x509.Certificate{cert},
+			CertUrl:     certURL,
+			ValidityUrl: params.signURL.ResolveReference(validityHRef),
+			PrivKey:     certKey.Key,
+			// TODO(twifkak): Should we make Rand user-configurable? The
+			// default is to use getrandom(2) if available, else
+			// /dev/urandom.
+		}
+		if err := exchange.AddSignatureHeader(&signer); err != nil {
+			log.Printf("Error signing exchange: %s\n", err)
+			this.proxyConsumed(resp, fetchResp, reasonSigningError)
+			return
+		}
+		signatures = append(signatures, exchange.SignatureHeaderValue)
+	}
+	exchange.SignatureHeaderValue = strings.Join(signatures, ", ")
+	sxg, err := serializeExchange(exchange)
+	if err != nil {
+		log.Printf("Error serializing exchange: %s\n", err)
+		this.proxyConsumed(resp, fetchResp, reasonSigningError)
+		return
+	}
+	if params.sxgCacheKey != "" {
+		// The cache outlives the pooled payload buffer, so needs a copy.
+		sxg = serializedSXG{prefix: sxg.Bytes()}
+	}
+
+	freshUntil := sxgFreshUntil(now, expires)
+	etag := outerETag(params.etagContext, innerETag, freshUntil)
+	if !this.writeSignedExchange(resp, sxg, etag, params) {
+		return
+	}
+
+	promSignedAmpDocumentsSize.WithLabelValues().Observe(float64(len(fetchResp.body)))
+	promDocumentsSignedVsUnsigned.WithLabelValues("signed", "").Inc()
+
+	if params.sxgCacheKey != "" {
+		entry := newSXGCacheEntry(fetchResp.Header, sxg.prefix, freshUntil)
+		entry.OuterETag = etag
+		this.sxgCache.Put(params.sxgCacheKey, entry)
+	}
+}
+
+// Mutates the given upstream response headers into those to be signed: it
+// strips stateful headers, and sets the Link header to the given value (or
+// deletes it, if empty), Content-Length to the given length of the transformed
+// body, and the Content-Security-Policy to one that can't break AMP pages.
+func (this *Signer) mutateSignedHeaders(header http.Header, linkHeader string, contentLength int, signURL *url.URL) {
 	// Remove stateful headers.
-	for header := range statefulResponseHeaders {
-		fetchResp.Header.Del(header)
+	for name := range statefulResponseHeaders {
+		header.Del(name)
 	}
 
 	// Set Link header if formatting returned a valid value, otherwise, delete
 	// it to ensure there are no privacy-violating Link:rel=preload headers.
 	if linkHeader != "" {
-		fetchResp.Header.Set("Link", linkHeader)
+		header.Set("Link", linkHeader)
 	} else {
-		fetchResp.Header.Del("Link")
+		header.Del("Link")
 	}
 
 	// Set content length.
-	fetchResp.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+	header.Set("Content-Length", strconv.Itoa(contentLength))
 
 	// Set general security headers.
-	fetchResp.Header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Content-Type-Options", "nosniff")
 
 	// Mutate the fetched CSP to make sure it cannot break AMP pages.
-	fetchResp.Header.Set(
-		"Content-Security-Policy",
-		MutateFetchedContentSecurityPolicy(
-			fetchResp.Header.Get("Content-Security-Policy")))
-
-	exchange := signedexchange.NewExchange(
-		accept.SxgVersion,
-		/*uri=*/ params.signURL.String(),
-		/*method=*/ "GET",
-		http.Header{}, fetchResp.StatusCode, fetchResp.Header, []byte(transformed))
-	if err := exchange.MiEncodePayload(miRecordSize); err != nil {
-		log.Printf("Error MI-encoding: %s\n", err)
-		proxyConsumed(resp, fetchResp)
-		return
-	}
-	cert := this.certHandler.GetLatestCert()
-	certURL, err := this.genCertURL(cert, params.signURL)
-	if err != nil {
-		log.Printf("Error building cert URL: %s\n", err)
-		proxyConsumed(resp, fetchResp)
-		return
-	}
-	now := time.Now()
-	validityHRef, err := url.Parse(util.ValidityMapPath)
-	if err != nil {
-		// Won't ever happen because util.ValidityMapPath is a constant.
-		log.Printf("Error building validity href: %s\n", err)
-		proxyConsumed(resp, fetchResp)
-		return
+	csp := MutateContentSecurityPolicy(header.Get("Content-Security-Policy"), this.cspPolicy)
+	if this.debug {
+		log.Printf("Mutated Content-Security-Policy of %s from %q to %q\n", signURL, header.Get("Content-Security-Policy"), csp)
 	}
+	header.Set("Content-Security-Policy", csp)
+}
+
+// Returns the Date and Expires of the signature on an exchange signed at now,
+// per the given sign pattern, upstream response headers, and the max-age
+// computed by the transformer. Returns an unsignedError if the exchange
+// shouldn't be signed with that lifetime, along with the Date and Expires.
+func signatureLifetime(now time.Time, sign *util.URLPattern, header http.Header, maxAgeSecs int32) (time.Time, time.Time, error) {
 	// Expires - Date must be <= 604800 seconds, per
 	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
-	duration := 7 * 24 * time.Hour
-	if maxAge := time.Duration(metadata.MaxAgeSecs) * time.Second; maxAge < duration {
+	// This is enforced by util.ValidateSignURLPattern.
+	duration := sign.SxgMaxLifetime()
+	if maxAge := time.Duration(maxAgeSecs) * time.Second; maxAge < duration {
 		duration = maxAge
 	}
-	date := now.Add(-24 * time.Hour)
+	date := now.Add(-sign.SxgBackdate())
 	expires := date.Add(duration)
-	if !expires.After(now) {
-		log.Printf("Not packaging because computed max-age %d places expiry in the past\n", metadata.MaxAgeSecs)
-		proxyConsumed(resp, fetchResp)
-		return
+	if sign.HonorMaxAge {
+		if maxAge, ok := upstreamMaxAge(header); ok && now.Add(maxAge).Before(expires) {
+			expires = now.Add(maxAge)
+			// AMP caches reject SXGs with less remaining lifetime than
+			// this, per docs/cache_requirements.md.
+			if maxAge > 0 && maxAge < util.MinSxgEffectiveLifetime {
+				return date, expires, newUnsignedError(reasonShortLifetime, errors.Errorf("upstream max-age leaves %s until expiry, less than %s", maxAge, util.MinSxgEffectiveLifetime))
+			}
+		}
 	}
-	signer := signedexchange.Signer{
-		Date:        date,
-		Expires:     expires,
-		Certs:       []*x509.Certificate{cert},
-		CertUrl:     certURL,
-		ValidityUrl: params.signURL.ResolveReference(validityHRef),
-		PrivKey:     this.key,
-		// TODO(twifkak): Should we make Rand user-configurable? The
-		// default is to use getrandom(2) if available, else
-		// /dev/urandom.
-	}
-	if err := exchange.AddSignatureHeader(&signer); err != nil {
-		log.Printf("Error signing exchange: %s\n", err)
-		proxyConsumed(resp, fetchResp)
-		return
+	if !expires.After(now) {
+		return date, expires, newUnsignedError(reasonExpired, errors.Errorf("computed expiry %s is in the past (max-age %d)", expires, maxAgeSecs))
 	}
-	var body bytes.Buffer
-	if err := exchange.Write(&body); err != nil {
-		log.Printf("Error serializing exchange: %s\n", err)
-		proxyConsumed(resp, fetchResp)
-		return
+	return date, expires, nil
+}
+
+// writeSignedExchange writes the given serialized exchange to the response,
+// along with the appropriate outer headers, including the given outer ETag (if
+// non-empty). It returns false if writing failed.
+func (this *Signer) writeSignedExchange(resp http.ResponseWriter, sxg serializedSXG, etag string, params *SXGParams) bool {
+	// Share before writing, so that waiting requests needn't also wait on
+	// this client's connection.
+	if params.publish != nil {
+		params.publish(sxg, etag)
 	}
 
 	// If requireHeaders was true when constructing signer, the
@@ -661,7 +1076,7 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp cons
 		resp.Header().Set("AMP-Cache-Transform", params.ampCacheTransformHeader)
 	}
 
-	resp.Header().Set("Content-Type", accept.SxgContentType)
+	resp.Header().Set("Content-Type", params.sxgVersion.MimeType())
 	// We set a zero freshness lifetime on the SXG, so that naive caching
 	// intermediaries won't inhibit the update of this resource on AMP
 	// caches. AMP caches are recommended to base their update strategies
@@ -669,60 +1084,72 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp cons
 	//
 	// If you change this code to set a Cache-Control based on the inner
 	// resource, you need to ensure that its max-age is no longer than the
-	// lifetime of the signature (6 days, per above). Maybe an even tighter
+	// lifetime of the signature (6 days by default, per above). Maybe an even tighter
 	// bound than that, based on data about client clock skew.
 	resp.Header().Set("Cache-Control", "no-transform, max-age=0")
 	resp.Header().Set("X-Content-Type-Options", "nosniff")
-	if _, err := resp.Write(body.Bytes()); err != nil {
+	if etag != "" {
+		resp.Header().Set("ETag", etag)
+	}
+	if _, err := sxg.WriteTo(resp); err != nil {
 		log.Println("Error writing response:", err)
-		return
+		return false
 	}
+	return true
+}
 
-	promSignedAmpDocumentsSize.WithLabelValues().Observe(float64(len(fetchResp.body)))
-	promDocumentsSignedVsUnsigned.WithLabelValues("signed").Inc()
+// writeNotModified responds that the client's SXG, with the given outer ETag, is
+// still current. The headers match those of writeSignedExchange, so that they
+// don't change the client's stored response.
+func (this *Signer) writeNotModified(resp http.ResponseWriter, etag string, params *SXGParams) {
+	if params.ampCacheTransformHeader != "" {
+		resp.Header().Set("AMP-Cache-Transform", params.ampCacheTransformHeader)
+	}
+	resp.Header().Set("Cache-Control", "no-transform, max-age=0")
+	resp.Header().Set("ETag", etag)
+	resp.WriteHeader(http.StatusNotModified)
 }
 
-func proxyUnconsumed(resp http.ResponseWriter, fetchResp *http.Response) {
-	proxyImpl(resp, fetchResp.Header, fetchResp.StatusCode,
+// Responds to a request whose signing was shed by the limiter, per its config:
+// either with a 503, or by proxying the document unsigned. consumedBodyPrefix
+// is the part of fetchResp's body that's already been read, if any.
+func (this *Signer) shed(resp http.ResponseWriter, fetchResp *http.Response, consumedBodyPrefix []byte, err error) {
+	if this.limiter.config.Shed == util.ShedUnavailable {
+		retryAfter := (this.limiter.config.RetryAfter + time.Second - 1) / time.Second
+		resp.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not packaging because overloaded: ", err).LogAndRespond(resp)
+		return
+	}
+	log.Println("Not packaging because overloaded:", err)
+	this.proxyPartiallyConsumed(resp, fetchResp, consumedBodyPrefix, reasonOf(err))
+}
+
+func (this *Signer) proxyUnconsumed(resp http.ResponseWriter, fetchResp *http.Response, reason unsignedReason) {
+	this.proxyImpl(resp, fetchResp,
 		/* consumedPrefix= */ nil,
-		/* unconsumedSuffix = */ fetchResp.Body)
+		/* unconsumedSuffix = */ fetchResp.Body, reason)
 }
 
-func proxyPartiallyConsumed(resp http.ResponseWriter, fetchResp *http.Response, consumedBodyPrefix []byte) {
-	proxyImpl(resp, fetchResp.Header, fetchResp.StatusCode,
+func (this *Signer) proxyPartiallyConsumed(resp http.ResponseWriter, fetchResp *http.Response, consumedBodyPrefix []byte, reason unsignedReason) {
+	this.proxyImpl(resp, fetchResp,
 		/* consumedPrefix= */ consumedBodyPrefix,
-		/* unconsumedSuffix = */ fetchResp.Body)
+		/* unconsumedSuffix = */ fetchResp.Body, reason)
 }
 
-func proxyConsumed(resp http.ResponseWriter, consumedFetchResp consumedFetchResp) {
-	proxyImpl(resp, consumedFetchResp.Header, consumedFetchResp.StatusCode,
+func (this *Signer) proxyConsumed(resp http.ResponseWriter, consumedFetchResp consumedFetchResp, reason unsignedReason) {
+	this.proxyImpl(resp, consumedFetchResp.Response,
 		/* consumedPrefix= */ consumedFetchResp.body,
-		/* unconsumedSuffix = */ nil)
+		/* unconsumedSuffix = */ nil, reason)
 }
 
 // Proxy the content unsigned. The body may be already partially or fully
-// consumed. TODO(twifkak): Take a look at the source code to
-// httputil.ReverseProxy and see what else needs to be implemented.
-func proxyImpl(resp http.ResponseWriter, header http.Header, statusCode int, consumedPrefix []byte, unconsumedSuffix io.ReadCloser) {
-	for k, v := range header {
-		resp.Header()[k] = v
-	}
-	resp.WriteHeader(statusCode)
-
-	if consumedPrefix != nil {
-		resp.Write(consumedPrefix)
+// consumed.
+func (this *Signer) proxyImpl(resp http.ResponseWriter, fetchResp *http.Response, consumedPrefix []byte, unconsumedSuffix io.Reader, reason unsignedReason) {
+	if this.debug {
+		resp.Header().Set("AMP-Packager-Reason", string(reason))
 	}
-
-	if unconsumedSuffix != nil {
-		bytesCopied, err := io.Copy(resp, unconsumedSuffix)
-		if err != nil {
-			if bytesCopied == 0 {
-				util.NewHTTPError(http.StatusInternalServerError, "Error copying response body").LogAndRespond(resp)
-			} else {
-				log.Printf("Error copying response body, %d bytes into stream\n", bytesCopied)
-			}
-		}
-	}
-
-	promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned").Inc()
+	// Count the document before proxying it, as the response may be
+	// aborted if the upstream body fails to read.
+	promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned", string(reason)).Inc()
+	proxyResponse(resp, fetchResp, consumedPrefix, unconsumedSuffix)
 }
@@ -16,21 +16,30 @@ package signer
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
+	"github.com/WICG/webpackage/go/signedexchange/version"
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/mux"
 	"github.com/ampproject/amppackager/packager/rtv"
@@ -60,9 +69,14 @@ func headerNames(headers http.Header) []string {
 }
 
 type fakeCertHandler struct {
+	// Defaults to pkgt.Certs.
+	certs []*x509.Certificate
 }
 
 func (this fakeCertHandler) GetLatestCert() *x509.Certificate {
+	if this.certs != nil {
+		return this.certs[0]
+	}
 	return pkgt.Certs[0]
 }
 
@@ -78,16 +92,45 @@ type SignerSuite struct {
 	fakeHandler           func(resp http.ResponseWriter, req *http.Request)
 	lastRequest           *http.Request
 	fakeClock             *pkgt.FakeClock
+	sxgCache              *SXGCache
+	compression           *util.CompressionConfig
+	cspPolicy             *util.CSPConfig
+	concurrency           *util.ConcurrencyConfig
+	fetchTransport        http.RoundTripper
+	debug                 bool
+	signer                *Signer
 }
 
 func (this *SignerSuite) new(urlSets []util.URLSet) http.Handler {
+	return this.newWithCerts(urlSets, []CertKey{{CertHandler: fakeCertHandler{}, Key: pkgt.Key}}, false)
+}
+
+func (this *SignerSuite) newWithCerts(urlSets []util.URLSet, certs []CertKey, signWithAllCerts bool) http.Handler {
 	forwardedRequestHeaders := []string{"Host", "X-Foo"}
 	this.fakeClock = pkgt.NewFakeClock()
-	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, forwardedRequestHeaders, this.fakeClock.Now)
+	handler, err := New(Options{
+		Certs:                   certs,
+		SignWithAllCerts:        signWithAllCerts,
+		URLSets:                 urlSets,
+		RTVCache:                &rtv.RTVCache{},
+		ShouldPackage:           func(string) error { return this.shouldPackage },
+		RequireHeaders:          true,
+		ForwardedRequestHeaders: forwardedRequestHeaders,
+		TimeNow:                 this.fakeClock.Now,
+		SXGCache:                this.sxgCache,
+		Compression:             this.compression,
+		CSPPolicy:               this.cspPolicy,
+		Concurrency:             this.concurrency,
+		FetchTransport:          this.fetchTransport,
+		Debug:                   this.debug,
+	})
 	this.Require().NoError(err)
-	// Accept the self-signed certificate generated by the test server.
-	handler.client = this.httpsClient
-	return mux.New(nil, handler, nil, nil, nil)
+	if this.fetchTransport == nil {
+		// Accept the self-signed certificate generated by the test server.
+		handler.client = this.httpsClient
+	}
+	this.signer = handler
+	return mux.New(nil, handler, NewExplainer(handler), nil, nil, nil)
 }
 
 func (this *SignerSuite) httpURL() string {
@@ -150,22 +193,31 @@ func (this *SignerSuite) TearDownSuite() {
 
 func (this *SignerSuite) SetupTest() {
 	this.shouldPackage = nil
+	this.sxgCache = nil
+	this.compression = nil
+	this.cspPolicy = nil
+	this.concurrency = nil
+	this.fetchTransport = nil
+	this.debug = false
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		this.lastRequest = req
 		resp.Header().Set("Content-Type", "text/html")
 		resp.Write(fakeBody)
 	}
 	// Don't actually do any transforms. Only parse & print.
-	getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
-		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_NONE,
+	getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+		return &rpb.Request{DocumentUrl: u, Config: rpb.Request_NONE,
 			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
 	}
+	getRTV = func(r *rtv.RTVCache) string {
+		return "1234"
+	}
 }
 
 func (this *SignerSuite) TestSimple() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -217,8 +269,8 @@ func (this *SignerSuite) TestSimple() {
 
 func (this *SignerSuite) TestFetchSignWithForwardedRequestHeaders() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.certSubjectCN(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.certSubjectCN(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		// Host and X-Foo headers are forwarded with forwardedRequestHeaders
@@ -263,10 +315,351 @@ func (this *SignerSuite) TestFetchSignWithForwardedRequestHeaders() {
 	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
 }
 
+func (this *SignerSuite) TestSelectsCertByHost() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Domain: "amppackageexample.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}, {
+		Sign:  &util.URLPattern{Domain: "www.amppackageexample2.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	handler := this.newWithCerts(urlSets, []CertKey{
+		{CertHandler: fakeCertHandler{pkgt.B3Certs}, Key: pkgt.B3Key},
+		{CertHandler: fakeCertHandler{pkgt.B3Certs2}, Key: pkgt.B3Key2},
+	}, false)
+
+	for _, test := range []struct {
+		signURL  string
+		certName string
+	}{
+		{"https://amppackageexample.com" + fakePath, util.CertName(pkgt.B3Certs[0])},
+		{"https://www.amppackageexample2.com" + fakePath, util.CertName(pkgt.B3Certs2[0])},
+	} {
+		target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(test.signURL)
+		resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(test.signURL, exchange.RequestURI)
+		signURL, err := url.Parse(test.signURL)
+		this.Require().NoError(err)
+		this.Assert().Contains(exchange.SignatureHeaderValue, "cert-url=\"https://"+signURL.Host+"/amppkg/cert/"+test.certName+"\"")
+		certHash, _ := base64.RawURLEncoding.DecodeString(test.certName)
+		this.Assert().Contains(exchange.SignatureHeaderValue, "cert-sha256=*"+base64.StdEncoding.EncodeToString(certHash[:])+"*")
+	}
+}
+
+func (this *SignerSuite) TestSignsWithAllCerts() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Domain: "amppackageexample.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	// The second chain doesn't cover the sign URL, so it shouldn't sign.
+	certs := [][]*x509.Certificate{pkgt.B3Certs91Days, pkgt.B3Certs2, pkgt.B3Certs}
+	handler := this.newWithCerts(urlSets, []CertKey{
+		{CertHandler: fakeCertHandler{certs[0]}, Key: pkgt.B3Key},
+		{CertHandler: fakeCertHandler{certs[1]}, Key: pkgt.B3Key2},
+		{CertHandler: fakeCertHandler{certs[2]}, Key: pkgt.B3Key},
+	}, true)
+
+	signURL := "https://amppackageexample.com" + fakePath
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(signURL)
+	resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().Len(signatures, 2)
+	for i, chain := range [][]*x509.Certificate{certs[0], certs[2]} {
+		certName := util.CertName(chain[0])
+		this.Assert().Equal("https://amppackageexample.com/amppkg/cert/"+certName, signatures[i].Params["cert-url"])
+		certHash, _ := base64.RawURLEncoding.DecodeString(certName)
+		this.Assert().Equal(certHash, signatures[i].Params["cert-sha256"])
+	}
+	this.Assert().Equal(signatures[0].Params["date"], signatures[1].Params["date"])
+	this.Assert().Equal(signatures[0].Params["expires"], signatures[1].Params["expires"])
+}
+
+func (this *SignerSuite) TestSXGCache() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	var err error
+	this.sxgCache, err = NewSXGCache(1<<20, "", 0)
+	this.Require().NoError(err)
+	etag := `"v1"`
+	fetches := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		this.lastRequest = req
+		resp.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte(strings.Replace(string(fakeBody), "OPINE", "OPINE "+strings.Trim(etag, `"`), 1)))
+	}
+	handler := this.new(urlSets)
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	get := func(reqHeader http.Header) (int, []byte) {
+		resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", reqHeader).Do()
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		return resp.StatusCode, body
+	}
+
+	status, first := get(header)
+	this.Require().Equal(http.StatusOK, status)
+	this.Assert().Empty(this.lastRequest.Header.Get("If-None-Match"))
+
+	// The origin is revalidated, and responds 304, so the cached SXG is served.
+	status, second := get(header)
+	this.Require().Equal(http.StatusOK, status)
+	this.Assert().Equal(etag, this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().Equal(first, second)
+	this.Assert().Equal(2, fetches)
+
+	// Requests with their own conditional headers bypass the cache.
+	conditionalHeader := http.Header{"If-None-Match": {`"other"`}}
+	for k, v := range header {
+		conditionalHeader[k] = v
+	}
+	status, _ = get(conditionalHeader)
+	this.Require().Equal(http.StatusOK, status)
+	this.Assert().Equal(`"other"`, this.lastRequest.Header.Get("If-None-Match"))
+
+	// A changed document is repackaged.
+	etag = `"v2"`
+	status, third := get(header)
+	this.Require().Equal(http.StatusOK, status)
+	this.Assert().Equal(`"v1"`, this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().NotEqual(first, third)
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(third))
+	this.Require().NoError(err)
+	this.Assert().Contains(string(exchange.Payload), "OPINE v2")
+
+	// A new RTV requires repackaging.
+	getRTV = func(r *rtv.RTVCache) string {
+		return "5678"
+	}
+	status, fourth := get(header)
+	this.Require().Equal(http.StatusOK, status)
+	this.Assert().Empty(this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().NotEqual(third, fourth)
+}
+
+func (this *SignerSuite) TestOuterETag() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	etag := `"v1"`
+	ignoreConditionals := false
+	fetches := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		this.lastRequest = req
+		resp.Header().Set("ETag", etag)
+		if !ignoreConditionals && req.Header.Get("If-None-Match") == etag {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler := this.new(urlSets)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	get := func(ifNoneMatch string) *http.Response {
+		reqHeader := http.Header{}
+		for k, v := range header {
+			reqHeader[k] = v
+		}
+		if ifNoneMatch != "" {
+			reqHeader.Set("If-None-Match", ifNoneMatch)
+		}
+		return pkgt.NewRequest(this.T(), handler, target).SetHeaders("", reqHeader).Do()
+	}
+
+	resp := get("")
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+	outer := resp.Header.Get("ETag")
+	this.Assert().True(strings.HasPrefix(outer, outerETagPrefix), "ETag: %s", outer)
+
+	// The origin confirms the inner ETag, so the SXG isn't re-signed.
+	resp = get(outer)
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode)
+	this.Assert().Equal(outer, resp.Header.Get("ETag"))
+	this.Assert().Equal("no-transform, max-age=0", resp.Header.Get("Cache-Control"))
+	this.Assert().Equal(etag, this.lastRequest.Header.Get("If-None-Match"))
+
+	// The same applies to origins that ignore conditional requests.
+	ignoreConditionals = true
+	resp = get(outer)
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode)
+	this.Assert().Equal(outer, resp.Header.Get("ETag"))
+	ignoreConditionals = false
+
+	// A changed document is re-signed.
+	etag = `"v2"`
+	resp = get(outer)
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal(`"v1"`, this.lastRequest.Header.Get("If-None-Match"))
+	outer = resp.Header.Get("ETag")
+
+	// A new RTV requires re-signing, so the outer ETag isn't forwarded.
+	getRTV = func(r *rtv.RTVCache) string {
+		return "5678"
+	}
+	resp = get(outer)
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Empty(this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().NotEqual(outer, resp.Header.Get("ETag"))
+	this.Assert().NotEmpty(resp.Header.Get("ETag"))
+	this.Assert().Equal(5, fetches)
+}
+
+func (this *SignerSuite) TestNoOuterETagWithoutInnerETag() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Empty(resp.Header.Get("ETag"))
+}
+
+func (this *SignerSuite) TestSXGCacheServesNotModifiedIfUnhealthy() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	var err error
+	this.sxgCache, err = NewSXGCache(1<<20, "", 0)
+	this.Require().NoError(err)
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("ETag", `"v1"`)
+		resp.Write(fakeBody)
+	}
+	handler := this.new(urlSets)
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	// When unhealthy, the cache isn't consulted, so that the client doesn't
+	// receive a 304 it didn't ask for.
+	this.shouldPackage = errors.New("random error")
+	resp = pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Empty(this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+// Returns the number of requests waiting on identical concurrent requests.
+func (this *SignerSuite) coalescedWaiters() int {
+	this.signer.inflight.mu.Lock()
+	defer this.signer.inflight.mu.Unlock()
+	waiters := 0
+	for _, call := range this.signer.inflight.calls {
+		waiters += call.waiters
+	}
+	return waiters
+}
+
+// Sends two identical requests, such that the second arrives while the first
+// is waiting on the origin. Returns both responses.
+func (this *SignerSuite) doConcurrentRequests(handler http.Handler, target string, fetched chan struct{}, release chan struct{}) [2]*http.Response {
+	var resps [2]*http.Response
+	done := make(chan struct{})
+	go func() {
+		resps[0] = pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+		done <- struct{}{}
+	}()
+	<-fetched
+	go func() {
+		resps[1] = pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+		done <- struct{}{}
+	}()
+	for this.coalescedWaiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+	<-done
+	return resps
+}
+
+func (this *SignerSuite) TestCoalescesIdenticalRequests() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	fetched := make(chan struct{}, 2)
+	release := make(chan struct{})
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetched <- struct{}{}
+		<-release
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	coalescedBefore := promtest.ToFloat64(promCoalescedRequests.WithLabelValues())
+
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resps := this.doConcurrentRequests(this.new(urlSets), target, fetched, release)
+
+	this.Assert().Len(fetched, 0, "origin was fetched more than once")
+	var bodies [2][]byte
+	for i, resp := range resps {
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+		var err error
+		bodies[i], err = ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+	}
+	this.Assert().Equal(bodies[0], bodies[1])
+	this.Assert().Equal(coalescedBefore+1, promtest.ToFloat64(promCoalescedRequests.WithLabelValues()))
+	this.Assert().Empty(this.signer.inflight.calls)
+}
+
+func (this *SignerSuite) TestCoalescedRequestFallsBackIfNotPackaged() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+	}}
+	fetched := make(chan struct{}, 2)
+	release := make(chan struct{})
+	first := true
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if first {
+			first = false
+			fetched <- struct{}{}
+			<-release
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	coalescedBefore := promtest.ToFloat64(promCoalescedRequests.WithLabelValues())
+
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resps := this.doConcurrentRequests(this.new(urlSets), target, fetched, release)
+
+	this.Assert().Equal(http.StatusServiceUnavailable, resps[0].StatusCode)
+	this.Assert().Equal(http.StatusOK, resps[1].StatusCode)
+	this.Assert().Equal(accept.SxgContentType, resps[1].Header.Get("Content-Type"))
+	this.Assert().Equal(coalescedBefore, promtest.ToFloat64(promCoalescedRequests.WithLabelValues()))
+}
+
 func (this *SignerSuite) TestForwardedHost() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	header := http.Header{
 		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
@@ -283,8 +676,8 @@ func (this *SignerSuite) TestForwardedHost() {
 
 func (this *SignerSuite) TestEscapeQueryParamsInFetchAndSign() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath+"?<hi>") + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath+"?<hi>")
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -298,8 +691,8 @@ func (this *SignerSuite) TestEscapeQueryParamsInFetchAndSign() {
 
 func (this *SignerSuite) TestMissingFetchParam() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -308,8 +701,8 @@ func (this *SignerSuite) TestMissingFetchParam() {
 
 func (this *SignerSuite) TestMissingSignParam() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath)
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -318,7 +711,7 @@ func (this *SignerSuite) TestMissingSignParam() {
 
 func (this *SignerSuite) TestDisallowInvalidCharsSign() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	target := "/priv/doc?&sign=" + url.QueryEscape(this.httpSignURL()+fakePath+"<hi>")
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -327,7 +720,7 @@ func (this *SignerSuite) TestDisallowInvalidCharsSign() {
 
 func (this *SignerSuite) TestNoFetchParam() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
@@ -340,7 +733,7 @@ func (this *SignerSuite) TestNoFetchParam() {
 
 func (this *SignerSuite) TestSignAsPathParam() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	target := `/priv/doc/` + this.httpsURL() + fakePath
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -354,7 +747,7 @@ func (this *SignerSuite) TestSignAsPathParam() {
 
 func (this *SignerSuite) TestSignAsPathParamWithQuery() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000},
 	}}
 	target := `/priv/doc/` + this.httpsURL() + fakePath + "?amp=1"
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -369,7 +762,7 @@ func (this *SignerSuite) TestSignAsPathParamWithQuery() {
 // Ensure that the server doesn't attempt to percent-decode the sign URL.
 func (this *SignerSuite) TestSignAsPathParamWithUnusualPctEncoding() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	target := `/priv/doc/` + this.httpsURL() + fakePath + `%2A`
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
@@ -383,7 +776,7 @@ func (this *SignerSuite) TestSignAsPathParamWithUnusualPctEncoding() {
 
 func (this *SignerSuite) TestPreservesContentType() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html;charset=utf-8;v=5")
 		resp.Write(fakeBody)
@@ -399,7 +792,7 @@ func (this *SignerSuite) TestPreservesContentType() {
 
 func (this *SignerSuite) TestRemovesLinkHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Header().Set("Link", "rel=preload;<http://1.2.3.4/>")
@@ -416,7 +809,7 @@ func (this *SignerSuite) TestRemovesLinkHeaders() {
 
 func (this *SignerSuite) TestRemovesStatefulHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Header().Set("Set-Cookie", "yum yum yum")
@@ -433,16 +826,7 @@ func (this *SignerSuite) TestRemovesStatefulHeaders() {
 
 func (this *SignerSuite) TestMutatesCspHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{
-			[]string{"https"},
-			"",
-			this.httpsHost(),
-			stringPtr("/amp/.*"),
-			[]string{},
-			stringPtr(""),
-			false,
-			2000,
-			nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		// Expect base-uri and block-all-mixed-content to remain unmodified.
@@ -474,9 +858,54 @@ func (this *SignerSuite) TestMutatesCspHeaders() {
 		exchange.ResponseHeaders.Get("Content-Security-Policy"))
 }
 
+func (this *SignerSuite) TestMutatesCspHeadersPerPolicy() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
+	this.cspPolicy = &util.CSPConfig{
+		KeepDirectives: []string{"font-src"},
+		ExtraFontSrc:   []string{"https://fonts.example.com"},
+	}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Expect base-uri to be stripped, as it's not in KeepDirectives.
+		resp.Header().Set(
+			"Content-Security-Policy",
+			"base-uri http://*.example.com; font-src 'self'")
+		resp.Write(fakeBody)
+	}
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(
+		http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(
+		"font-src 'self' https://fonts.example.com;"+
+			"default-src * blob: data:;"+
+			"report-uri https://csp.withgoogle.com/csp/amp;"+
+			"script-src blob: https://cdn.ampproject.org/rtv/ https://cdn.ampproject.org/v0.js https://cdn.ampproject.org/v0.mjs https://cdn.ampproject.org/v0/ https://cdn.ampproject.org/lts/ https://cdn.ampproject.org/viewer/;"+
+			"style-src 'unsafe-inline' https://cdn.materialdesignicons.com https://cloud.typography.com https://fast.fonts.net https://fonts.googleapis.com https://maxcdn.bootstrapcdn.com https://p.typekit.net https://pro.fontawesome.com https://use.fontawesome.com https://use.typekit.net;"+
+			"object-src 'none'",
+		exchange.ResponseHeaders.Get("Content-Security-Policy"))
+}
+
+func TestMutateContentSecurityPolicyFontSrcNone(t *testing.T) {
+	policy := &util.CSPConfig{KeepDirectives: []string{"font-src"}, ExtraFontSrc: []string{"https://fonts.example.com"}}
+	csp := MutateContentSecurityPolicy("font-src 'NONE'", policy)
+	if !strings.HasPrefix(csp, "font-src https://fonts.example.com;default-src ") {
+		t.Errorf("unexpected CSP: %s", csp)
+	}
+	// Without a font-src, default-src applies, so there's nothing to extend.
+	csp = MutateContentSecurityPolicy("", policy)
+	if !strings.HasPrefix(csp, "default-src ") {
+		t.Errorf("unexpected CSP: %s", csp)
+	}
+}
+
 func (this *SignerSuite) TestAddsLinkHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Write([]byte(`<html amp><head><link rel=stylesheet href=foo><script src=bar></script><link rel=preload as=image href=baz imagesizes="100vw" imagesrcset="qux">`))
@@ -492,7 +921,7 @@ func (this *SignerSuite) TestAddsLinkHeaders() {
 
 func (this *SignerSuite) TestEscapesLinkHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		// This shouldn't happen for valid AMP, and AMP Caches should
@@ -513,7 +942,7 @@ func (this *SignerSuite) TestEscapesLinkHeaders() {
 
 func (this *SignerSuite) TestRemovesHopByHopHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Header().Set("Connection", "PROXY-AUTHENTICATE, Server")
@@ -535,9 +964,101 @@ func (this *SignerSuite) TestRemovesHopByHopHeaders() {
 	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Transfer-Encoding"))
 }
 
+// Returns the date and expires params of the first signature.
+func (this *SignerSuite) signatureDates(resp *http.Response) (int64, int64) {
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	return date, expires
+}
+
+func (this *SignerSuite) TestConfiguredLifetime() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000,
+			Backdate: 2 * time.Hour, MaxLifetime: 96 * time.Hour}}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	date, expires := this.signatureDates(resp)
+	this.Assert().InDelta(time.Now().Add(-2*time.Hour).Unix(), date, 5)
+	this.Assert().Equal(int64(96*60*60), expires-date)
+}
+
+func (this *SignerSuite) TestHonorMaxAge() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000,
+			HonorMaxAge: true}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "max-age=345600")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	date, expires := this.signatureDates(resp)
+	this.Assert().InDelta(time.Now().Add(-24*time.Hour).Unix(), date, 5)
+	this.Assert().InDelta(time.Now().Add(345600*time.Second).Unix(), expires, 5)
+}
+
+func (this *SignerSuite) TestIgnoresMaxAgeByDefault() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	date, expires := this.signatureDates(resp)
+	this.Assert().Equal(int64(604800), expires-date)
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfMaxAgeExpired() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000,
+			HonorMaxAge: true}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Header().Set("Age", "60")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfMaxAgeTooShort() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000,
+			HonorMaxAge: true}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "max-age=300")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+}
+
 func (this *SignerSuite) TestLimitsDuration() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Write([]byte("<html amp><body><amp-script script max-age=123456>"))
@@ -560,7 +1081,7 @@ func (this *SignerSuite) TestLimitsDuration() {
 
 func (this *SignerSuite) TestDoesNotExtendDuration() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
 		resp.Write([]byte("<html amp><body><amp-script script max-age=700000>"))
@@ -583,7 +1104,7 @@ func (this *SignerSuite) TestDoesNotExtendDuration() {
 
 func (this *SignerSuite) TestProxyUnsignedIfExpired() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	fakeBody := []byte("<html amp><body><amp-script script max-age=86400>")
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -600,7 +1121,7 @@ func (this *SignerSuite) TestProxyUnsignedIfExpired() {
 
 func (this *SignerSuite) TestErrorNoCache() {
 	urlSets := []util.URLSet{{
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
 	}}
 	// Missing sign param generates an error.
 	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath)
@@ -611,7 +1132,7 @@ func (this *SignerSuite) TestErrorNoCache() {
 
 func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -627,58 +1148,493 @@ func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
 	this.Assert().Equal("/login", resp.Header.Get("location"))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
-	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+// A URLSet that follows up to the given number of redirects.
+func (this *SignerSuite) redirectURLSets(maxRedirects int) []util.URLSet {
+	return []util.URLSet{{
+		Sign:         &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		MaxRedirects: maxRedirects,
 	}}
-	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Cache-control", "private")
-		resp.Header().Set("Cookie", "yum yum yum")
-		resp.Header().Set("ETag", "superrad")
-		resp.WriteHeader(304)
+}
+
+// Redirects each path in redirects to its value, and serves fakeBody at any
+// other path.
+func (this *SignerSuite) redirectingHandler(redirects map[string]string) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		if location, ok := redirects[req.URL.Path]; ok {
+			resp.Header().Set("Location", location)
+			resp.WriteHeader(http.StatusFound)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+}
+
+func (this *SignerSuite) TestFollowsSameOriginRedirects() {
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath:          "/amp/moved.html",
+		"/amp/moved.html": this.httpsURL() + "/amp/moved/",
+	})
+	var documentURL string
+	getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+		documentURL = u
+		return &rpb.Request{DocumentUrl: u, Config: rpb.Request_NONE,
+			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
 	}
 
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
-	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
-	this.Assert().Equal(304, resp.StatusCode)
-	this.Assert().Equal("private", resp.Header.Get("cache-control"))
-	this.Assert().Equal("", resp.Header.Get("cookie"))
-	this.Assert().Equal("superrad", resp.Header.Get("etag"))
+	resp := pkgt.NewRequest(this.T(), this.new(this.redirectURLSets(2)), target).SetHeaders("", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/amp/moved/", this.lastRequest.URL.Path)
+	this.Assert().Equal(this.httpsURL()+"/amp/moved/", documentURL)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	// The document is signed under the requested URL, as required of the
+	// fallback URL by AMP caches.
+	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	this.Assert().Equal(200, exchange.ResponseStatus)
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfShouldntPackage() {
+func (this *SignerSuite) TestProxyUnsignedIfTooManyRedirects() {
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath:          "/amp/moved.html",
+		"/amp/moved.html": "/amp/moved/",
+	})
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.redirectURLSets(1)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusFound, resp.StatusCode)
+	this.Assert().Equal("/amp/moved/", resp.Header.Get("Location"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfRedirectCrossOrigin() {
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath: this.httpURL() + "/amp/moved.html",
+	})
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.redirectURLSets(2)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusFound, resp.StatusCode)
+	this.Assert().Equal(this.httpURL()+"/amp/moved.html", resp.Header.Get("Location"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfRedirectDoesNotMatchURLSet() {
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath: "/login",
+	})
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.redirectURLSets(2)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusFound, resp.StatusCode)
+	this.Assert().Equal("/login", resp.Header.Get("Location"))
+}
+
+func (this *SignerSuite) TestFollowsRedirectsFromFetchURL() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign:         &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000},
+		Fetch:        &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000, SamePath: boolPtr(true)},
+		MaxRedirects: 1,
 	}}
-	this.shouldPackage = errors.New("random error")
-	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
-	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	body, err := ioutil.ReadAll(resp.Body)
-	this.Require().NoError(err)
-	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath: "/amp/moved.html?page=1",
+	})
+
+	target := "/priv/explain?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	explanation := this.explain(urlSets, target, header)
+	this.Assert().Equal(decisionSigned, explanation.Decision, explanation.Error)
+	this.Assert().Equal(this.httpSignURL()+fakePath, explanation.SignURL)
+	this.Assert().Equal(this.httpURL()+fakePath, explanation.FetchURL)
+	this.Assert().Equal(this.httpSignURL()+"/amp/moved.html?page=1", explanation.DocumentURL)
+	this.Assert().Equal("page=1", this.lastRequest.URL.RawQuery)
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfMissingAMPCacheTransformHeader() {
+func (this *SignerSuite) TestShedsToUnsignedWhenOverloaded() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
-	header := http.Header{"Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}}
-	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.concurrency = &util.ConcurrencyConfig{MaxSigning: 1, MaxQueued: 1, QueueTimeout: time.Millisecond, Shed: util.ShedUnsigned}
+	handler := this.new(urlSets)
+	release, err := this.signer.limiter.acquire(context.Background())
+	this.Require().NoError(err)
+	defer release()
+
+	before := promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned", "overloaded"))
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
 	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+	this.Assert().Equal(fakeBody, body)
+	this.Assert().Equal(before+1, promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned", "overloaded")))
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfInvalidAMPCacheTransformHeader() {
+func (this *SignerSuite) TestShedsTo503WhenOverloaded() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
-	header := http.Header{
-		"Accept":              {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
-		"AMP-Cache-Transform": {"donotmatch"},
+	this.concurrency = &util.ConcurrencyConfig{MaxSigning: 4, MaxQueued: 4, QueueTimeout: time.Second,
+		MaxMemoryBytes: 1, Shed: util.ShedUnavailable, RetryAfter: 1500 * time.Millisecond}
+	handler := this.new(urlSets)
+	release, err := this.signer.limiter.reserveMemory(1)
+	this.Require().NoError(err)
+	defer release()
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	this.Assert().Equal("2", resp.Header.Get("Retry-After"))
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+}
+
+func (this *SignerSuite) TestSignsWithinConcurrencyLimits() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.concurrency = &util.ConcurrencyConfig{MaxSigning: 1, MaxQueued: 1, QueueTimeout: time.Second, MaxMemoryBytes: 1 << 20, Shed: util.ShedUnavailable}
+	handler := this.new(urlSets)
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	for i := 0; i < 2; i++ {
+		resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode)
+		this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	}
+	this.Assert().Equal(0.0, promtest.ToFloat64(promSigningRequests.WithLabelValues()))
+	this.Assert().Equal(0.0, promtest.ToFloat64(promSigningMemoryBytes.WithLabelValues()))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Cache-control", "private")
+		resp.Header().Set("Cookie", "yum yum yum")
+		resp.Header().Set("ETag", "superrad")
+		resp.WriteHeader(304)
+	}
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(304, resp.StatusCode)
+	this.Assert().Equal("private", resp.Header.Get("cache-control"))
+	this.Assert().Equal("", resp.Header.Get("cookie"))
+	this.Assert().Equal("superrad", resp.Header.Get("etag"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfShouldntPackage() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.shouldPackage = errors.New("random error")
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestSignsWithNegotiatedVersion() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	header := http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=b3;q=0.5,application/signed-exchange;v=b2"}}
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/signed-exchange;v=b2", resp.Header.Get("Content-Type"))
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(version.Version1b2, exchange.Version)
+	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfAcceptPrefersHTML() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	header := http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"text/html,application/signed-exchange;v=b3;q=0.9"}}
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) optimizeURLSets() []util.URLSet {
+	return []util.URLSet{{
+		Sign:     &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Optimize: true,
+	}}
+}
+
+func (this *SignerSuite) TestOptimizesForNonSXGClients() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("ETag", `"abc"`)
+		resp.Header().Set("Set-Cookie", "yum=1")
+		resp.Write(fakeBody)
+	}
+	before := promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("optimized unsigned", "amp_cache_transform"))
+	header := http.Header{"Accept": {"text/html"}}
+	resp := pkgt.NewRequest(this.T(), this.new(this.optimizeURLSets()), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	this.Assert().Equal(`W/"abc"`, resp.Header.Get("ETag"))
+	// Unlike SXGs, stateful headers are kept, as the document is served
+	// directly to the client.
+	this.Assert().Equal("yum=1", resp.Header.Get("Set-Cookie"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), `transformed="self;v=1"`)
+	this.Assert().Contains(string(body), "They like to OPINE.")
+	this.Assert().Equal(strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+	this.Assert().Equal(before+1, promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("optimized unsigned", "amp_cache_transform")))
+}
+
+func (this *SignerSuite) TestOptimizedNotModified() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.Assert().Equal(`W/"abc"`, req.Header.Get("If-None-Match"))
+		resp.Header().Set("ETag", `"abc"`)
+		resp.WriteHeader(http.StatusNotModified)
+	}
+	header := http.Header{"Accept": {"text/html"}, "If-None-Match": {`W/"abc"`}}
+	resp := pkgt.NewRequest(this.T(), this.new(this.optimizeURLSets()), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(`W/"abc"`, resp.Header.Get("ETag"))
+}
+
+func (this *SignerSuite) TestOptimizeProxiesNonAMP() {
+	nonAMPBody := []byte("<html><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(nonAMPBody)
+	}
+	header := http.Header{"Accept": {"text/html"}}
+	resp := pkgt.NewRequest(this.T(), this.new(this.optimizeURLSets()), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(nonAMPBody, body)
+}
+
+func (this *SignerSuite) TestOptimizeStillSignsForSXGClients() {
+	resp := pkgt.NewRequest(this.T(), this.new(this.optimizeURLSets()), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+}
+
+// Returns a front end that signs example.com's AMP documents, fetching them
+// from the test HTTP server.
+func (this *SignerSuite) newFrontEnd() http.Handler {
+	return this.newFrontEndWithRedirects(0)
+}
+
+// Same as newFrontEnd, but follows up to the given number of redirects.
+func (this *SignerSuite) newFrontEndWithRedirects(maxRedirects int) http.Handler {
+	this.new([]util.URLSet{{
+		Sign:         &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		MaxRedirects: maxRedirects,
+	}})
+	frontEnd, err := NewFrontEnd(this.signer, &util.FrontEndConfig{Origin: this.httpURL(), Hosts: []string{"example.com"}})
+	this.Require().NoError(err)
+	return mux.NewFrontEnd(nil, frontEnd, nil, nil, nil)
+}
+
+func (this *SignerSuite) TestFrontEndSigns() {
+	for _, host := range []string{"example.com", "EXAMPLE.com:443"} {
+		this.lastRequest = nil
+		resp := pkgt.NewRequest(this.T(), this.newFrontEnd(), fakePath).SetHeaders(host, header).Do()
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Require().NotNil(this.lastRequest)
+		this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+		this.Assert().Equal("example.com", this.lastRequest.Host)
+		this.Assert().Equal(userAgent, this.lastRequest.Header.Get("User-Agent"))
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal("https://example.com"+fakePath, exchange.RequestURI)
+		this.Assert().Contains(exchange.SignatureHeaderValue, `cert-url="https://example.com/amppkg/cert/`+pkgt.CertName+`"`)
+	}
+}
+
+func (this *SignerSuite) TestFrontEndFollowsRedirectsFromOrigin() {
+	// The origin redirects to its public URLs, both relative and absolute.
+	this.fakeHandler = this.redirectingHandler(map[string]string{
+		fakePath:          "/amp/moved.html",
+		"/amp/moved.html": "https://example.com/amp/moved/",
+	})
+
+	resp := pkgt.NewRequest(this.T(), this.newFrontEndWithRedirects(2), fakePath).SetHeaders("example.com", header).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/amp/moved/", this.lastRequest.URL.Path)
+	this.Assert().Equal("example.com", this.lastRequest.Host)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("https://example.com"+fakePath, exchange.RequestURI)
+	this.Assert().Equal(200, exchange.ResponseStatus)
+}
+
+func (this *SignerSuite) TestFrontEndProxiesOtherRequests() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		body, err := ioutil.ReadAll(req.Body)
+		this.Require().NoError(err)
+		resp.Header().Set("Content-Type", "text/plain")
+		resp.Write(append([]byte(req.Method+" "), body...))
+	}
+
+	// Not in the URLSet.
+	resp := pkgt.NewRequest(this.T(), this.newFrontEnd(), "/style.css?v=1").SetHeaders("example.com", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/style.css?v=1", this.lastRequest.URL.String())
+	this.Assert().Equal("example.com", this.lastRequest.Host)
+	this.Assert().Equal("example.com", this.lastRequest.Header.Get("X-Forwarded-Host"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("GET ", string(body))
+
+	// Not a GET.
+	resp = pkgt.NewRequest(this.T(), this.newFrontEnd(), fakePath).SetHeaders("example.com", http.Header{}).SetBody(strings.NewReader("a=b")).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("POST a=b", string(body))
+
+	// The /priv/ URLs aren't served by the front end.
+	resp = pkgt.NewRequest(this.T(), this.newFrontEnd(), "/priv/doc?sign="+url.QueryEscape("https://example.com"+fakePath)).SetHeaders("example.com", header).Do()
+	this.Assert().Equal("text/plain", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("/priv/doc", this.lastRequest.URL.Path)
+}
+
+func (this *SignerSuite) TestFrontEndProxiesNonSXGRequests() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+
+	// A browser that doesn't accept SXGs.
+	resp := pkgt.NewRequest(this.T(), this.newFrontEnd(), fakePath).SetHeaders("example.com", http.Header{
+		"Accept":     {"text/html"},
+		"Cookie":     {"session=abc"},
+		"User-Agent": {"Mozilla/5.0"},
+	}).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	this.Assert().Equal("session=abc", this.lastRequest.Header.Get("Cookie"))
+	this.Assert().Equal("Mozilla/5.0", this.lastRequest.Header.Get("User-Agent"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body)
+}
+
+func (this *SignerSuite) TestFrontEndRejectsUnknownHosts() {
+	for _, host := range []string{"attacker.com", "example.com:8443", "example.com.attacker.com"} {
+		this.lastRequest = nil
+		resp := pkgt.NewRequest(this.T(), this.newFrontEnd(), fakePath).SetHeaders(host, header).Do()
+		this.Assert().Equal(http.StatusMisdirectedRequest, resp.StatusCode, "incorrect status for %q: %#v", host, resp)
+		this.Assert().Nil(this.lastRequest, "fetched for %q", host)
+	}
+}
+
+func (this *SignerSuite) TestProxyUnsignedReasons() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), ErrorOnStatefulHeaders: true, MaxLength: 2000},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	serve := func(header http.Header, body []byte) func(http.ResponseWriter, *http.Request) {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/html")
+			for name, values := range header {
+				resp.Header()[name] = values
+			}
+			if body == nil {
+				body = fakeBody
+			}
+			resp.Write(body)
+		}
+	}
+	scenarios := []struct {
+		reason        unsignedReason
+		shouldPackage error
+		requestHeader http.Header
+		fakeHandler   func(http.ResponseWriter, *http.Request)
+	}{
+		{reason: reasonUnhealthy, shouldPackage: errors.New("no OCSP")},
+		{reason: reasonAMPCacheTransform, requestHeader: http.Header{"Accept": header["Accept"]}},
+		{reason: reasonAccept, requestHeader: http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"text/html"}}},
+		{reason: reasonStatusCode, fakeHandler: func(resp http.ResponseWriter, req *http.Request) { resp.WriteHeader(404) }},
+		{reason: reasonNonCacheable, fakeHandler: serve(http.Header{"Cache-Control": {"no-store"}}, nil)},
+		{reason: reasonContentEncoding, fakeHandler: serve(http.Header{"Content-Encoding": {"zstd"}}, nil)},
+		{reason: reasonContentType, fakeHandler: serve(http.Header{"Content-Type": {"text/plain"}}, nil)},
+		{reason: reasonStatefulHeader, fakeHandler: serve(http.Header{"Set-Cookie": {"a=b"}}, nil)},
+		{reason: reasonVariants, fakeHandler: serve(http.Header{"Variants": {"foo"}}, nil)},
+		{reason: reasonTooLarge, fakeHandler: serve(nil, make([]byte, maxSignableBodyLength))},
+	}
+	for _, scenario := range scenarios {
+		this.Run(string(scenario.reason), func() {
+			before := promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned", string(scenario.reason)))
+			this.shouldPackage = scenario.shouldPackage
+			if scenario.fakeHandler != nil {
+				this.fakeHandler = scenario.fakeHandler
+			} else {
+				this.fakeHandler = serve(nil, nil)
+			}
+			requestHeader := scenario.requestHeader
+			if requestHeader == nil {
+				requestHeader = header
+			}
+
+			this.debug = true
+			resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", requestHeader).Do()
+			this.Assert().Equal(string(scenario.reason), resp.Header.Get("AMP-Packager-Reason"))
+			this.Assert().Equal(before+1, promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("proxied unsigned", string(scenario.reason))))
+
+			this.debug = false
+			resp = pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", requestHeader).Do()
+			this.Assert().Empty(resp.Header.Get("AMP-Packager-Reason"))
+		})
+	}
+}
+
+func TestReasonOf(t *testing.T) {
+	if reason := reasonOf(errors.Wrap(newUnsignedError(reasonAccept, errors.New("bad")), "wrapped")); reason != reasonAccept {
+		t.Errorf("got %s", reason)
+	}
+	if reason := reasonOf(errors.New("unexpected")); reason != reasonSigningError {
+		t.Errorf("got %s", reason)
+	}
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfMissingAMPCacheTransformHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	header := http.Header{"Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}}
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body, "incorrect body: %#v", resp)
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfInvalidAMPCacheTransformHeader() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	header := http.Header{
+		"Accept":              {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"AMP-Cache-Transform": {"donotmatch"},
 	}
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
@@ -689,7 +1645,7 @@ func (this *SignerSuite) TestProxyUnsignedIfInvalidAMPCacheTransformHeader() {
 
 func (this *SignerSuite) TestProxyUnsignedIfMissingAcceptHeader() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	header := http.Header{"AMP-Cache-Transform": {"google"}}
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath)).SetHeaders("", header).Do()
@@ -701,7 +1657,7 @@ func (this *SignerSuite) TestProxyUnsignedIfMissingAcceptHeader() {
 
 func (this *SignerSuite) TestProxyUnsignedNonCachable() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html")
@@ -718,24 +1674,134 @@ func (this *SignerSuite) TestProxyUnsignedNonCachable() {
 
 func (this *SignerSuite) TestProxyUnsignedBadContentEncoding() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html")
-		resp.Header().Set("Content-Encoding", "br")
+		resp.Header().Set("Content-Encoding", "zstd")
 		resp.WriteHeader(200)
 	}
 
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
 	this.Assert().Equal(200, resp.StatusCode)
-	this.Assert().Equal("br", resp.Header.Get("Content-Encoding"))
+	this.Assert().Equal("zstd", resp.Header.Get("Content-Encoding"))
 	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
 }
 
+func (this *SignerSuite) TestDecodesCompressedResponse() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	for _, encoding := range []string{"br", "gzip", "deflate"} {
+		this.Run(encoding, func() {
+			before := promtest.ToFloat64(promUpstreamContentEncodings.WithLabelValues(encoding))
+			this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+				this.lastRequest = req
+				resp.Header().Set("Content-Type", "text/html")
+				resp.Header().Set("Content-Encoding", encoding)
+				resp.Write(encode(this.T(), encoding, fakeBody))
+			}
+
+			target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+			resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+			this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+			this.Assert().Equal(upstreamAcceptEncoding, this.lastRequest.Header.Get("Accept-Encoding"))
+			this.Assert().Equal(before+1, promtest.ToFloat64(promUpstreamContentEncodings.WithLabelValues(encoding)))
+
+			exchange, err := signedexchange.ReadExchange(resp.Body)
+			this.Require().NoError(err)
+			// The inner Content-Encoding is the MICE encoding of the decoded body.
+			this.Assert().Equal("mi-sha256-03", exchange.ResponseHeaders.Get("Content-Encoding"))
+			var payloadPrefix bytes.Buffer
+			binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+			this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
+		})
+	}
+}
+
+func (this *SignerSuite) TestProxyUnsignedDecodedResponse() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Content-Encoding", "br")
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.Write(encode(this.T(), "br", fakeBody))
+	}
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("", resp.Header.Get("Content-Encoding"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body)
+}
+
+func (this *SignerSuite) TestCompressesSignedExchange() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.compression = testCompressionConfig
+	requestHeader := header.Clone()
+	requestHeader.Set("Accept-Encoding", "gzip")
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", requestHeader).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("gzip", resp.Header.Get("Content-Encoding"))
+	this.Assert().Equal([]string{"Accept, AMP-Cache-Transform", "Accept-Encoding"}, resp.Header["Vary"])
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(decodedBodyOf(this.T(), resp)))
+	this.Require().NoError(err)
+	// The signed payload is unaffected.
+	this.Assert().Equal("mi-sha256-03", exchange.ResponseHeaders.Get("Content-Encoding"))
+	var payloadPrefix bytes.Buffer
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
+}
+
+func (this *SignerSuite) TestCompressesProxiedResponse() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	this.compression = testCompressionConfig
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.Header().Set("Content-Encoding", "gzip")
+		resp.Write(encode(this.T(), "gzip", fakeBody))
+	}
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", http.Header{"Accept-Encoding": {"br"}}).Do()
+	this.Assert().Equal(200, resp.StatusCode)
+	this.Assert().Equal("br", resp.Header.Get("Content-Encoding"))
+	this.Assert().Equal(fakeBody, decodedBodyOf(this.T(), resp))
+}
+
+func (this *SignerSuite) TestDoesNotCompressIfUnconfigured() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	requestHeader := header.Clone()
+	requestHeader.Set("Accept-Encoding", "gzip")
+
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", requestHeader).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("", resp.Header.Get("Content-Encoding"))
+	this.Assert().Equal("Accept, AMP-Cache-Transform", resp.Header.Get("Vary"))
+	_, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+}
+
 func (this *SignerSuite) TestProxyUnsignedErrOnStatefulHeader() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), ErrorOnStatefulHeaders: true, MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -753,7 +1819,7 @@ func (this *SignerSuite) TestProxyUnsignedErrOnStatefulHeader() {
 
 func (this *SignerSuite) TestProxyUnsignedOnVariants() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), ErrorOnStatefulHeaders: true, MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -772,7 +1838,7 @@ func (this *SignerSuite) TestProxyUnsignedOnVariants() {
 
 func (this *SignerSuite) TestProxyUnsignedOnVariants04() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), true, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), ErrorOnStatefulHeaders: true, MaxLength: 2000},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -790,7 +1856,7 @@ func (this *SignerSuite) TestProxyUnsignedOnVariants04() {
 
 func (this *SignerSuite) TestProxyUnsignedIfNotAMP() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	nonAMPBody := []byte("<html><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html")
@@ -807,7 +1873,7 @@ func (this *SignerSuite) TestProxyUnsignedIfNotAMP() {
 
 func (this *SignerSuite) TestProxyUnsignedIfWrongAMP() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	wrongAMPBody := []byte("<html amp4email><body>They like to OPINE. Get it? (Is he fir real? Yew gotta be kidding me.)")
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html")
@@ -822,14 +1888,101 @@ func (this *SignerSuite) TestProxyUnsignedIfWrongAMP() {
 	this.Assert().Equal(wrongAMPBody, body, "incorrect body: %#v", resp)
 }
 
+func (this *SignerSuite) TestProxiesChunkedOriginWithTrailers() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Trailer", "X-Checksum")
+		resp.Header().Set("Connection", "X-Hop")
+		resp.Header().Set("X-Hop", "1")
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("not "))
+		resp.(http.Flusher).Flush()
+		resp.Write([]byte("found"))
+		resp.Header().Set("X-Checksum", "abc")
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Empty(resp.Header.Get("X-Hop"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("not found", string(body))
+	this.Assert().Equal(http.Header{"X-Checksum": {"abc"}}, resp.Trailer)
+}
+
+func (this *SignerSuite) TestProxiesStreamingOrigin() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
+	release := make(chan struct{})
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/event-stream")
+		resp.Write([]byte("data: 1\n\n"))
+		resp.(http.Flusher).Flush()
+		<-release
+		resp.Write([]byte("data: 2\n\n"))
+	}
+	server := httptest.NewServer(this.new(urlSets))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), nil)
+	this.Require().NoError(err)
+	for name, values := range header {
+		req.Header.Set(name, values[0])
+	}
+	resp, err := server.Client().Do(req)
+	this.Require().NoError(err)
+	defer resp.Body.Close()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+
+	// The first event arrives before the origin has finished responding.
+	first := make([]byte, len("data: 1\n\n"))
+	_, err = io.ReadFull(resp.Body, first)
+	this.Require().NoError(err)
+	this.Assert().Equal("data: 1\n\n", string(first))
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("data: 2\n\n", string(rest))
+}
+
+func (this *SignerSuite) TestAbortsProxyOnTruncatedOrigin() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Content-Length", "100")
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("not found"))
+	}
+	server := httptest.NewServer(this.new(urlSets))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath))
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+	}
+	// The client sees that the response is incomplete (whether or not its
+	// header was sent before the abort), rather than a complete 404.
+	this.Assert().Error(err)
+}
+
 func (this *SignerSuite) TestProxyTransformError() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 
 	// Generate a request for non-existent transformer that will fail
-	getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
-		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_CUSTOM,
+	getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+		return &rpb.Request{DocumentUrl: u, Config: rpb.Request_CUSTOM,
 			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP},
 			Transformers:   []string{"bogus"}}
 	}
@@ -845,14 +1998,14 @@ func (this *SignerSuite) TestProxyTransformError() {
 
 func (this *SignerSuite) TestProxyHeadersUnaltered() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 
 	// "Perform local transformations" is close to the last opportunity that a
 	// response could be proxied instead of signed. Intentionally cause an error
 	// to occur so that we can verify the proxy response has not been altered.
-	getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
-		return &rpb.Request{Html: string(s), DocumentUrl: u, Config: rpb.Request_CUSTOM,
+	getTransformerRequest = func(r *rtv.RTVCache, u string) *rpb.Request {
+		return &rpb.Request{DocumentUrl: u, Config: rpb.Request_CUSTOM,
 			AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP},
 			Transformers:   []string{"bogus"}}
 	}
@@ -887,6 +2040,117 @@ func (this *SignerSuite) TestProxyHeadersUnaltered() {
 	this.Assert().Empty(resp.Header)
 }
 
+func (this *SignerSuite) explain(urlSets []util.URLSet, target string, requestHeader http.Header) *Explanation {
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", requestHeader).Do()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/json", resp.Header.Get("Content-Type"))
+	var explanation Explanation
+	this.Require().NoError(json.NewDecoder(resp.Body).Decode(&explanation))
+	return &explanation
+}
+
+func (this *SignerSuite) TestExplainSigned() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000,
+			MaxLifetime: 96 * time.Hour}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Content-Security-Policy", "font-src https://fonts.example; frame-src 'none'")
+		resp.Write([]byte(`<html amp><head><script src=bar></script>`))
+	}
+	before := promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("signed", ""))
+	target := "/priv/explain?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	requestHeader := http.Header{"If-None-Match": {`"abc"`}}
+	for name, values := range header {
+		requestHeader[name] = values
+	}
+	explanation := this.explain(urlSets, target, requestHeader)
+
+	this.Assert().Equal(decisionSigned, explanation.Decision)
+	this.Assert().Empty(explanation.Error)
+	this.Assert().Equal(this.httpsURL()+fakePath, explanation.SignURL)
+	this.Assert().Equal(this.httpsURL()+fakePath, explanation.FetchURL)
+	this.Assert().Equal([]URLSetMatch{{SignDomain: this.httpsHost(), Matched: true}}, explanation.URLSets)
+	this.Assert().Equal(transformer.SupportedVersions[0].Max, explanation.TransformVersion)
+	this.Assert().Equal(string(accept.SxgVersion), explanation.SXGVersion)
+	this.Assert().Equal(http.StatusOK, explanation.StatusCode)
+	this.Assert().Equal("text/html; charset=utf-8", explanation.ResponseHeaders.Get("Content-Type"))
+	this.Require().Len(explanation.Preloads, 1)
+	this.Assert().Equal("bar", explanation.Preloads[0].Url)
+	this.Assert().Equal("<bar>;rel=preload;as=script", explanation.LinkHeader)
+	this.Assert().Equal(explanation.LinkHeader, explanation.SignedHeaders.Get("Link"))
+	this.Assert().True(strings.HasPrefix(explanation.ContentSecurityPolicy, "font-src https://fonts.example;default-src"))
+	this.Assert().Equal(explanation.ContentSecurityPolicy, explanation.SignedHeaders.Get("Content-Security-Policy"))
+	this.Require().NotNil(explanation.Date)
+	this.Require().NotNil(explanation.Expires)
+	this.Assert().Equal(96*time.Hour, explanation.Expires.Sub(*explanation.Date))
+
+	// The fetch is unconditional, and nothing is counted as signed.
+	this.Assert().Empty(this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().Equal(before, promtest.ToFloat64(promDocumentsSignedVsUnsigned.WithLabelValues("signed", "")))
+}
+
+func (this *SignerSuite) TestExplainProxiedUnsigned() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), ErrorOnStatefulHeaders: true, MaxLength: 2000}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Set-Cookie", "chocolate chip")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/explain/" + this.httpsURL() + fakePath
+	explanation := this.explain(urlSets, target, header)
+
+	this.Assert().Equal(decisionProxiedUnsigned, explanation.Decision)
+	this.Assert().Equal(string(reasonStatefulHeader), explanation.Reason)
+	this.Assert().Contains(explanation.Error, "Set-Cookie")
+	this.Assert().Equal("chocolate chip", explanation.ResponseHeaders.Get("Set-Cookie"))
+	this.Assert().Empty(explanation.Preloads)
+	this.Assert().Nil(explanation.Expires)
+}
+
+func (this *SignerSuite) TestExplainOptimizedUnsigned() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/explain?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	explanation := this.explain(this.optimizeURLSets(), target, http.Header{"Accept": {"text/html"}})
+	this.Assert().Equal(decisionOptimizedUnsigned, explanation.Decision)
+	this.Assert().Equal(string(reasonAMPCacheTransform), explanation.Reason)
+
+	// Non-AMP documents are proxied as is.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte("<html><body>Not AMP."))
+	}
+	explanation = this.explain(this.optimizeURLSets(), target, http.Header{"Accept": {"text/html"}})
+	this.Assert().Equal(decisionProxiedUnsigned, explanation.Decision)
+	this.Assert().Equal(string(reasonAMPCacheTransform), explanation.Reason)
+}
+
+func (this *SignerSuite) TestExplainURLSetMatches() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: "other.example", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}, {
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	target := "/priv/explain?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	explanation := this.explain(urlSets, target, header)
+	this.Assert().Equal(decisionSigned, explanation.Decision)
+	this.Require().Len(explanation.URLSets, 2)
+	this.Assert().False(explanation.URLSets[0].Matched)
+	this.Assert().Equal("sign URL: Domain doesn't match", explanation.URLSets[0].Error)
+	this.Assert().True(explanation.URLSets[1].Matched)
+
+	explanation = this.explain(urlSets[:1], target, header)
+	this.Assert().Equal(decisionError, explanation.Decision)
+	this.Assert().Equal("fetch/sign URLs do not match config", explanation.Error)
+	this.Assert().Empty(explanation.FetchURL)
+	this.Assert().Zero(explanation.StatusCode)
+}
+
 func TestSignerSuite(t *testing.T) {
 	suite.Run(t, new(SignerSuite))
 }
@@ -899,13 +2163,13 @@ func (this *SignerSuite) minimalisticRequestWithFakeGatewayRequest(handler http.
 }
 
 const promExpectedHeaderGatewayRequestsLatency = `
-	# HELP amppackager_signer_gateway_duration_seconds Latencies (in seconds) of gateway requests to AMP document server - by HTTP response status code.
+	# HELP amppackager_signer_gateway_duration_seconds Latencies (in seconds) of gateway requests to AMP document server, including any retries - by HTTP response status code and number of retries.
 	# TYPE amppackager_signer_gateway_duration_seconds histogram
 	`
 
 func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	suffix := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 	handler := this.new(urlSets)
@@ -923,20 +2187,20 @@ func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 				pkgt.NewRequest(this.T(), handler, suffix).Do()
 			},
 			expectation: `
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="1"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="2.5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="10"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="+Inf"} 2
-				amppackager_signer_gateway_duration_seconds_sum{code="200"} 2
-				amppackager_signer_gateway_duration_seconds_count{code="200"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="1"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="2.5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="10"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="+Inf"} 2
+				amppackager_signer_gateway_duration_seconds_sum{code="200",retries="0"} 2
+				amppackager_signer_gateway_duration_seconds_count{code="200",retries="0"} 2
 				`,
 		},
 		{
@@ -946,34 +2210,34 @@ func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 				this.minimalisticRequestWithFakeGatewayRequest(handler, suffix, 502)
 			},
 			expectation: `
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="1"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="2.5"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="5"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="10"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="+Inf"} 1
-				amppackager_signer_gateway_duration_seconds_sum{code="304"} 1
-				amppackager_signer_gateway_duration_seconds_count{code="304"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="1"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="2.5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="10"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="+Inf"} 2
-				amppackager_signer_gateway_duration_seconds_sum{code="502"} 2
-				amppackager_signer_gateway_duration_seconds_count{code="502"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="1"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="2.5"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="5"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="10"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="+Inf"} 1
+				amppackager_signer_gateway_duration_seconds_sum{code="304",retries="0"} 1
+				amppackager_signer_gateway_duration_seconds_count{code="304",retries="0"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="1"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="2.5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="10"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="+Inf"} 2
+				amppackager_signer_gateway_duration_seconds_sum{code="502",retries="0"} 2
+				amppackager_signer_gateway_duration_seconds_count{code="502",retries="0"} 2
 				`,
 		},
 		{
@@ -986,48 +2250,48 @@ func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 				this.minimalisticRequestWithFakeGatewayRequest(handler, suffix, 502)
 			},
 			expectation: `
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="1"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="2.5"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="5"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="10"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="+Inf"} 3
-				amppackager_signer_gateway_duration_seconds_sum{code="200"} 3
-				amppackager_signer_gateway_duration_seconds_count{code="200"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="1"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="2.5"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="5"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="10"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="304",le="+Inf"} 1
-				amppackager_signer_gateway_duration_seconds_sum{code="304"} 1
-				amppackager_signer_gateway_duration_seconds_count{code="304"} 1
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="1"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="2.5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="10"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="502",le="+Inf"} 2
-				amppackager_signer_gateway_duration_seconds_sum{code="502"} 2
-				amppackager_signer_gateway_duration_seconds_count{code="502"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="1"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="2.5"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="5"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="10"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="+Inf"} 3
+				amppackager_signer_gateway_duration_seconds_sum{code="200",retries="0"} 3
+				amppackager_signer_gateway_duration_seconds_count{code="200",retries="0"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="1"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="2.5"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="5"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="10"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="304",retries="0",le="+Inf"} 1
+				amppackager_signer_gateway_duration_seconds_sum{code="304",retries="0"} 1
+				amppackager_signer_gateway_duration_seconds_count{code="304",retries="0"} 1
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="1"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="2.5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="10"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="502",retries="0",le="+Inf"} 2
+				amppackager_signer_gateway_duration_seconds_sum{code="502",retries="0"} 2
+				amppackager_signer_gateway_duration_seconds_count{code="502",retries="0"} 2
 				`,
 		},
 		{
@@ -1039,20 +2303,20 @@ func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 				this.minimalisticRequestWithFakeGatewayRequest(handler, suffix, 200)
 			},
 			expectation: `
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.005"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.01"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.025"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.05"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.1"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.25"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="0.5"} 0
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="1"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="2.5"} 2
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="5"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="10"} 3
-				amppackager_signer_gateway_duration_seconds_bucket{code="200",le="+Inf"} 3
-				amppackager_signer_gateway_duration_seconds_sum{code="200"} 7
-				amppackager_signer_gateway_duration_seconds_count{code="200"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.005"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.01"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.025"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.05"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.1"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.25"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="0.5"} 0
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="1"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="2.5"} 2
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="5"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="10"} 3
+				amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="0",le="+Inf"} 3
+				amppackager_signer_gateway_duration_seconds_sum{code="200",retries="0"} 7
+				amppackager_signer_gateway_duration_seconds_count{code="200",retries="0"} 3
 				`,
 		},
 	}
@@ -1067,9 +2331,173 @@ func (this *SignerSuite) TestPrometheusMetricGatewayRequestsLatency() {
 
 }
 
+func (this *SignerSuite) upstreamURLSets(retries int) []util.URLSet {
+	return []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+		Upstream: &util.UpstreamConfig{ConnectTimeout: time.Second, Timeout: 10 * time.Second, MaxIdleConnsPerHost: 2,
+			Retries: retries, RetryBackoff: time.Millisecond},
+	}}
+}
+
+func (this *SignerSuite) TestRetriesUpstreamErrors() {
+	attempts := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			// Reset the connection.
+			conn, _, err := resp.(http.Hijacker).Hijack()
+			this.Require().NoError(err)
+			this.Require().NoError(conn.(*net.TCPConn).SetLinger(0))
+			conn.Close()
+		case 2:
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write(fakeBody)
+		}
+	}
+	promGatewayRequestsLatency.Reset()
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.upstreamURLSets(2)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+	this.Assert().Equal(3, attempts)
+
+	expectation := strings.NewReader(promExpectedHeaderGatewayRequestsLatency + `
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.005"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.01"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.025"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.05"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.1"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.25"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="0.5"} 0
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="1"} 1
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="2.5"} 1
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="5"} 1
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="10"} 1
+		amppackager_signer_gateway_duration_seconds_bucket{code="200",retries="2",le="+Inf"} 1
+		amppackager_signer_gateway_duration_seconds_sum{code="200",retries="2"} 1
+		amppackager_signer_gateway_duration_seconds_count{code="200",retries="2"} 1
+		`)
+	this.Require().NoError(promtest.CollectAndCompare(promGatewayRequestsLatency, expectation, "amppackager_signer_gateway_duration_seconds"))
+}
+
+func (this *SignerSuite) TestProxiesLastResponseIfRetriesExhausted() {
+	attempts := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte("try again later"))
+	}
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.upstreamURLSets(1)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("try again later", string(body))
+	this.Assert().Equal(2, attempts)
+
+	// Without Retries, the fetch is attempted once.
+	attempts = 0
+	resp = pkgt.NewRequest(this.T(), this.new(this.upstreamURLSets(0)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode)
+	this.Assert().Equal(1, attempts)
+}
+
+func (this *SignerSuite) TestDoesNotRetryNonRetryableStatus() {
+	attempts := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		resp.WriteHeader(http.StatusInternalServerError)
+	}
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(this.upstreamURLSets(2)), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusInternalServerError, resp.StatusCode)
+	this.Assert().Equal(1, attempts)
+}
+
+func (this *SignerSuite) TestStopsRetryingAtTotalTimeout() {
+	var attempts int32
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(30 * time.Millisecond)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	urlSets := this.upstreamURLSets(5)
+	urlSets[0].Upstream.TotalTimeout = 50 * time.Millisecond
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode)
+	this.Assert().Equal(int32(2), atomic.LoadInt32(&attempts))
+}
+
+func (this *SignerSuite) TestFetchesViaTransport() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}, {
+		Sign:     &util.URLPattern{Scheme: []string{"https"}, Domain: "example.org", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Upstream: &util.UpstreamConfig{Timeout: time.Second, Retries: 1, RetryBackoff: time.Millisecond},
+	}}
+	attempts := 0
+	this.fetchTransport = HandlerTransport(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		attempts++
+		this.Assert().Equal(fakePath, req.URL.Path)
+		if req.URL.Host == "example.org" && attempts == 1 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}))
+	handler := this.new(urlSets)
+
+	for _, host := range []string{"example.com", "example.org"} {
+		attempts = 0
+		target := "/priv/doc?sign=" + url.QueryEscape("https://"+host+fakePath)
+		resp := pkgt.NewRequest(this.T(), handler, target).SetHeaders("", header).Do()
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal("https://"+host+fakePath, exchange.RequestURI)
+	}
+	// The Upstream config's retries still apply.
+	this.Assert().Equal(2, attempts)
+}
+
+func (this *SignerSuite) TestFetchesOverUnixSocket() {
+	dir, err := ioutil.TempDir("", "amppkg-socket")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "origin.sock")
+	listener, err := net.Listen("unix", socket)
+	this.Require().NoError(err)
+	server := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: "origin.invalid", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true), UnixSocket: socket},
+	}}
+	target := "/priv/doc?fetch=" + url.QueryEscape("http://origin.invalid"+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+	resp := pkgt.NewRequest(this.T(), this.new(urlSets), target).SetHeaders("", header).Do()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.Path)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.httpSignURL()+fakePath, exchange.RequestURI)
+}
+
 func (this *SignerSuite) TestIfCappedDontSignAndProxyFullDocument() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 
 	const uncappedTailLength = 100
 	veryLongString := strings.Repeat("a", maxSignableBodyLength+uncappedTailLength)
@@ -1092,7 +2520,7 @@ func (this *SignerSuite) TestWrongContentLength() {
 	wrongLength := "4"
 
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/html")
 		resp.Header().Set("Content-Length", wrongLength)
@@ -1105,7 +2533,7 @@ func (this *SignerSuite) TestWrongContentLength() {
 
 func (this *SignerSuite) TestPrometheusMetricSignedAmpDocumentsSize() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 
@@ -1194,7 +2622,7 @@ func (this *SignerSuite) TestPrometheusMetricSignedAmpDocumentsSize() {
 
 func (this *SignerSuite) TestPrometheusMetricDocumentsSignedVsUnsigned() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Sign: &util.URLPattern{Scheme: []string{"https"}, Domain: this.httpsHost(), PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
 	}}
 	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 
@@ -1206,17 +2634,17 @@ func (this *SignerSuite) TestPrometheusMetricDocumentsSignedVsUnsigned() {
 		{
 			name:           "Scenario DocumentSigned",
 			customFakeBody: fakeBody,
-			expectation:    `amppackager_signer_documents_total{status="signed"} 1`,
+			expectation:    `amppackager_signer_documents_total{reason="",status="signed"} 1`,
 		},
 		{
 			name:           "Scenario DocumentUnsigned",
 			customFakeBody: []byte("Not an amp document, won't sign."),
-			expectation:    `amppackager_signer_documents_total{status="proxied unsigned"} 1`,
+			expectation:    `amppackager_signer_documents_total{reason="content_type",status="proxied unsigned"} 1`,
 		},
 	}
 
 	const expectedHeader = `
-		# HELP amppackager_signer_documents_total Total number of successful underlying requests to AMP document server, broken down by status based on the action signer has taken: sign or proxy unsigned.
+		# HELP amppackager_signer_documents_total Total number of successful underlying requests to AMP document server, broken down by status based on the action signer has taken: sign or proxy unsigned, and for the latter, the reason.
 		# TYPE amppackager_signer_documents_total counter
 		`
 
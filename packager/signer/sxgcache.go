@@ -0,0 +1,383 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Returns the time until which an SXG signed at the given time, and whose
+// signature expires at the given time, may be reused: from the SXG cache, or
+// via its outer ETag. AMP caches require util.MinSxgEffectiveLifetime to remain
+// (see docs/cache_requirements.md), and a third of the lifetime beyond that is
+// kept in reserve, to allow for client clock skew and for the time it takes
+// the SXG to propagate through the cache. With the default signature lifetime,
+// of which 6 days remain at signing, that's 4 days before it expires. SXGs
+// signed with no more than the minimum remaining aren't reused at all.
+func sxgFreshUntil(signed time.Time, expires time.Time) time.Time {
+	spare := expires.Sub(signed) - util.MinSxgEffectiveLifetime
+	if spare <= 0 {
+		return signed
+	}
+	return signed.Add(spare - spare/3)
+}
+
+// How often to remove expired entries from the disk tier.
+const sxgCacheSweepInterval = time.Hour
+
+// The disk tier is also swept whenever this fraction of its maximum size has
+// been written since the last sweep, so that it exceeds the maximum by no more
+// than that per replica.
+const sxgCacheSweepDivisor = 10
+
+// The approximate per-entry memory overhead, beyond the SXG itself.
+const sxgCacheEntryOverhead = 512
+
+var promSXGCacheRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: promSubsystem,
+		Name:      "sxg_cache_requests_total",
+		Help:      "Total number of lookups in the packaged SXG cache, by result: hit (served from memory or disk after revalidation against the origin) or miss.",
+	},
+	[]string{"result"},
+)
+
+// A packaged SXG, along with the validators of the upstream response it was
+// generated from. Fields are exported for JSON serialization to the disk tier.
+type sxgCacheEntry struct {
+	ETag         string
+	LastModified string
+	// The time after which the entry must no longer be served.
+	FreshUntil time.Time
+	SXG        []byte
+	// The ETag of the outer response; see outerETag.
+	OuterETag string
+}
+
+// Returns an entry for the given SXG, which may be served until freshUntil, per
+// sxgFreshUntil.
+func newSXGCacheEntry(upstreamHeader http.Header, sxg []byte, freshUntil time.Time) *sxgCacheEntry {
+	return &sxgCacheEntry{
+		ETag:         upstreamHeader.Get("ETag"),
+		LastModified: upstreamHeader.Get("Last-Modified"),
+		FreshUntil:   freshUntil,
+		SXG:          sxg,
+	}
+}
+
+func (this *sxgCacheEntry) size() int64 {
+	return int64(len(this.SXG) + len(this.ETag) + len(this.LastModified) + len(this.OuterETag) + sxgCacheEntryOverhead)
+}
+
+// Sets conditional headers on the given upstream request, so that the origin
+// responds with a 304 if the entry is still valid.
+func (this *sxgCacheEntry) setConditionalHeaders(h http.Header) {
+	if this.ETag != "" {
+		h.Set("If-None-Match", this.ETag)
+	}
+	if this.LastModified != "" {
+		h.Set("If-Modified-Since", this.LastModified)
+	}
+}
+
+// Returns true if the given 200 response from the origin is the same
+// representation as the one the entry was generated from. Only strong ETags
+// are considered, as neither weak ETags nor Last-Modified guarantee the body
+// is byte-for-byte identical.
+func (this *sxgCacheEntry) matches(upstreamHeader http.Header) bool {
+	return this.ETag != "" && !strings.HasPrefix(this.ETag, "W/") &&
+		upstreamHeader.Get("ETag") == this.ETag
+}
+
+// SXGCache is a cache of packaged SXGs, so that unchanged documents needn't be
+// re-transformed and re-signed on every request. Entries are kept in a
+// size-bounded LRU in memory, and optionally also in a size-bounded directory
+// on disk, which allows them to survive restarts and be shared between
+// replicas.
+//
+// Entries are revalidated against the origin on every use, via conditional
+// requests; see Signer.ServeHTTP.
+type SXGCache struct {
+	maxBytes     int64
+	dir          string
+	maxDiskBytes int64
+	// Overrideable for testing. This is compared against signature expiry
+	// times, so it must be the real time.
+	now func() time.Time
+
+	mu        sync.Mutex
+	bytes     int64
+	lru       *list.List // Of *sxgCacheItem, most recently used first.
+	items     map[string]*list.Element
+	lastSweep time.Time
+	// The number of bytes written to the disk tier since lastSweep.
+	diskBytesWritten int64
+}
+
+type sxgCacheItem struct {
+	key   string
+	entry *sxgCacheEntry
+}
+
+// NewSXGCache returns an SXGCache that stores up to maxBytes in memory. If dir
+// is non-empty, entries are also stored as files in that directory, which must
+// exist, up to about maxDiskBytes.
+func NewSXGCache(maxBytes int64, dir string, maxDiskBytes int64) (*SXGCache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("SXG cache size must be positive")
+	}
+	if dir != "" {
+		if maxDiskBytes <= 0 {
+			return nil, errors.New("SXG cache disk size must be positive")
+		}
+		if info, err := os.Stat(dir); err != nil {
+			return nil, errors.Wrapf(err, "checking SXG cache dir %s", dir)
+		} else if !info.IsDir() {
+			return nil, errors.Errorf("SXG cache dir %s is not a directory", dir)
+		}
+	}
+	return &SXGCache{
+		maxBytes:     maxBytes,
+		dir:          dir,
+		maxDiskBytes: maxDiskBytes,
+		now:          time.Now,
+		lru:          list.New(),
+		items:        map[string]*list.Element{},
+	}, nil
+}
+
+// Returns the cache key for the given sign URL, along with everything else
+// that affects the generated SXG other than the upstream response itself.
+func sxgCacheKey(signURL string, fetchURL string, forwardedHeaders []string, transformVersion int64, sxgVersion version.Version, rtv string, certNames []string) string {
+	parts := []string{signURL, fetchURL, strconv.FormatInt(transformVersion, 10), string(sxgVersion), rtv}
+	parts = append(parts, certNames...)
+	parts = append(parts, forwardedHeaders...)
+	hash := sha256.Sum256([]byte(lengthPrefixedJoin(parts)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Joins the given strings such that the result is unambiguous, e.g.
+// ["ab", "c"] and ["a", "bc"] result in different strings.
+func lengthPrefixedJoin(parts []string) string {
+	var ret strings.Builder
+	for _, part := range parts {
+		ret.WriteString(strconv.Itoa(len(part)))
+		ret.WriteByte(':')
+		ret.WriteString(part)
+	}
+	return ret.String()
+}
+
+// Get returns the entry for the given key, or nil if there is none that is
+// still fresh.
+func (this *SXGCache) Get(key string) *sxgCacheEntry {
+	now := this.now()
+	this.mu.Lock()
+	if elem, ok := this.items[key]; ok {
+		entry := elem.Value.(*sxgCacheItem).entry
+		if now.Before(entry.FreshUntil) {
+			this.lru.MoveToFront(elem)
+			this.mu.Unlock()
+			return entry
+		}
+		this.removeElement(elem)
+	}
+	this.mu.Unlock()
+
+	if this.dir == "" {
+		return nil
+	}
+	entry, err := this.readFile(key)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			log.Println("Error reading SXG cache file:", err)
+			this.removeFile(key)
+		}
+		return nil
+	}
+	if !now.Before(entry.FreshUntil) {
+		this.removeFile(key)
+		return nil
+	}
+	this.putInMemory(key, entry)
+	return entry
+}
+
+// Put stores the entry under the given key. Entries that can't be revalidated
+// (because the upstream response had no validators) or that are already too
+// close to expiry aren't stored.
+func (this *SXGCache) Put(key string, entry *sxgCacheEntry) {
+	if entry.ETag == "" && entry.LastModified == "" {
+		return
+	}
+	if !this.now().Before(entry.FreshUntil) {
+		return
+	}
+	this.putInMemory(key, entry)
+	if this.dir != "" {
+		written, err := this.writeFile(key, entry)
+		if err != nil {
+			log.Println("Error writing SXG cache file:", err)
+		}
+		this.maybeSweep(written)
+	}
+}
+
+func (this *SXGCache) putInMemory(key string, entry *sxgCacheEntry) {
+	size := entry.size()
+	if size > this.maxBytes {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, ok := this.items[key]; ok {
+		this.removeElement(elem)
+	}
+	this.items[key] = this.lru.PushFront(&sxgCacheItem{key, entry})
+	this.bytes += size
+	for this.bytes > this.maxBytes {
+		this.removeElement(this.lru.Back())
+	}
+}
+
+// Must be called with mu held.
+func (this *SXGCache) removeElement(elem *list.Element) {
+	item := this.lru.Remove(elem).(*sxgCacheItem)
+	delete(this.items, item.key)
+	this.bytes -= item.entry.size()
+}
+
+func (this *SXGCache) filename(key string) string {
+	return filepath.Join(this.dir, key+".sxg")
+}
+
+func (this *SXGCache) readFile(key string) (*sxgCacheEntry, error) {
+	contents, err := ioutil.ReadFile(this.filename(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", this.filename(key))
+	}
+	var entry sxgCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", this.filename(key))
+	}
+	return &entry, nil
+}
+
+// Writes to a temp file and renames it into place, so that concurrent readers
+// (including other replicas sharing the directory) never see a partial entry.
+// Returns the number of bytes written.
+func (this *SXGCache) writeFile(key string, entry *sxgCacheEntry) (int64, error) {
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return 0, errors.Wrap(err, "serializing entry")
+	}
+	tmp, err := ioutil.TempFile(this.dir, ".tmp-")
+	if err != nil {
+		return 0, errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return 0, errors.Wrapf(err, "writing %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, errors.Wrapf(err, "closing %s", tmp.Name())
+	}
+	// Record the expiry in the mtime, so that sweep needn't read each file.
+	if err := os.Chtimes(tmp.Name(), entry.FreshUntil, entry.FreshUntil); err != nil {
+		return 0, errors.Wrapf(err, "setting mtime of %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), this.filename(key)); err != nil {
+		return 0, errors.Wrapf(err, "renaming to %s", this.filename(key))
+	}
+	return int64(len(contents)), nil
+}
+
+func (this *SXGCache) removeFile(key string) {
+	if err := os.Remove(this.filename(key)); err != nil && !os.IsNotExist(err) {
+		log.Println("Error removing SXG cache file:", err)
+	}
+}
+
+// Removes expired entries from the disk tier, and then those closest to expiry
+// until it's within maxDiskBytes, if that hasn't been done recently: within
+// sxgCacheSweepInterval, or since a tenth of maxDiskBytes was written.
+func (this *SXGCache) maybeSweep(written int64) {
+	now := this.now()
+	this.mu.Lock()
+	this.diskBytesWritten += written
+	if now.Sub(this.lastSweep) < sxgCacheSweepInterval && this.diskBytesWritten < this.maxDiskBytes/sxgCacheSweepDivisor {
+		this.mu.Unlock()
+		return
+	}
+	this.lastSweep = now
+	this.diskBytesWritten = 0
+	this.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		log.Println("Error sweeping SXG cache dir:", err)
+		return
+	}
+	var live []os.FileInfo
+	var liveBytes int64
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".sxg") {
+			if !now.Before(info.ModTime()) {
+				this.removeFile(strings.TrimSuffix(info.Name(), ".sxg"))
+			} else {
+				live = append(live, info)
+				liveBytes += info.Size()
+			}
+		} else if strings.HasPrefix(info.Name(), ".tmp-") && now.Sub(info.ModTime()) > sxgCacheSweepInterval {
+			// Left behind by a crash during writeFile.
+			if err := os.Remove(filepath.Join(this.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+				log.Println("Error removing SXG cache temp file:", err)
+			}
+		}
+	}
+	if liveBytes <= this.maxDiskBytes {
+		return
+	}
+	// The mtime is the expiry; see writeFile.
+	sort.Slice(live, func(i, j int) bool { return live[i].ModTime().Before(live[j].ModTime()) })
+	for _, info := range live {
+		if liveBytes <= this.maxDiskBytes {
+			break
+		}
+		this.removeFile(strings.TrimSuffix(info.Name(), ".sxg"))
+		liveBytes -= info.Size()
+	}
+}
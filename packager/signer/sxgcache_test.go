@@ -0,0 +1,225 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sxgCacheNow = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestSXGCache(t *testing.T, maxBytes int64, dir string) *SXGCache {
+	cache, err := NewSXGCache(maxBytes, dir, 1<<30)
+	require.NoError(t, err)
+	cache.now = func() time.Time { return sxgCacheNow }
+	return cache
+}
+
+// Returns an entry whose signature expires in 6 days, per the default signing
+// duration.
+func newTestSXGCacheEntry(etag string, sxg string) *sxgCacheEntry {
+	return newSXGCacheEntry(http.Header{"Etag": {etag}}, []byte(sxg), sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(6*24*time.Hour)))
+}
+
+func TestSXGCacheKey(t *testing.T) {
+	key := sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv", []string{"cert"})
+	assert.Equal(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv", []string{"cert"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 2, version.Version1b3, "rtv", []string{"cert"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv2", []string{"cert"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv", []string{"cert2"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv", []string{"cert", "cert2"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/", "http://origin/", []string{"host"}, 1, version.Version1b2, "rtv", []string{"cert"}))
+	assert.NotEqual(t, key, sxgCacheKey("https://example.com/a", "http://origin/", []string{"host"}, 1, version.Version1b3, "rtv", []string{"cert"}))
+	// Concatenation is unambiguous.
+	assert.NotEqual(t,
+		sxgCacheKey("https://example.com/", "http://origin/", []string{"ab", "c"}, 1, version.Version1b3, "rtv", nil),
+		sxgCacheKey("https://example.com/", "http://origin/", []string{"a", "bc"}, 1, version.Version1b3, "rtv", nil))
+}
+
+func TestSXGCacheEntryMatches(t *testing.T) {
+	assert.True(t, newTestSXGCacheEntry(`"v1"`, "").matches(http.Header{"Etag": {`"v1"`}}))
+	assert.False(t, newTestSXGCacheEntry(`"v1"`, "").matches(http.Header{"Etag": {`"v2"`}}))
+	assert.False(t, newTestSXGCacheEntry(`W/"v1"`, "").matches(http.Header{"Etag": {`W/"v1"`}}))
+	assert.False(t, newTestSXGCacheEntry("", "").matches(http.Header{}))
+}
+
+func TestSXGCacheGetPut(t *testing.T) {
+	cache := newTestSXGCache(t, 1<<20, "")
+	assert.Nil(t, cache.Get("a"))
+
+	cache.Put("a", newTestSXGCacheEntry(`"v1"`, "sxg"))
+	entry := cache.Get("a")
+	require.NotNil(t, entry)
+	assert.Equal(t, `"v1"`, entry.ETag)
+	assert.Equal(t, []byte("sxg"), entry.SXG)
+}
+
+func TestSXGCacheRequiresValidator(t *testing.T) {
+	cache := newTestSXGCache(t, 1<<20, "")
+	cache.Put("a", newTestSXGCacheEntry("", "sxg"))
+	assert.Nil(t, cache.Get("a"))
+
+	entry := newSXGCacheEntry(http.Header{"Last-Modified": {"Tue, 01 Jun 2021 00:00:00 GMT"}}, []byte("sxg"), sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(6*24*time.Hour)))
+	cache.Put("a", entry)
+	assert.NotNil(t, cache.Get("a"))
+}
+
+func TestSXGCacheExpiry(t *testing.T) {
+	cache := newTestSXGCache(t, 1<<20, "")
+
+	// Signatures with only the minimum lifetime remaining aren't stored at
+	// all.
+	entry := newSXGCacheEntry(http.Header{"Etag": {`"v1"`}}, []byte("sxg"), sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(util.MinSxgEffectiveLifetime)))
+	cache.Put("a", entry)
+	assert.Nil(t, cache.Get("a"))
+
+	cache.Put("b", newTestSXGCacheEntry(`"v1"`, "sxg"))
+	assert.NotNil(t, cache.Get("b"))
+	cache.now = func() time.Time { return sxgCacheNow.Add(2*24*time.Hour - time.Second) }
+	assert.NotNil(t, cache.Get("b"))
+	cache.now = func() time.Time { return sxgCacheNow.Add(2 * 24 * time.Hour) }
+	assert.Nil(t, cache.Get("b"))
+	assert.Zero(t, cache.bytes)
+}
+
+func TestSXGCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	entrySize := newTestSXGCacheEntry(`"v1"`, "sxg").size()
+	cache := newTestSXGCache(t, 2*entrySize, "")
+
+	cache.Put("a", newTestSXGCacheEntry(`"v1"`, "sxg"))
+	cache.Put("b", newTestSXGCacheEntry(`"v1"`, "sxg"))
+	assert.NotNil(t, cache.Get("a"))
+	cache.Put("c", newTestSXGCacheEntry(`"v1"`, "sxg"))
+
+	assert.NotNil(t, cache.Get("a"))
+	assert.Nil(t, cache.Get("b"))
+	assert.NotNil(t, cache.Get("c"))
+	assert.Equal(t, 2*entrySize, cache.bytes)
+
+	// Entries bigger than the whole cache aren't stored.
+	cache.Put("d", newTestSXGCacheEntry(`"v1"`, string(make([]byte, 2*entrySize))))
+	assert.Nil(t, cache.Get("d"))
+	assert.NotNil(t, cache.Get("a"))
+}
+
+func TestSXGCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sxgcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := newTestSXGCache(t, 1<<20, dir)
+	cache.Put("a", newTestSXGCacheEntry(`"v1"`, "sxg"))
+
+	// A fresh cache (e.g. after restart, or on another replica) reads it
+	// from disk.
+	cache = newTestSXGCache(t, 1<<20, dir)
+	entry := cache.Get("a")
+	require.NotNil(t, entry)
+	assert.Equal(t, `"v1"`, entry.ETag)
+	assert.Equal(t, []byte("sxg"), entry.SXG)
+	// And promotes it to memory.
+	assert.Contains(t, cache.items, "a")
+
+	// Expired files are removed on read.
+	cache = newTestSXGCache(t, 1<<20, dir)
+	cache.now = func() time.Time { return sxgCacheNow.Add(2 * 24 * time.Hour) }
+	assert.Nil(t, cache.Get("a"))
+	_, err = os.Stat(filepath.Join(dir, "a.sxg"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSXGCacheDiskCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sxgcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.sxg"), []byte("not json"), 0644))
+	cache := newTestSXGCache(t, 1<<20, dir)
+	assert.Nil(t, cache.Get("a"))
+	_, err = os.Stat(filepath.Join(dir, "a.sxg"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSXGCacheDiskSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sxgcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := newTestSXGCache(t, 1<<20, dir)
+	cache.Put("a", newTestSXGCacheEntry(`"v1"`, "sxg"))
+	cache.now = func() time.Time { return sxgCacheNow.Add(2 * 24 * time.Hour) }
+	cache.Put("b", newSXGCacheEntry(http.Header{"Etag": {`"v1"`}}, []byte("sxg"), sxgFreshUntil(sxgCacheNow.Add(2*24*time.Hour), sxgCacheNow.Add(8*24*time.Hour))))
+
+	_, err = os.Stat(filepath.Join(dir, "a.sxg"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "b.sxg"))
+	assert.NoError(t, err)
+}
+
+func TestSXGCacheDiskLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sxgcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Entries expiring an hour apart, in the opposite order to their keys.
+	put := func(cache *SXGCache, key string, hoursLeft int) {
+		freshUntil := sxgCacheNow.Add(time.Duration(hoursLeft) * time.Hour)
+		cache.Put(key, newSXGCacheEntry(http.Header{"Etag": {`"v1"`}}, []byte("sxg"), freshUntil))
+	}
+	cache := newTestSXGCache(t, 1<<20, dir)
+	put(cache, "a", 3)
+	info, err := os.Stat(filepath.Join(dir, "a.sxg"))
+	require.NoError(t, err)
+	// Room for two and a half files.
+	cache.maxDiskBytes = 5 * info.Size() / 2
+
+	put(cache, "b", 2)
+	put(cache, "c", 1)
+	put(cache, "d", 4)
+
+	// Those closest to expiry were removed.
+	names, err := filepath.Glob(filepath.Join(dir, "*.sxg"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{filepath.Join(dir, "a.sxg"), filepath.Join(dir, "d.sxg")}, names)
+}
+
+func TestSXGFreshUntil(t *testing.T) {
+	// The default lifetime, 7 days backdated by 1.
+	assert.Equal(t, sxgCacheNow.Add(2*24*time.Hour), sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(6*24*time.Hour)))
+	// The shortest lifetime that ValidateSignURLPattern allows.
+	assert.Equal(t, sxgCacheNow, sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(util.MinSxgEffectiveLifetime)))
+	assert.Equal(t, sxgCacheNow.Add(8*time.Hour), sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(util.MinSxgEffectiveLifetime+12*time.Hour)))
+	// A lifetime shortened below the minimum by an amp-script max-age.
+	assert.Equal(t, sxgCacheNow, sxgFreshUntil(sxgCacheNow, sxgCacheNow.Add(time.Hour)))
+}
+
+func TestNewSXGCacheErrors(t *testing.T) {
+	_, err := NewSXGCache(0, "", 0)
+	assert.EqualError(t, err, "SXG cache size must be positive")
+	_, err = NewSXGCache(1, "/does/not/exist", 1)
+	assert.Error(t, err)
+	_, err = NewSXGCache(1, os.TempDir(), 0)
+	assert.EqualError(t, err, "SXG cache disk size must be positive")
+}
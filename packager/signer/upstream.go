@@ -0,0 +1,242 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// How much of the body of a response that's about to be retried to read, in
+// order to reuse its connection. Error pages are typically small; any larger
+// and it's cheaper to open a new connection.
+const maxDrainedBodyLength = 4 << 10
+
+// The timeout on fetches from URLSets without an Upstream config.
+const defaultFetchTimeout = 60 * time.Second
+
+// Returns true if fetches from the given URLSet need a dedicated http.Client,
+// rather than the signer's default.
+func needsUpstreamClient(urlSet *util.URLSet) bool {
+	return urlSet.Upstream != nil || (urlSet.Fetch != nil && urlSet.Fetch.UnixSocket != "")
+}
+
+// Returns an http.Client configured per the given URLSet's upstream settings
+// and Fetch.UnixSocket. The Transport settings not covered by these match
+// those of http.DefaultTransport.
+func newUpstreamClient(urlSet *util.URLSet) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	timeout := defaultFetchTimeout
+	if upstream := urlSet.Upstream; upstream != nil {
+		dialer.Timeout = upstream.ConnectTimeout
+		transport.MaxIdleConnsPerHost = upstream.MaxIdleConnsPerHost
+		transport.ResponseHeaderTimeout = upstream.ResponseHeaderTimeout
+		timeout = upstream.Timeout
+	}
+	transport.DialContext = dialer.DialContext
+	if urlSet.Fetch != nil && urlSet.Fetch.UnixSocket != "" {
+		socket := urlSet.Fetch.UnixSocket
+		// Ignore the address, so that fetches can only reach the socket,
+		// whatever the fetch URL's host.
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		CheckRedirect: noRedirects,
+		Transport:     transport,
+		Timeout:       timeout,
+	}
+}
+
+// Returns true if a fetch that resulted in the given response or error should
+// be retried: if the connection was refused or reset, or was reused from an
+// earlier fetch and closed before responding, or if the response has a 502,
+// 503, or 504 status. Other errors, including timeouts, aren't retried, as
+// they're likely due to an overloaded origin, to which retries would only add
+// load. Nothing is retried once ctx is done.
+func shouldRetry(ctx context.Context, resp *http.Response, err error, reused bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+			return true
+		}
+		// A reused connection may have been closed by the origin while
+		// idle.
+		return reused && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF))
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Returns how long to wait before the given retry (0 for the first), with
+// "full jitter" per
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/,
+// so that retries from concurrent requests are spread out.
+func retryBackoff(base time.Duration, retry int) time.Duration {
+	limit := int64(base) << uint(retry)
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(limit))
+}
+
+// A response body that cancels its context once closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *cancelOnClose) Close() error {
+	err := this.ReadCloser.Close()
+	this.cancel()
+	return err
+}
+
+// Sends req via client, retrying per the given upstream settings (if any). It
+// returns the last response or error, along with the number of retries. req
+// must not have a body, so that it can be resent. All attempts, including
+// reading the body of the last, are limited to upstream.TotalTimeout.
+func doWithRetries(client *http.Client, req *http.Request, upstream *util.UpstreamConfig) (*http.Response, int, error) {
+	if upstream == nil {
+		resp, err := client.Do(req)
+		return resp, 0, err
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if upstream.TotalTimeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), upstream.TotalTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	done := func(resp *http.Response, retries int, err error) (*http.Response, int, error) {
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelOnClose{resp.Body, cancel}
+		}
+		return resp, retries, err
+	}
+	retries := 0
+	for {
+		reused := false
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+		if retries >= upstream.Retries || !shouldRetry(ctx, resp, err, reused) {
+			return done(resp, retries, err)
+		}
+		backoff := retryBackoff(upstream.RetryBackoff, retries)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return done(resp, retries, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return done(resp, retries, err)
+		case <-timer.C:
+		}
+		if err != nil {
+			log.Printf("Retrying fetch of %q after error: %s\n", req.URL, err)
+		} else {
+			log.Printf("Retrying fetch of %q after status code %d\n", req.URL, resp.StatusCode)
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainedBodyLength))
+			resp.Body.Close()
+		}
+		retries++
+	}
+}
+
+// Returns true if the given status code is a redirect that the signer may
+// follow, per its URLSet's MaxRedirects.
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Returns the sign URL corresponding to the given redirect target: sign, with
+// the target's path and query.
+func redirectedSignURL(sign *url.URL, target *url.URL) *url.URL {
+	ret := *sign
+	ret.Path = target.Path
+	ret.RawPath = target.RawPath
+	ret.RawQuery = target.RawQuery
+	ret.Fragment = ""
+	return &ret
+}
+
+// Returns the target of the given redirect response to req, if it's allowed to
+// be followed: it must be same-origin, and it and its corresponding sign URL
+// must still match urlSet. If frontEndOrigin is non-nil, req was fetched from
+// it in front-end mode, and redirects to the sign URL's origin are fetched
+// from it too.
+func redirectTarget(req *http.Request, resp *http.Response, sign *url.URL, urlSet *util.URLSet, frontEndOrigin *url.URL) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, errors.New("missing Location header")
+	}
+	target, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Location header")
+	}
+	if frontEndOrigin != nil && target.Scheme == sign.Scheme && target.Host == sign.Host {
+		// The origin knows itself by the sign URL's host.
+		target = frontEndFetchURL(frontEndOrigin, target)
+	}
+	if target.Scheme != req.URL.Scheme || target.Host != req.URL.Host {
+		return nil, errors.Errorf("%q is cross-origin", target)
+	}
+	target.Fragment = ""
+	fetchTarget := target
+	if urlSet.Fetch == nil {
+		// The fetch URL is the sign URL.
+		fetchTarget = nil
+	}
+	if err := urlsMatch(fetchTarget, redirectedSignURL(sign, target), *urlSet); err != nil {
+		return nil, errors.Wrapf(err, "%q doesn't match URLSet", target)
+	}
+	return target, nil
+}
+
+// Returns the URL of the document fetched from final, as the sign URL
+// corresponding to it: sign itself, unless the fetch of fetch was redirected.
+func documentURL(fetch *url.URL, sign *url.URL, final *url.URL) *url.URL {
+	if final.String() == fetch.String() {
+		return sign
+	}
+	return redirectedSignURL(sign, final)
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNetError struct{ timeout bool }
+
+func (this fakeNetError) Error() string   { return "fake" }
+func (this fakeNetError) Timeout() bool   { return this.timeout }
+func (this fakeNetError) Temporary() bool { return false }
+
+func TestShouldRetry(t *testing.T) {
+	ctx := context.Background()
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "/", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", err)}}
+	}
+	assert.True(t, shouldRetry(ctx, nil, wrap(syscall.ECONNRESET), false))
+	assert.True(t, shouldRetry(ctx, nil, wrap(syscall.ECONNREFUSED), false))
+	assert.True(t, shouldRetry(ctx, nil, &url.Error{Op: "Get", URL: "/", Err: io.EOF}, true))
+	assert.False(t, shouldRetry(ctx, nil, &url.Error{Op: "Get", URL: "/", Err: io.EOF}, false))
+	assert.False(t, shouldRetry(ctx, nil, errors.New("connection reset by peer"), true))
+	assert.False(t, shouldRetry(ctx, nil, &url.Error{Op: "Get", URL: "/", Err: fakeNetError{timeout: false}}, true))
+	assert.False(t, shouldRetry(ctx, nil, &url.Error{Op: "Get", URL: "/", Err: fakeNetError{timeout: true}}, true))
+	for status, expected := range map[int]bool{200: false, 304: false, 404: false, 500: false, 502: true, 503: true, 504: true} {
+		assert.Equal(t, expected, shouldRetry(ctx, &http.Response{StatusCode: status}, nil, false), "status %d", status)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, shouldRetry(canceled, nil, wrap(syscall.ECONNRESET), false))
+	assert.False(t, shouldRetry(canceled, &http.Response{StatusCode: 503}, nil, false))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for retry := 0; retry < 4; retry++ {
+		for i := 0; i < 100; i++ {
+			backoff := retryBackoff(100*time.Millisecond, retry)
+			assert.True(t, backoff >= 0 && backoff < (100*time.Millisecond)<<uint(retry), "retry %d: %s", retry, backoff)
+		}
+	}
+	assert.Equal(t, time.Duration(0), retryBackoff(0, 0))
+}
@@ -6,11 +6,14 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/pkg/errors"
 	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
 // Converts an URL string into an URL object with an unambiguous interpretation.
@@ -188,39 +191,71 @@ func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet) error {
 	return nil
 }
 
-// If the given fetch and sign URLs are valid, and match at least one of the
-// urlSets (as specified by the [[URLSet]] blocks in the config file), then
-// this returns the parsed URLs as well as a bool containing the value of
-// ErrorOnStatefulHeaders for the first matching URLSet. Otherwise, returns an
-// error.
-func parseURLs(fetch string, sign string, urlSets []util.URLSet) (*url.URL, *url.URL, bool, *util.HTTPError) {
+// Parses the given fetch and sign URLs. The fetch URL may be empty, in which
+// case the returned fetchURL is nil.
+func parseFetchAndSignURLs(fetch string, sign string) (*url.URL, *url.URL, *util.HTTPError) {
 	var fetchURL *url.URL
 	var err *util.HTTPError
 	if fetch != "" {
 		fetchURL, err = parseURL(fetch, "fetch")
 		if err != nil {
 			// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-			return nil, nil, false, err
+			return nil, nil, err
 		}
 	}
 	signURL, err := parseURL(sign, "sign")
 	if err != nil {
 		// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-		return nil, nil, false, err
+		return nil, nil, err
+	}
+	return fetchURL, signURL, nil
+}
+
+// If the given fetch and sign URLs are valid, and match at least one of the
+// urlSets (as specified by the [[URLSet]] blocks in the config file), then
+// this returns the parsed URLs as well as the first matching URLSet.
+// Otherwise, returns an error.
+func parseURLs(fetch string, sign string, urlSets []util.URLSet) (*url.URL, *url.URL, *util.URLSet, *util.HTTPError) {
+	fetchURL, signURL, err := parseFetchAndSignURLs(fetch, sign)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
 	errs := []string{}
-	for _, set := range urlSets {
-		err := urlsMatch(fetchURL, signURL, set)
+	for i := range urlSets {
+		err := urlsMatch(fetchURL, signURL, urlSets[i])
 		if err == nil {
 			if fetchURL == nil {
 				fetchURL = signURL
 			}
-			return fetchURL, signURL, set.Sign.ErrorOnStatefulHeaders, nil
+			return fetchURL, signURL, &urlSets[i], nil
 		}
 		errs = append(errs, err.Error())
 	}
-	return nil, nil, false, util.NewHTTPError(http.StatusBadRequest, "fetch/sign URLs do not match config; caused by: ", strings.Join(errs, ", "))
+	return nil, nil, nil, util.NewHTTPError(http.StatusBadRequest, "fetch/sign URLs do not match config; caused by: ", strings.Join(errs, ", "))
+}
+
+// Returns the remaining freshness lifetime of the given upstream response, per
+// its Cache-Control and Age headers, and whether it specified one. As the SXG
+// is intended for shared caches, s-maxage takes precedence over max-age.
+func upstreamMaxAge(header http.Header) (time.Duration, bool) {
+	directives, err := cacheobject.ParseResponseCacheControl(GetJoined(header, "Cache-Control"))
+	if err != nil {
+		// validateFetch already rejects unparseable Cache-Control.
+		return 0, false
+	}
+	maxAge := directives.SMaxAge
+	if maxAge == -1 {
+		maxAge = directives.MaxAge
+	}
+	if maxAge == -1 {
+		return 0, false
+	}
+	ret := time.Duration(maxAge) * time.Second
+	if age, err := strconv.ParseUint(header.Get("Age"), 10, 31); err == nil {
+		ret -= time.Duration(age) * time.Second
+	}
+	return ret, true
 }
 
 // Given a request/response pair for the fetch from the packager to the backend
@@ -236,16 +271,22 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	// headers, per https://github.com/WICG/webpackage/pull/339.
 	nonCachableReasons, _, err := cachecontrol.CachableResponse(req, resp, cachecontrol.Options{PrivateCache: false})
 	if err != nil {
-		return errors.Wrap(err, "Parsing cache headers")
+		return newUnsignedError(reasonNonCacheable, errors.Wrap(err, "Parsing cache headers"))
 	}
 	if len(nonCachableReasons) > 0 {
-		return errors.Errorf("Non-cacheable response: %s", nonCachableReasons)
+		return newUnsignedError(reasonNonCacheable, errors.Errorf("Non-cacheable response: %s", nonCachableReasons))
 	}
+	return validateHTML(resp)
+}
 
+// Validates that the given response is UTF-8 HTML that the transformer can
+// parse.
+func validateHTML(resp *http.Response) error {
 	// Validate that no Content-Encoding is specified. Otherwise, it was
-	// encoded as something that http.Client was unable to decode (e.g. br).
+	// encoded as something that decodeResponseBody was unable to decode
+	// (e.g. zstd).
 	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
-		return errors.Errorf("Invalid Content-Encoding: %s", encoding)
+		return newUnsignedError(reasonContentEncoding, errors.Errorf("Invalid Content-Encoding: %s", encoding))
 	}
 
 	// Validate that Content-Type seems right. This doesn't validate its
@@ -254,16 +295,39 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	// later for unambiguous interpretation by the browser.
 	contentType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		return errors.Wrap(err, "Parsing Content-Type")
+		return newUnsignedError(reasonContentType, errors.Wrap(err, "Parsing Content-Type"))
 	}
 	if contentType != "text/html" {
-		return errors.Errorf("Wrong Content-Type: %s", contentType)
+		return newUnsignedError(reasonContentType, errors.Errorf("Wrong Content-Type: %s", contentType))
 	}
 
 	// Don't allow charset other than utf-8, as this overrides <meta charset>.
 	charset := strings.ToLower(params["charset"])
 	if charset != "" && charset != "utf-8" {
-		return errors.Errorf("Wrong charset: %s", charset)
+		return newUnsignedError(reasonContentType, errors.Errorf("Wrong charset: %s", charset))
+	}
+	return nil
+}
+
+// Like validateFetch, but additionally validates that the response is fit for
+// packaging per the given URLSet.
+func validatePackageable(req *http.Request, resp *http.Response, urlSet *util.URLSet) error {
+	if err := validateFetch(req, resp); err != nil {
+		return err
+	}
+	if urlSet.Sign.ErrorOnStatefulHeaders {
+		for header := range statefulResponseHeaders {
+			if GetJoined(resp.Header, header) != "" {
+				return newUnsignedError(reasonStatefulHeader, errors.Errorf("ErrorOnStatefulHeaders = True and fetch response contains stateful header: %s", header))
+			}
+		}
+	}
+	if resp.Header.Get("Variants") != "" || resp.Header.Get("Variant-Key") != "" ||
+		// Include versioned headers per https://github.com/WICG/webpackage/pull/406.
+		resp.Header.Get("Variants-04") != "" || resp.Header.Get("Variant-Key-04") != "" {
+		// Variants headers (https://tools.ietf.org/html/draft-ietf-httpbis-variants-04) are disallowed by AMP Cache.
+		// We could delete the headers, but it's safest to assume they reflect the downstream server's intent.
+		return newUnsignedError(reasonVariants, errors.New("response contains a Variants header"))
 	}
 	return nil
 }
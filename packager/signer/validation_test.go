@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/stretchr/testify/assert"
@@ -130,7 +131,7 @@ func TestParseURLs(t *testing.T) {
 		assert.Contains(t, err.Error(), "sign URL")
 	}
 
-	fetch, sign, errorOnStatefulHeaders, err := parseURLs("", "https://example.com/", []util.URLSet{
+	fetch, sign, urlSet, err := parseURLs("", "https://example.com/", []util.URLSet{
 		{Sign: &util.URLPattern{Domain: "wrongexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
 		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000, ErrorOnStatefulHeaders: true}},
@@ -139,7 +140,7 @@ func TestParseURLs(t *testing.T) {
 	if assert.Nil(t, err) {
 		assert.Equal(t, "https://example.com/", fetch.String())
 		assert.Equal(t, "https://example.com/", sign.String())
-		assert.True(t, errorOnStatefulHeaders)
+		assert.True(t, urlSet.Sign.ErrorOnStatefulHeaders)
 	}
 
 	_, _, _, err = parseURLs("", "https://example.com/", []util.URLSet{
@@ -154,6 +155,25 @@ func TestParseURLs(t *testing.T) {
 	}
 }
 
+func TestUpstreamMaxAge(t *testing.T) {
+	for _, test := range []struct {
+		header http.Header
+		maxAge time.Duration
+		ok     bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public"}}, 0, false},
+		{http.Header{"Cache-Control": {"max-age=100"}}, 100 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=100, s-maxage=200"}}, 200 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=100"}, "Age": {"30"}}, 70 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=100"}, "Age": {"bogus"}}, 100 * time.Second, true},
+	} {
+		maxAge, ok := upstreamMaxAge(test.header)
+		assert.Equal(t, test.ok, ok, "%v", test.header)
+		assert.Equal(t, test.maxAge, maxAge, "%v", test.header)
+	}
+}
+
 func TestValidateFetch(t *testing.T) {
 	req := httptest.NewRequest("", "/", nil)
 	resp := http.Response{Header: http.Header{}}
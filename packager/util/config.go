@@ -15,9 +15,12 @@
 package util
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
@@ -41,11 +44,119 @@ type Config struct {
 	ForwardedRequestHeaders []string
 	URLSet                  []URLSet
 	ACMEConfig              *ACMEConfig
+
+	// Additional cert chains, for serving multiple domains from one
+	// packager. Each chain is used to sign the URLSets whose Sign.Domain
+	// is covered by its leaf certificate. See CertChains().
+	CertChain []CertChain
+
+	// When true, each exchange is signed by every cert chain that covers its
+	// sign URL, in the order given by CertChains(), rather than just the
+	// first. This is useful while migrating between CAs, so that caches that
+	// trust only one of the roots still accept the SXG.
+	SignWithAllCertChains bool
+
+	// Configures where OCSP responses are cached, and how replicas
+	// coordinate refreshing them. If unset, each is cached in its
+	// OCSPCache file, as with Backend = "file".
+	OCSPStorage *OCSPStorageConfig
+
+	// Configures how OCSP responses are fetched from the CA's responders,
+	// e.g. through an outbound proxy. If unset, the defaults described in
+	// OCSPFetchConfig apply.
+	OCSPFetch *OCSPFetchConfig
+
+	// If set, packaged SXGs are cached, and revalidated against the origin
+	// on subsequent requests rather than regenerated.
+	SXGCache *SXGCacheConfig
+
+	// If set, responses are compressed per the request's Accept-Encoding.
+	// If unset, they're never compressed.
+	Compression *CompressionConfig
+
+	// Configures the mutation of the publisher's Content-Security-Policy.
+	// If unset, the defaults described in CSPConfig apply.
+	ContentSecurityPolicy *CSPConfig
+
+	// If set, limits the number of documents transformed and signed at once,
+	// and sheds load beyond that. If unset, there is no limit.
+	Concurrency *ConcurrencyConfig
+
+	// If set, the packager runs as a transparent front end to the origin,
+	// rather than behind /priv/doc URLs: requests to the publisher's own URLs
+	// are signed if they match a URLSet, and reverse-proxied otherwise.
+	FrontEnd *FrontEndConfig
+
+	// Enables verbose logging, to help debug why and how documents are
+	// packaged. Not recommended for production, as it logs on every
+	// request.
+	Debug bool
+}
+
+// The files backing a single certificate chain. The fields have the same
+// meaning as the identically-named fields in Config.
+type CertChain struct {
+	CertFile    string
+	KeyFile     string
+	CSRFile     string
+	NewCertFile string
+	OCSPCache   string
+}
+
+// CertChains returns all configured cert chains: the one specified by the
+// top-level CertFile, KeyFile, etc. (if any), followed by each [[CertChain]].
+func (this *Config) CertChains() []CertChain {
+	var chains []CertChain
+	if this.CertFile != "" {
+		chains = append(chains, this.topLevelCertChain())
+	}
+	return append(chains, this.CertChain...)
+}
+
+func (this *Config) topLevelCertChain() CertChain {
+	return CertChain{
+		CertFile:    this.CertFile,
+		KeyFile:     this.KeyFile,
+		CSRFile:     this.CSRFile,
+		NewCertFile: this.NewCertFile,
+		OCSPCache:   this.OCSPCache,
+	}
+}
+
+// ForCertChain returns a shallow copy of the config, with the top-level
+// CertFile, KeyFile, etc. replaced by those of the given chain. This allows
+// passing it to functions that operate on a single cert chain.
+func (this *Config) ForCertChain(chain CertChain) *Config {
+	ret := *this
+	ret.CertFile = chain.CertFile
+	ret.KeyFile = chain.KeyFile
+	ret.CSRFile = chain.CSRFile
+	ret.NewCertFile = chain.NewCertFile
+	ret.OCSPCache = chain.OCSPCache
+	ret.CertChain = nil
+	return &ret
 }
 
 type URLSet struct {
 	Fetch *URLPattern
 	Sign  *URLPattern
+	// Configures how documents in this set are fetched from the origin. If
+	// unset, each fetch has a 60 second timeout and isn't retried. If the
+	// signer is given a FetchTransport, only the timeouts and retries apply;
+	// see signer.Options.
+	Upstream *UpstreamConfig
+	// The number of redirects to follow when fetching a document. Only
+	// same-origin redirects are followed, and only if the target's path and
+	// query, on the sign URL's origin, still match this URLSet. The final
+	// document is signed under the requested sign URL, but its relative
+	// URLs are resolved against the redirect target. Defaults to 0, i.e.
+	// redirects are proxied unsigned.
+	MaxRedirects int
+	// If true, documents in this set that aren't signed because the client
+	// doesn't accept SXGs (or the packager is unhealthy) are served as
+	// transformed HTML, optimized for serving from the origin, rather than
+	// proxied as is. See signer.optimizerTransformers.
+	Optimize bool
 }
 
 type URLPattern struct {
@@ -58,8 +169,245 @@ type URLPattern struct {
 	ErrorOnStatefulHeaders bool
 	MaxLength              int
 	SamePath               *bool
+
+	// The following are only allowed in Sign patterns. They configure the
+	// lifetime of the SXG signature; see the Sxg* methods for defaults.
+	//
+	// How far before the signing time to set the signature date, to allow
+	// for clients with slow clocks.
+	Backdate time.Duration
+	// The maximum time from the signature date until it expires.
+	MaxLifetime time.Duration
+	// If true, the signature additionally expires no later than the
+	// upstream response does, per its Cache-Control s-maxage or max-age. If
+	// that leaves less than MinSxgEffectiveLifetime, the response is served
+	// unsigned instead.
+	HonorMaxAge bool
+
+	// Only allowed in Fetch patterns. If set, fetches connect to this Unix
+	// domain socket, rather than to the fetch URL's host. The fetch URL is
+	// otherwise unchanged, so its host is still sent in the Host header.
+	UnixSocket string
+}
+
+// The longest allowed signature duration (expires minus date), per
+// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
+const MaxSxgLifetime = 7 * 24 * time.Hour
+
+// The shortest allowed remaining signature lifetime (expires minus signing
+// time), per docs/cache_requirements.md.
+const MinSxgEffectiveLifetime = 3 * 24 * time.Hour
+
+const defaultSxgBackdate = 24 * time.Hour
+
+// SxgBackdate returns Backdate, or its default if unset.
+func (this *URLPattern) SxgBackdate() time.Duration {
+	if this.Backdate == 0 {
+		return defaultSxgBackdate
+	}
+	return this.Backdate
+}
+
+// SxgMaxLifetime returns MaxLifetime, or its default if unset.
+func (this *URLPattern) SxgMaxLifetime() time.Duration {
+	if this.MaxLifetime == 0 {
+		return MaxSxgLifetime
+	}
+	return this.MaxLifetime
+}
+
+type SXGCacheConfig struct {
+	// The maximum size of the in-memory cache. Defaults to 64 MiB.
+	MaxMemoryBytes int64
+	// If non-empty, SXGs are also cached as files in this directory, which
+	// must exist. It may be shared by multiple replicas.
+	Dir string
+	// The maximum total size of the files in Dir. Once exceeded, those
+	// closest to expiry are removed. Defaults to 1 GiB.
+	MaxDiskBytes int64
+}
+
+const defaultSXGCacheMaxMemoryBytes = 64 << 20
+const defaultSXGCacheMaxDiskBytes = 1 << 30
+
+type CompressionConfig struct {
+	// The gzip compression level, from 1 (fastest) to 9 (smallest). Defaults
+	// to 6.
+	GzipLevel int
+	// The brotli compression level, from 1 (fastest) to 11 (smallest).
+	// Defaults to 5.
+	BrotliLevel int
+}
+
+const defaultGzipLevel = 6
+const defaultBrotliLevel = 5
+
+type ConcurrencyConfig struct {
+	// The maximum number of documents transformed and signed at once.
+	// Required.
+	MaxSigning int
+	// The maximum number of requests waiting for one of the MaxSigning
+	// slots. Defaults to MaxSigning.
+	MaxQueued int
+	// How long a request may wait for a slot. Defaults to 1 second.
+	QueueTimeout time.Duration
+	// The approximate maximum memory used by documents being transformed
+	// and signed, estimated as a multiple of their sizes. If unset, only
+	// MaxSigning applies.
+	MaxMemoryBytes int64
+	// What to do with requests that can't be signed because the above
+	// limits are exceeded: "unsigned" to proxy the document unsigned, or
+	// "unavailable" to respond with a 503. Defaults to "unsigned".
+	Shed string
+	// The Retry-After of 503 responses, when Shed is "unavailable".
+	// Rounded up to whole seconds. Defaults to 1 second.
+	RetryAfter time.Duration
+}
+
+const (
+	ShedUnsigned    = "unsigned"
+	ShedUnavailable = "unavailable"
+)
+
+const defaultConcurrencyQueueTimeout = time.Second
+const defaultConcurrencyRetryAfter = time.Second
+
+type FrontEndConfig struct {
+	// The origin server that documents are fetched from and other requests
+	// are proxied to, as a URL with only a scheme and host, e.g.
+	// "http://origin.internal:8080". Requests keep their Host header.
+	// Required.
+	Origin string
+	// The hosts that requests may be addressed to. Requests for any other
+	// Host are rejected, so that spoofed Hosts are neither signed nor sent
+	// to the origin. Defaults to the Sign.Domain of each URLSet.
+	Hosts []string
+}
+
+const (
+	OCSPStorageFile   = "file"
+	OCSPStorageMemory = "memory"
+	OCSPStorageRedis  = "redis"
+	OCSPStorageS3     = "s3"
+)
+
+type OCSPStorageConfig struct {
+	// One of:
+	//  - "file", the default: each OCSP response is cached in its
+	//    OCSPCache file, guarded by a file lock. Replicas may share the
+	//    file over a network filesystem, subject to its locking semantics.
+	//  - "memory": each replica caches and refreshes its own OCSP
+	//    responses, without persisting them.
+	//  - "redis": OCSP responses are cached in a Redis-protocol server,
+	//    per [OCSPStorage.Redis].
+	//  - "s3": OCSP responses are cached in S3-compatible object storage,
+	//    per [OCSPStorage.S3].
+	// For the remote backends, the OCSPCache paths are used as key names,
+	// and the replica that refreshes a response holds a lease on it so the
+	// others don't.
+	Backend string
+	// How long a replica may take to refresh an OCSP response before
+	// another replica may take over. Defaults to 2 minutes.
+	LeaseDuration time.Duration
+	Redis         *RedisStorageConfig
+	S3            *S3StorageConfig
+}
+
+const defaultOCSPStorageLeaseDuration = 2 * time.Minute
+
+type RedisStorageConfig struct {
+	// The server's host:port. Required.
+	Addr string
+	// If set, sent with AUTH upon connecting.
+	Password string
+	// The database number, sent with SELECT upon connecting.
+	DB int
+	// If true, connects using TLS.
+	TLS bool
+	// Prepended to the key of each OCSP response. Defaults to
+	// "amppackager:".
+	KeyPrefix string
 }
 
+const defaultRedisKeyPrefix = "amppackager:"
+
+type S3StorageConfig struct {
+	// The service's URL, e.g. "https://s3.us-east-1.amazonaws.com".
+	// Objects are addressed path-style, as Endpoint/Bucket/Key. Required.
+	Endpoint string
+	// The region that requests are signed for. Defaults to "us-east-1".
+	Region string
+	// Required.
+	Bucket string
+	// Prepended to the key of each OCSP response. Defaults to
+	// "amppackager/".
+	KeyPrefix string
+	// The credentials that requests are signed with. If unset, they're
+	// read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+const defaultS3Region = "us-east-1"
+const defaultS3KeyPrefix = "amppackager/"
+
+type OCSPFetchConfig struct {
+	// The URL of the proxy that requests to OCSP responders are sent
+	// through, e.g. "http://proxy.example.com:3128". If unset, the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+	Proxy string
+	// A PEM file of CA certificates to trust, in addition to the system's,
+	// when connecting to HTTPS responders or an HTTPS Proxy.
+	CABundle string
+	// The limit on each request to a responder. Each of the cert's
+	// responders is tried in turn, by GET and then by POST, until one
+	// returns a valid response. Defaults to 60 seconds.
+	Timeout time.Duration
+}
+
+const defaultOCSPFetchTimeout = 60 * time.Second
+
+type UpstreamConfig struct {
+	// The limit on establishing a connection to the origin. Defaults to 30
+	// seconds.
+	ConnectTimeout time.Duration
+	// The limit on waiting for the response headers, once the request is
+	// sent. If unset, only Timeout applies.
+	ResponseHeaderTimeout time.Duration
+	// The limit on each attempt, from connecting until the body is read.
+	// Defaults to 60 seconds.
+	Timeout time.Duration
+	// The limit on all attempts of a fetch together, including the waits
+	// between retries. No retry is started once it has elapsed. Defaults to
+	// Timeout, so that retries don't prolong a fetch beyond what a single
+	// attempt could take.
+	TotalTimeout time.Duration
+	// The maximum number of idle connections to keep open to each origin
+	// host. Defaults to 2.
+	MaxIdleConnsPerHost int
+	// The number of times to retry a fetch that failed because the
+	// connection was refused or reset (or closed, if reused from an earlier
+	// fetch), or with a 502, 503, or 504 status. Timeouts aren't retried.
+	// Defaults to 0.
+	Retries int
+	// Each retry waits a random duration of up to RetryBackoff * 2^n, where
+	// n is the number of retries so far. Defaults to 100 milliseconds.
+	RetryBackoff time.Duration
+}
+
+const defaultUpstreamConnectTimeout = 30 * time.Second
+const defaultUpstreamTimeout = 60 * time.Second
+const defaultUpstreamMaxIdleConnsPerHost = 2
+const defaultUpstreamRetryBackoff = 100 * time.Millisecond
+
+// The most retries allowed, to bound the load added to an origin that's
+// already struggling.
+const maxUpstreamRetries = 5
+
+// The most redirects a URLSet may follow, to bound the fetches per request.
+const maxURLSetRedirects = 10
+
 type ACMEConfig struct {
 	Production  *ACMEServerConfig
 	Development *ACMEServerConfig
@@ -138,6 +486,22 @@ func ValidateSignURLPattern(pattern *URLPattern) error {
 	if pattern.SamePath != nil {
 		return errors.New("SamePath not allowed here")
 	}
+	if pattern.UnixSocket != "" {
+		return errors.New("UnixSocket not allowed here")
+	}
+	if pattern.Backdate < 0 {
+		return errors.New("Backdate must not be negative")
+	}
+	if pattern.MaxLifetime < 0 {
+		return errors.New("MaxLifetime must not be negative")
+	}
+	if pattern.SxgMaxLifetime() > MaxSxgLifetime {
+		return errors.Errorf("MaxLifetime must be at most %s", MaxSxgLifetime)
+	}
+	if pattern.SxgMaxLifetime()-pattern.SxgBackdate() < MinSxgEffectiveLifetime {
+		return errors.Errorf("MaxLifetime (%s) minus Backdate (%s) must be at least %s, per the AMP cache requirements",
+			pattern.SxgMaxLifetime(), pattern.SxgBackdate(), MinSxgEffectiveLifetime)
+	}
 	if err := ValidateURLPattern(pattern); err != nil {
 		return err
 	}
@@ -179,6 +543,18 @@ func ValidateFetchURLPattern(pattern *URLPattern) error {
 	if pattern.ErrorOnStatefulHeaders {
 		return errors.New("ErrorOnStatefulHeaders not allowed here")
 	}
+	if pattern.Backdate != 0 {
+		return errors.New("Backdate not allowed here")
+	}
+	if pattern.MaxLifetime != 0 {
+		return errors.New("MaxLifetime not allowed here")
+	}
+	if pattern.HonorMaxAge {
+		return errors.New("HonorMaxAge not allowed here")
+	}
+	if pattern.UnixSocket != "" && !filepath.IsAbs(pattern.UnixSocket) {
+		return errors.Errorf("UnixSocket must be an absolute path: %s", pattern.UnixSocket)
+	}
 	if err := ValidateURLPattern(pattern); err != nil {
 		return err
 	}
@@ -194,6 +570,271 @@ func ValidateForwardedRequestHeaders(hs []string) error {
 	return nil
 }
 
+func validateCertChain(chain *CertChain) error {
+	if chain.CertFile == "" {
+		return errors.New("must specify CertFile")
+	}
+	if chain.KeyFile == "" {
+		return errors.New("must specify KeyFile")
+	}
+	if chain.OCSPCache == "" {
+		return errors.New("must specify OCSPCache")
+	}
+	ocspDir := filepath.Dir(chain.OCSPCache)
+	if stat, err := os.Stat(ocspDir); os.IsNotExist(err) || !stat.Mode().IsDir() {
+		return errors.Errorf("OCSPCache parent directory must exist: %s", ocspDir)
+	}
+	// TODO(twifkak): Verify OCSPCache is writable by the current user.
+	return nil
+}
+
+// Also sets defaults.
+func validateSXGCache(cache *SXGCacheConfig) error {
+	if cache.MaxMemoryBytes < 0 {
+		return errors.New("MaxMemoryBytes must not be negative")
+	}
+	if cache.MaxMemoryBytes == 0 {
+		cache.MaxMemoryBytes = defaultSXGCacheMaxMemoryBytes
+	}
+	if cache.MaxDiskBytes < 0 {
+		return errors.New("MaxDiskBytes must not be negative")
+	}
+	if cache.MaxDiskBytes == 0 {
+		cache.MaxDiskBytes = defaultSXGCacheMaxDiskBytes
+	}
+	if cache.Dir != "" {
+		if stat, err := os.Stat(cache.Dir); os.IsNotExist(err) || !stat.Mode().IsDir() {
+			return errors.Errorf("Dir must exist: %s", cache.Dir)
+		}
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateCompression(compression *CompressionConfig) error {
+	if compression.GzipLevel < 0 || compression.GzipLevel > 9 {
+		return errors.Errorf("GzipLevel must be between 1 and 9: %d", compression.GzipLevel)
+	}
+	if compression.GzipLevel == 0 {
+		compression.GzipLevel = defaultGzipLevel
+	}
+	if compression.BrotliLevel < 0 || compression.BrotliLevel > 11 {
+		return errors.Errorf("BrotliLevel must be between 1 and 11: %d", compression.BrotliLevel)
+	}
+	if compression.BrotliLevel == 0 {
+		compression.BrotliLevel = defaultBrotliLevel
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateConcurrency(concurrency *ConcurrencyConfig) error {
+	if concurrency.MaxSigning <= 0 {
+		return errors.Errorf("MaxSigning must be positive: %d", concurrency.MaxSigning)
+	}
+	if concurrency.MaxQueued < 0 {
+		return errors.New("MaxQueued must not be negative")
+	}
+	if concurrency.MaxQueued == 0 {
+		concurrency.MaxQueued = concurrency.MaxSigning
+	}
+	if concurrency.QueueTimeout < 0 {
+		return errors.New("QueueTimeout must not be negative")
+	}
+	if concurrency.QueueTimeout == 0 {
+		concurrency.QueueTimeout = defaultConcurrencyQueueTimeout
+	}
+	if concurrency.MaxMemoryBytes < 0 {
+		return errors.New("MaxMemoryBytes must not be negative")
+	}
+	switch concurrency.Shed {
+	case "":
+		concurrency.Shed = ShedUnsigned
+	case ShedUnsigned, ShedUnavailable:
+	default:
+		return errors.Errorf("Shed must be %q or %q: %q", ShedUnsigned, ShedUnavailable, concurrency.Shed)
+	}
+	if concurrency.RetryAfter < 0 {
+		return errors.New("RetryAfter must not be negative")
+	}
+	if concurrency.RetryAfter == 0 {
+		concurrency.RetryAfter = defaultConcurrencyRetryAfter
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateFrontEnd(frontEnd *FrontEndConfig, urlSets []URLSet) error {
+	if frontEnd.Origin == "" {
+		return errors.New("must specify Origin")
+	}
+	origin, err := url.Parse(frontEnd.Origin)
+	if err != nil {
+		return errors.Wrap(err, "parsing Origin")
+	}
+	if !allowedFetchSchemes[origin.Scheme] || origin.Host == "" || (origin.Path != "" && origin.Path != "/") || origin.RawQuery != "" || origin.User != nil {
+		return errors.Errorf("Origin must be an http or https URL with only a scheme and host: %s", frontEnd.Origin)
+	}
+	for i := range urlSets {
+		// The fetch URL is always the sign URL on Origin.
+		if urlSets[i].Fetch != nil {
+			return errors.Errorf("URLSet.%d.Fetch not allowed with FrontEnd", i)
+		}
+	}
+	if len(frontEnd.Hosts) == 0 {
+		for i := range urlSets {
+			frontEnd.Hosts = append(frontEnd.Hosts, urlSets[i].Sign.Domain)
+		}
+	}
+	for i, host := range frontEnd.Hosts {
+		if host == "" || strings.ContainsAny(host, ":/@") {
+			return errors.Errorf("Hosts must contain only host names: %q", host)
+		}
+		frontEnd.Hosts[i] = strings.ToLower(host)
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateOCSPStorage(storage *OCSPStorageConfig) error {
+	switch storage.Backend {
+	case "":
+		storage.Backend = OCSPStorageFile
+	case OCSPStorageFile, OCSPStorageMemory:
+	case OCSPStorageRedis:
+		if storage.Redis == nil {
+			return errors.New("must specify [OCSPStorage.Redis]")
+		}
+		if err := validateRedisStorage(storage.Redis); err != nil {
+			return errors.Wrap(err, "parsing Redis")
+		}
+	case OCSPStorageS3:
+		if storage.S3 == nil {
+			return errors.New("must specify [OCSPStorage.S3]")
+		}
+		if err := validateS3Storage(storage.S3); err != nil {
+			return errors.Wrap(err, "parsing S3")
+		}
+	default:
+		return errors.Errorf("Backend must be %q, %q, %q or %q: %q",
+			OCSPStorageFile, OCSPStorageMemory, OCSPStorageRedis, OCSPStorageS3, storage.Backend)
+	}
+	if storage.LeaseDuration < 0 {
+		return errors.New("LeaseDuration must not be negative")
+	}
+	if storage.LeaseDuration == 0 {
+		storage.LeaseDuration = defaultOCSPStorageLeaseDuration
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateRedisStorage(redis *RedisStorageConfig) error {
+	if redis.Addr == "" {
+		return errors.New("must specify Addr")
+	}
+	if redis.DB < 0 {
+		return errors.New("DB must not be negative")
+	}
+	if redis.KeyPrefix == "" {
+		redis.KeyPrefix = defaultRedisKeyPrefix
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateS3Storage(s3 *S3StorageConfig) error {
+	if s3.Endpoint == "" {
+		return errors.New("must specify Endpoint")
+	}
+	endpoint, err := url.Parse(s3.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "parsing Endpoint")
+	}
+	if !allowedFetchSchemes[endpoint.Scheme] || endpoint.Host == "" || endpoint.RawQuery != "" || endpoint.User != nil {
+		return errors.Errorf("Endpoint must be an http or https URL: %s", s3.Endpoint)
+	}
+	if s3.Bucket == "" || strings.Contains(s3.Bucket, "/") {
+		return errors.Errorf("Bucket must be a bucket name: %q", s3.Bucket)
+	}
+	if (s3.AccessKeyID == "") != (s3.SecretAccessKey == "") {
+		return errors.New("must specify both or neither of AccessKeyID and SecretAccessKey")
+	}
+	if s3.Region == "" {
+		s3.Region = defaultS3Region
+	}
+	if s3.KeyPrefix == "" {
+		s3.KeyPrefix = defaultS3KeyPrefix
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateOCSPFetch(fetch *OCSPFetchConfig) error {
+	if fetch.Proxy != "" {
+		proxy, err := url.Parse(fetch.Proxy)
+		if err != nil {
+			return errors.Wrap(err, "parsing Proxy")
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return errors.Errorf("Proxy must be an http, https or socks5 URL: %s", fetch.Proxy)
+		}
+		if proxy.Host == "" {
+			return errors.Errorf("Proxy must have a host: %s", fetch.Proxy)
+		}
+	}
+	if fetch.Timeout < 0 {
+		return errors.New("Timeout must not be negative")
+	}
+	if fetch.Timeout == 0 {
+		fetch.Timeout = defaultOCSPFetchTimeout
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateUpstream(upstream *UpstreamConfig) error {
+	if upstream.ConnectTimeout < 0 {
+		return errors.New("ConnectTimeout must not be negative")
+	}
+	if upstream.ConnectTimeout == 0 {
+		upstream.ConnectTimeout = defaultUpstreamConnectTimeout
+	}
+	if upstream.ResponseHeaderTimeout < 0 {
+		return errors.New("ResponseHeaderTimeout must not be negative")
+	}
+	if upstream.Timeout < 0 {
+		return errors.New("Timeout must not be negative")
+	}
+	if upstream.Timeout == 0 {
+		upstream.Timeout = defaultUpstreamTimeout
+	}
+	if upstream.TotalTimeout < 0 {
+		return errors.New("TotalTimeout must not be negative")
+	}
+	if upstream.TotalTimeout == 0 {
+		upstream.TotalTimeout = upstream.Timeout
+	}
+	if upstream.MaxIdleConnsPerHost < 0 {
+		return errors.New("MaxIdleConnsPerHost must not be negative")
+	}
+	if upstream.MaxIdleConnsPerHost == 0 {
+		upstream.MaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	}
+	if upstream.Retries < 0 || upstream.Retries > maxUpstreamRetries {
+		return errors.Errorf("Retries must be between 0 and %d: %d", maxUpstreamRetries, upstream.Retries)
+	}
+	if upstream.RetryBackoff < 0 {
+		return errors.New("RetryBackoff must not be negative")
+	}
+	if upstream.RetryBackoff == 0 {
+		upstream.RetryBackoff = defaultUpstreamRetryBackoff
+	}
+	return nil
+}
+
 // ReadConfig reads the config file specified at --config and validates it.
 func ReadConfig(configBytes []byte) (*Config, error) {
 	tree, err := toml.LoadBytes(configBytes)
@@ -209,25 +850,62 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 	if config.Port == 0 {
 		config.Port = 8080
 	}
-	if config.CertFile == "" {
-		return nil, errors.New("must specify CertFile")
+	// The top-level cert chain is optional only if [[CertChain]] is given.
+	if config.CertFile != "" || len(config.CertChain) == 0 {
+		topLevel := config.topLevelCertChain()
+		if err := validateCertChain(&topLevel); err != nil {
+			return nil, err
+		}
 	}
-	if config.KeyFile == "" {
-		return nil, errors.New("must specify KeyFile")
+	for i := range config.CertChain {
+		if err := validateCertChain(&config.CertChain[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing CertChain.%d", i)
+		}
 	}
-	if config.OCSPCache == "" {
-		return nil, errors.New("must specify OCSPCache")
+	// Each chain has its own OCSP response, so sharing a cache file would
+	// cause them to overwrite each other.
+	ocspCaches := map[string]bool{}
+	for _, chain := range config.CertChains() {
+		if ocspCaches[chain.OCSPCache] {
+			return nil, errors.Errorf("OCSPCache must be unique per cert chain: %s", chain.OCSPCache)
+		}
+		ocspCaches[chain.OCSPCache] = true
+	}
+	if config.OCSPStorage != nil {
+		if err := validateOCSPStorage(config.OCSPStorage); err != nil {
+			return nil, errors.Wrap(err, "parsing OCSPStorage")
+		}
+	}
+	if config.OCSPFetch != nil {
+		if err := validateOCSPFetch(config.OCSPFetch); err != nil {
+			return nil, errors.Wrap(err, "parsing OCSPFetch")
+		}
 	}
 	if len(config.ForwardedRequestHeaders) > 0 {
 		if err := ValidateForwardedRequestHeaders(config.ForwardedRequestHeaders); err != nil {
 			return nil, err
 		}
 	}
-	ocspDir := filepath.Dir(config.OCSPCache)
-	if stat, err := os.Stat(ocspDir); os.IsNotExist(err) || !stat.Mode().IsDir() {
-		return nil, errors.Errorf("OCSPCache parent directory must exist: %s", ocspDir)
+	if config.SXGCache != nil {
+		if err := validateSXGCache(config.SXGCache); err != nil {
+			return nil, errors.Wrap(err, "parsing SXGCache")
+		}
+	}
+	if config.ContentSecurityPolicy != nil {
+		if err := validateCSP(config.ContentSecurityPolicy); err != nil {
+			return nil, errors.Wrap(err, "parsing ContentSecurityPolicy")
+		}
+	}
+	if config.Concurrency != nil {
+		if err := validateConcurrency(config.Concurrency); err != nil {
+			return nil, errors.Wrap(err, "parsing Concurrency")
+		}
+	}
+	if config.Compression != nil {
+		if err := validateCompression(config.Compression); err != nil {
+			return nil, errors.Wrap(err, "parsing Compression")
+		}
 	}
-	// TODO(twifkak): Verify OCSPCache is writable by the current user.
 	if len(config.URLSet) == 0 {
 		return nil, errors.New("must specify one or more [[URLSet]]")
 	}
@@ -240,6 +918,19 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 		if err := ValidateSignURLPattern(config.URLSet[i].Sign); err != nil {
 			return nil, errors.Wrapf(err, "parsing URLSet.%d.Sign", i)
 		}
+		if config.URLSet[i].Upstream != nil {
+			if err := validateUpstream(config.URLSet[i].Upstream); err != nil {
+				return nil, errors.Wrapf(err, "parsing URLSet.%d.Upstream", i)
+			}
+		}
+		if redirects := config.URLSet[i].MaxRedirects; redirects < 0 || redirects > maxURLSetRedirects {
+			return nil, errors.Errorf("parsing URLSet.%d: MaxRedirects must be between 0 and %d: %d", i, maxURLSetRedirects, redirects)
+		}
+	}
+	if config.FrontEnd != nil {
+		if err := validateFrontEnd(config.FrontEnd, config.URLSet); err != nil {
+			return nil, errors.Wrap(err, "parsing FrontEnd")
+		}
 	}
 	return &config, nil
 }
@@ -2,6 +2,7 @@ package util
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -335,6 +336,9 @@ func TestSignOverrides(t *testing.T) {
 		    QueryRE = ""
 		    ErrorOnStatefulHeaders = true
 		    MaxLength = 8000
+		    Backdate = "2h"
+		    MaxLifetime = "96h"
+		    HonorMaxAge = true
 	`))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(config.URLSet))
@@ -346,7 +350,115 @@ func TestSignOverrides(t *testing.T) {
 		QueryRE:                stringPtr(""),
 		ErrorOnStatefulHeaders: true,
 		MaxLength:              8000,
+		Backdate:               2 * time.Hour,
+		MaxLifetime:            96 * time.Hour,
+		HonorMaxAge:            true,
 	}, *config.URLSet[0].Sign)
+	assert.Equal(t, 2*time.Hour, config.URLSet[0].Sign.SxgBackdate())
+	assert.Equal(t, 96*time.Hour, config.URLSet[0].Sign.SxgMaxLifetime())
+}
+
+func TestSignLifetimeDefaults(t *testing.T) {
+	pattern := URLPattern{}
+	assert.Equal(t, 24*time.Hour, pattern.SxgBackdate())
+	assert.Equal(t, 7*24*time.Hour, pattern.SxgMaxLifetime())
+}
+
+func TestSignLifetimeTooShort(t *testing.T) {
+	// The 1-day default backdate leaves less than 3 days.
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		    MaxLifetime = "95h"
+	`))), "MaxLifetime (95h0m0s) minus Backdate (24h0m0s) must be at least 72h0m0s")
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		    Backdate = "97h"
+	`))), "MaxLifetime (168h0m0s) minus Backdate (97h0m0s) must be at least 72h0m0s")
+}
+
+func TestSignLifetimeTooLong(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		    MaxLifetime = "169h"
+	`))), "MaxLifetime must be at most 168h0m0s")
+}
+
+func TestSignNegativeBackdate(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		    Backdate = "-1h"
+	`))), "Backdate must not be negative")
+}
+
+func TestFetchLifetime(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		  [URLSet.Fetch]
+		    Domain = "example.com"
+		    MaxLifetime = "96h"
+	`))), "MaxLifetime not allowed here")
+}
+
+func TestFetchUnixSocket(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		  [URLSet.Fetch]
+		    Domain = "renderer.internal"
+		    UnixSocket = "/run/renderer.sock"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, "/run/renderer.sock", config.URLSet[0].Fetch.UnixSocket)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		  [URLSet.Fetch]
+		    Domain = "renderer.internal"
+		    UnixSocket = "renderer.sock"
+	`))), "parsing URLSet.0.Fetch: UnixSocket must be an absolute path: renderer.sock")
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		    UnixSocket = "/run/renderer.sock"
+	`))), "parsing URLSet.0.Sign: UnixSocket not allowed here")
 }
 
 func TestFetchDefaults(t *testing.T) {
@@ -448,3 +560,527 @@ func TestFetchErrorOnStatefulHeaders(t *testing.T) {
 		    ErrorOnStatefulHeaders = true
 	`))), "ErrorOnStatefulHeaders not allowed")
 }
+
+func TestCertChains(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[CertChain]]
+		  CertFile = "cert2.pem"
+		  KeyFile = "key2.pem"
+		  CSRFile = "file2.csr"
+		  OCSPCache = "/tmp/ocsp2"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, []CertChain{
+		{CertFile: "cert.pem", KeyFile: "key.pem", OCSPCache: "/tmp/ocsp"},
+		{CertFile: "cert2.pem", KeyFile: "key2.pem", CSRFile: "file2.csr", OCSPCache: "/tmp/ocsp2"},
+	}, config.CertChains())
+	chainConfig := config.ForCertChain(config.CertChains()[1])
+	assert.Equal(t, "cert2.pem", chainConfig.CertFile)
+	assert.Equal(t, "key2.pem", chainConfig.KeyFile)
+	assert.Equal(t, "file2.csr", chainConfig.CSRFile)
+	assert.Equal(t, "/tmp/ocsp2", chainConfig.OCSPCache)
+	assert.Equal(t, config.URLSet, chainConfig.URLSet)
+}
+
+func TestSignWithAllCertChains(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		SignWithAllCertChains = true
+		[[CertChain]]
+		  CertFile = "cert2.pem"
+		  KeyFile = "key2.pem"
+		  OCSPCache = "/tmp/ocsp2"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.True(t, config.SignWithAllCertChains)
+	assert.Len(t, config.CertChains(), 2)
+}
+
+func TestSXGCacheConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[SXGCache]
+		  Dir = "/tmp"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &SXGCacheConfig{MaxMemoryBytes: 64 << 20, Dir: "/tmp", MaxDiskBytes: 1 << 30}, config.SXGCache)
+}
+
+func TestSXGCacheConfigMaxDiskBytesMustNotBeNegative(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[SXGCache]
+		  MaxDiskBytes = -1
+	`))), "parsing SXGCache: MaxDiskBytes must not be negative")
+}
+
+func TestSXGCacheConfigDirMustExist(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[SXGCache]
+		  Dir = "/does/not/exist"
+	`))), "parsing SXGCache: Dir must exist: /does/not/exist")
+}
+
+func TestCompressionConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[Compression]
+		  GzipLevel = 1
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &CompressionConfig{GzipLevel: 1, BrotliLevel: 5}, config.Compression)
+}
+
+func TestCompressionLevelOutOfRange(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[Compression]
+		  BrotliLevel = 12
+	`))), "parsing Compression: BrotliLevel must be between 1 and 11: 12")
+}
+
+func TestContentSecurityPolicyConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[ContentSecurityPolicy]
+		  ExtraFontSrc = ["https://*.example.com/fonts/"]
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &CSPConfig{
+		KeepDirectives: CSPPassthroughDirectives,
+		ExtraFontSrc:   []string{"https://*.example.com/fonts/"},
+	}, config.ContentSecurityPolicy)
+
+	config, err = ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[ContentSecurityPolicy]
+		  KeepDirectives = ["Base-URI"]
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"base-uri"}, config.ContentSecurityPolicy.KeepDirectives)
+}
+
+func TestContentSecurityPolicyErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		`KeepDirectives = ["script-src"]`: `KeepDirectives must be a subset of`,
+		`KeepDirectives = ["base-uri"]` + "\n" + `ExtraFontSrc = ["https://fonts.example.com"]`: `ExtraFontSrc requires font-src in KeepDirectives`,
+		`ExtraFontSrc = ["http://fonts.example.com"]`:                                           `ExtraFontSrc: source must be an https host-source: "http://fonts.example.com"`,
+		`ExtraFontSrc = ["'unsafe-eval'"]`:                                                      `ExtraFontSrc: source must be an https host-source`,
+		`ExtraFontSrc = ["https://*"]`:                                                          `ExtraFontSrc: source must be an https host-source`,
+		`ExtraFontSrc = ["https://example.com; script-src *"]`:                                  `ExtraFontSrc: source must be an https host-source`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			[ContentSecurityPolicy]
+			  `+body))), "parsing ContentSecurityPolicy: "+msg)
+	}
+}
+
+func TestUpstreamConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		  [URLSet.Upstream]
+		    ResponseHeaderTimeout = "5s"
+		    Timeout = "20s"
+		    Retries = 2
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.org"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &UpstreamConfig{
+		ConnectTimeout:        30 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		Timeout:               20 * time.Second,
+		TotalTimeout:          20 * time.Second,
+		MaxIdleConnsPerHost:   2,
+		Retries:               2,
+		RetryBackoff:          100 * time.Millisecond,
+	}, config.URLSet[0].Upstream)
+	assert.Nil(t, config.URLSet[1].Upstream)
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		`ConnectTimeout = "-1s"`:   `ConnectTimeout must not be negative`,
+		`Timeout = "-1s"`:          `Timeout must not be negative`,
+		`TotalTimeout = "-1s"`:     `TotalTimeout must not be negative`,
+		`MaxIdleConnsPerHost = -1`: `MaxIdleConnsPerHost must not be negative`,
+		`Retries = 6`:              `Retries must be between 0 and 5: 6`,
+		`RetryBackoff = "-100ms"`:  `RetryBackoff must not be negative`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			  [URLSet.Upstream]
+			    `+body))), "parsing URLSet.0.Upstream: "+msg)
+	}
+}
+
+func TestConcurrencyConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[Concurrency]
+		  MaxSigning = 8
+		  MaxMemoryBytes = 268435456
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &ConcurrencyConfig{
+		MaxSigning:     8,
+		MaxQueued:      8,
+		QueueTimeout:   time.Second,
+		MaxMemoryBytes: 256 << 20,
+		Shed:           "unsigned",
+		RetryAfter:     time.Second,
+	}, config.Concurrency)
+}
+
+func TestConcurrencyErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		``:                                       `MaxSigning must be positive: 0`,
+		"MaxSigning = 1\nMaxQueued = -1":         `MaxQueued must not be negative`,
+		"MaxSigning = 1\nQueueTimeout = \"-1s\"": `QueueTimeout must not be negative`,
+		"MaxSigning = 1\nMaxMemoryBytes = -1":    `MaxMemoryBytes must not be negative`,
+		"MaxSigning = 1\nShed = \"drop\"":        `Shed must be "unsigned" or "unavailable": "drop"`,
+		"MaxSigning = 1\nRetryAfter = \"-1s\"":   `RetryAfter must not be negative`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			[Concurrency]
+			`+body))), "parsing Concurrency: "+msg)
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  MaxRedirects = 3
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, 3, config.URLSet[0].MaxRedirects)
+	assert.False(t, config.URLSet[0].Optimize)
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  MaxRedirects = 11
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing URLSet.0: MaxRedirects must be between 0 and 10: 11")
+}
+
+func TestOptimize(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  Optimize = true
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.True(t, config.URLSet[0].Optimize)
+}
+
+func TestFrontEndConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "www.example.com"
+		[FrontEnd]
+		  Origin = "http://origin.internal:8080"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &FrontEndConfig{
+		Origin: "http://origin.internal:8080",
+		Hosts:  []string{"example.com", "www.example.com"},
+	}, config.FrontEnd)
+
+	config, err = ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[FrontEnd]
+		  Origin = "https://origin.internal/"
+		  Hosts = ["Example.com", "static.example.com"]
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "static.example.com"}, config.FrontEnd.Hosts)
+}
+
+func TestFrontEndErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		``:                                 `must specify Origin`,
+		`Origin = "ftp://origin.internal"`: `Origin must be an http or https URL with only a scheme and host: ftp://origin.internal`,
+		`Origin = "http://origin/amp"`:     `Origin must be an http or https URL with only a scheme and host: http://origin/amp`,
+		`Origin = "http://origin?a=b"`:     `Origin must be an http or https URL with only a scheme and host: http://origin?a=b`,
+		"Origin = \"http://origin\"\nHosts = [\"example.com:443\"]": `Hosts must contain only host names: "example.com:443"`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			[FrontEnd]
+			`+body))), "parsing FrontEnd: "+msg)
+	}
+
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Fetch]
+		    Domain = "origin.internal"
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[FrontEnd]
+		  Origin = "http://origin.internal"
+	`))), "parsing FrontEnd: URLSet.0.Fetch not allowed with FrontEnd")
+}
+
+func TestOCSPStorageConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[OCSPStorage]
+		  Backend = "redis"
+		  [OCSPStorage.Redis]
+		    Addr = "redis.internal:6379"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &OCSPStorageConfig{
+		Backend:       "redis",
+		LeaseDuration: 2 * time.Minute,
+		Redis: &RedisStorageConfig{
+			Addr:      "redis.internal:6379",
+			KeyPrefix: "amppackager:",
+		},
+	}, config.OCSPStorage)
+
+	config, err = ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[OCSPStorage]
+		  Backend = "s3"
+		  LeaseDuration = "30s"
+		  [OCSPStorage.S3]
+		    Endpoint = "https://storage.example"
+		    Bucket = "ocsp"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &OCSPStorageConfig{
+		Backend:       "s3",
+		LeaseDuration: 30 * time.Second,
+		S3: &S3StorageConfig{
+			Endpoint:  "https://storage.example",
+			Region:    "us-east-1",
+			Bucket:    "ocsp",
+			KeyPrefix: "amppackager/",
+		},
+	}, config.OCSPStorage)
+}
+
+func TestOCSPStorageErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		`Backend = "nfs"`:       `Backend must be "file", "memory", "redis" or "s3": "nfs"`,
+		`Backend = "redis"`:     `must specify [OCSPStorage.Redis]`,
+		`LeaseDuration = "-1s"`: `LeaseDuration must not be negative`,
+		"Backend = \"redis\"\n[OCSPStorage.Redis]\nDB = 1":                                                   `parsing Redis: must specify Addr`,
+		"Backend = \"s3\"\n[OCSPStorage.S3]\nBucket = \"ocsp\"":                                              `parsing S3: must specify Endpoint`,
+		"Backend = \"s3\"\n[OCSPStorage.S3]\nEndpoint = \"ftp://storage.example\"":                           `parsing S3: Endpoint must be an http or https URL: ftp://storage.example`,
+		"Backend = \"s3\"\n[OCSPStorage.S3]\nEndpoint = \"https://storage.example\"":                         `parsing S3: Bucket must be a bucket name: ""`,
+		"Backend = \"s3\"\n[OCSPStorage.S3]\nEndpoint = \"https://s\"\nBucket = \"b\"\nAccessKeyID = \"id\"": `parsing S3: must specify both or neither of AccessKeyID and SecretAccessKey`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			[OCSPStorage]
+			`+body))), "parsing OCSPStorage: "+msg)
+	}
+}
+
+func TestOCSPFetchConfig(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+		[OCSPFetch]
+		  Proxy = "http://proxy.internal:3128"
+		  CABundle = "/etc/ssl/corp.pem"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, &OCSPFetchConfig{
+		Proxy:    "http://proxy.internal:3128",
+		CABundle: "/etc/ssl/corp.pem",
+		Timeout:  60 * time.Second,
+	}, config.OCSPFetch)
+}
+
+func TestOCSPFetchErrors(t *testing.T) {
+	for body, msg := range map[string]string{
+		`Proxy = "ftp://proxy.internal"`: `Proxy must be an http, https or socks5 URL: ftp://proxy.internal`,
+		`Proxy = "http:///"`:             `Proxy must have a host: http:///`,
+		`Timeout = "-1s"`:                `Timeout must not be negative`,
+	} {
+		assert.Contains(t, errorFrom(ReadConfig([]byte(`
+			CertFile = "cert.pem"
+			KeyFile = "key.pem"
+			OCSPCache = "/tmp/ocsp"
+			[[URLSet]]
+			  [URLSet.Sign]
+			    Domain = "example.com"
+			[OCSPFetch]
+			`+body))), "parsing OCSPFetch: "+msg)
+	}
+}
+
+func TestCertChainsWithoutTopLevel(t *testing.T) {
+	config, err := ReadConfig([]byte(`
+		[[CertChain]]
+		  CertFile = "cert.pem"
+		  KeyFile = "key.pem"
+		  OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))
+	require.NoError(t, err)
+	assert.Equal(t, []CertChain{
+		{CertFile: "cert.pem", KeyFile: "key.pem", OCSPCache: "/tmp/ocsp"},
+	}, config.CertChains())
+}
+
+func TestCertChainMissingKeyFile(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[CertChain]]
+		  CertFile = "cert2.pem"
+		  OCSPCache = "/tmp/ocsp2"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "parsing CertChain.0: must specify KeyFile")
+}
+
+func TestCertChainDuplicateOCSPCache(t *testing.T) {
+	assert.Contains(t, errorFrom(ReadConfig([]byte(`
+		CertFile = "cert.pem"
+		KeyFile = "key.pem"
+		OCSPCache = "/tmp/ocsp"
+		[[CertChain]]
+		  CertFile = "cert2.pem"
+		  KeyFile = "key2.pem"
+		  OCSPCache = "/tmp/ocsp"
+		[[URLSet]]
+		  [URLSet.Sign]
+		    Domain = "example.com"
+	`))), "OCSPCache must be unique per cert chain: /tmp/ocsp")
+}
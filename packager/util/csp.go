@@ -0,0 +1,91 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The directives of the publisher's Content-Security-Policy that AMP caches
+// allow to have any value, per docs/cache_requirements.md. (report-uri is also
+// allowed, but the signer always overrides it.) All others are overridden or
+// stripped by the signer.
+var CSPPassthroughDirectives = []string{
+	"base-uri",
+	"block-all-mixed-content",
+	"font-src",
+	"form-action",
+	"manifest-src",
+	"referrer",
+	"upgrade-insecure-requests",
+}
+
+// Configures how the signer mutates the publisher's Content-Security-Policy
+// before signing. See signer.MutateContentSecurityPolicy.
+type CSPConfig struct {
+	// The directives to preserve from the publisher's CSP. Must be a subset
+	// of CSPPassthroughDirectives. Defaults to all of them.
+	KeepDirectives []string
+	// Sources to append to the publisher's font-src directive, if it has
+	// one. Requires font-src in KeepDirectives.
+	ExtraFontSrc []string
+}
+
+// Matches a CSP host-source
+// (https://w3c.github.io/webappsec-csp/#grammardef-host-source) with an https
+// scheme, and optional port and path. Wildcards are allowed only as the
+// leftmost host label, and keywords (e.g. 'unsafe-eval'), nonces, and hashes
+// are disallowed, so that the extra sources can't weaken the CSP beyond
+// allowing resources from specific origins.
+var cspHTTPSHostSource = regexp.MustCompile(`^https://(\*\.)?[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*(:[0-9]+)?(/[^\s;,'"]*)?$`)
+
+func validateCSPSources(sources []string) error {
+	for _, source := range sources {
+		if !cspHTTPSHostSource.MatchString(source) {
+			return errors.Errorf("source must be an https host-source: %q", source)
+		}
+	}
+	return nil
+}
+
+// Also sets defaults.
+func validateCSP(csp *CSPConfig) error {
+	if csp.KeepDirectives == nil {
+		csp.KeepDirectives = append([]string{}, CSPPassthroughDirectives...)
+	}
+	keepsFontSrc := false
+	for i, directive := range csp.KeepDirectives {
+		directive = strings.ToLower(directive)
+		csp.KeepDirectives[i] = directive
+		allowed := false
+		for _, passthrough := range CSPPassthroughDirectives {
+			allowed = allowed || directive == passthrough
+		}
+		if !allowed {
+			return errors.Errorf("KeepDirectives must be a subset of %v, per the AMP cache requirements: %q", CSPPassthroughDirectives, directive)
+		}
+		keepsFontSrc = keepsFontSrc || directive == "font-src"
+	}
+	if len(csp.ExtraFontSrc) > 0 && !keepsFontSrc {
+		return errors.New("ExtraFontSrc requires font-src in KeepDirectives")
+	}
+	if err := validateCSPSources(csp.ExtraFontSrc); err != nil {
+		return errors.Wrap(err, "ExtraFontSrc")
+	}
+	return nil
+}
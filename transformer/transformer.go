@@ -18,6 +18,8 @@
 package transformer
 
 import (
+	"bytes"
+	"io"
 	"math"
 	"net/url"
 	"regexp"
@@ -41,19 +43,20 @@ import (
 // NOTE: The string mapping is necessary as a language cross-over to
 // allow explicit transformer invocation (via the CUSTOM config).
 var transformerFunctionMap = map[string]func(*transformers.Context) error{
-	"absoluteurl":           transformers.AbsoluteURL,
-	"ampboilerplate":        transformers.AMPBoilerplate,
-	"ampruntimecss":         transformers.AMPRuntimeCSS,
-	"linktag":               transformers.LinkTag,
-	"nodecleanup":           transformers.NodeCleanup,
-	"preloadimage":          transformers.PreloadImage,
-	"reorderhead":           transformers.ReorderHead,
-	"serversiderendering":   transformers.ServerSideRendering,
-	"stripjs":               transformers.StripJS,
-	"stripscriptcomments":   transformers.StripScriptComments,
-	"transformedidentifier": transformers.TransformedIdentifier,
-	"unusedextensions":      transformers.UnusedExtensions,
-	"urlrewrite":            transformers.URLRewrite,
+	"absoluteurl":               transformers.AbsoluteURL,
+	"ampboilerplate":            transformers.AMPBoilerplate,
+	"ampruntimecss":             transformers.AMPRuntimeCSS,
+	"linktag":                   transformers.LinkTag,
+	"nodecleanup":               transformers.NodeCleanup,
+	"preloadimage":              transformers.PreloadImage,
+	"reorderhead":               transformers.ReorderHead,
+	"selftransformedidentifier": transformers.SelfTransformedIdentifier,
+	"serversiderendering":       transformers.ServerSideRendering,
+	"stripjs":                   transformers.StripJS,
+	"stripscriptcomments":       transformers.StripScriptComments,
+	"transformedidentifier":     transformers.TransformedIdentifier,
+	"unusedextensions":          transformers.UnusedExtensions,
+	"urlrewrite":                transformers.URLRewrite,
 }
 
 // The map of config to the list of transformers, in the order in
@@ -150,8 +153,8 @@ func isAllowed(declaredFormat string, allowedFormats []rpb.Request_HtmlFormat) b
 }
 
 // setDOM parses the input HTML and sets c.DOM to the parsed DOM struct.
-func setDOM(c *transformers.Context, s string) error {
-	doc, err := html.Parse(strings.NewReader(s))
+func setDOM(c *transformers.Context, r io.Reader) error {
+	doc, err := html.Parse(r)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing input HTML")
 	}
@@ -321,18 +324,36 @@ func computeMaxAgeSeconds(dom *amphtml.DOM) int32 {
 //
 // If the requested list of transformers is empty, apply the default.
 func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
-	context := &transformers.Context{}
-
 	if err := validateUTF8ForHTML(r.Html); err != nil {
 		return "", nil, err
 	}
-
-	if err := setDOM(context, r.Html); err != nil {
+	var o strings.Builder
+	metadata, err := process(&o, r, strings.NewReader(r.Html))
+	if err != nil {
 		return "", nil, err
 	}
+	return o.String(), metadata, nil
+}
+
+// ProcessBytes is like Process, but transforms the given HTML instead of
+// r.Html, and prints the result to w. This avoids copying the HTML to and from
+// strings; if w is a *bytes.Buffer, it's printed directly into it.
+func ProcessBytes(w io.Writer, r *rpb.Request, html []byte) (*rpb.Metadata, error) {
+	if err := validateUTF8BytesForHTML(html); err != nil {
+		return nil, err
+	}
+	return process(w, r, bytes.NewReader(html))
+}
+
+func process(w io.Writer, r *rpb.Request, html io.Reader) (*rpb.Metadata, error) {
+	context := &transformers.Context{}
+
+	if err := setDOM(context, html); err != nil {
+		return nil, err
+	}
 
 	if err := requireAMPAttribute(context.DOM, r.AllowedFormats); err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
 	fns := configMap[r.Config]
@@ -340,7 +361,7 @@ func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
 		for _, val := range r.Transformers {
 			fn, ok := transformerFunctionMap[strings.ToLower(val)]
 			if !ok {
-				return "", nil, errors.Errorf("transformer doesn't exist: %s", val)
+				return nil, errors.Errorf("transformer doesn't exist: %s", val)
 			}
 			fns = append(fns, fn)
 		}
@@ -348,7 +369,7 @@ func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
 
 	documentURL, err := url.Parse(r.DocumentUrl)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 	context.DocumentURL = documentURL
 
@@ -356,7 +377,7 @@ func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
 	if r.Version == 0 {
 		version, err := SelectVersion(nil)
 		if err != nil {
-			return "", nil, err
+			return nil, err
 		}
 		context.Version = version
 	}
@@ -365,17 +386,16 @@ func Process(r *rpb.Request) (string, *rpb.Metadata, error) {
 	setBaseURL(context)
 
 	if err := runTransformers(context, fns); err != nil {
-		return "", nil, err
+		return nil, err
 	}
 	// extractPreloads is an implicit transformer, and must run before printer.
 	preloads := extractPreloads(context.DOM)
-	var o strings.Builder
-	if err := printer.Print(&o, context.DOM.RootNode); err != nil {
-		return "", nil, err
+	if err := printer.Print(w, context.DOM.RootNode); err != nil {
+		return nil, err
 	}
 	metadata := rpb.Metadata{
 		Preloads:   preloads,
 		MaxAgeSecs: computeMaxAgeSeconds(context.DOM),
 	}
-	return o.String(), &metadata, nil
+	return &metadata, nil
 }
@@ -1,6 +1,7 @@
 package transformer
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -58,6 +59,28 @@ func TestProcess(t *testing.T) {
 	}
 }
 
+func TestProcessBytes(t *testing.T) {
+	html := "<html ⚡><lemur>"
+	r := rpb.Request{Html: "ignored", Config: rpb.Request_NONE}
+	var o bytes.Buffer
+	o.WriteString("prefix:")
+	metadata, err := ProcessBytes(&o, &r, []byte(html))
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+
+	expected, _, err := Process(&rpb.Request{Html: html, Config: rpb.Request_NONE})
+	if err != nil {
+		t.Fatalf("unexpected failure %v", err)
+	}
+	if got := o.String(); got != "prefix:"+expected {
+		t.Errorf("got = %q, want = %q", got, "prefix:"+expected)
+	}
+	if metadata == nil {
+		t.Error("metadata unexpectedly nil")
+	}
+}
+
 func TestPreloads(t *testing.T) {
 	// Programmatically prepare the `> maxPreloads` test case.
 	var manyScriptsHTML strings.Builder
@@ -359,6 +382,14 @@ func TestInvalidUTF8(t *testing.T) {
 			if err.Error() != tc.expectedError {
 				t.Fatalf("mismatched error. got=%s, want=%s", err.Error(), tc.expectedError)
 			}
+
+			_, err = ProcessBytes(&bytes.Buffer{}, &r, []byte(tc.html))
+			if err == nil {
+				t.Fatal("ProcessBytes unexpected success")
+			}
+			if err.Error() != tc.expectedError {
+				t.Fatalf("ProcessBytes mismatched error. got=%s, want=%s", err.Error(), tc.expectedError)
+			}
 		})
 	}
 }
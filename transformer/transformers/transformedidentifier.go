@@ -30,3 +30,11 @@ func TransformedIdentifier(e *Context) error {
 	htmlnode.SetAttribute(e.DOM.HTMLNode, "", "transformed", v)
 	return nil
 }
+
+// SelfTransformedIdentifier identifies that transformations were made by the
+// publisher, for serving the document from its own origin rather than from an
+// AMP cache.
+func SelfTransformedIdentifier(e *Context) error {
+	htmlnode.SetAttribute(e.DOM.HTMLNode, "", "transformed", "self;v=1")
+	return nil
+}
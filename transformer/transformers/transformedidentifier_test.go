@@ -85,3 +85,34 @@ func TestTransformedIdentifier(t *testing.T) {
 		}
 	}
 }
+
+func TestSelfTransformedIdentifier(t *testing.T) {
+	input := tt.Concat(tt.Doctype, "<html ⚡><head>", tt.MetaCharset, "</head><body></body></html>")
+	expected := tt.Concat(tt.Doctype, "<html ⚡=\"\" transformed=\"self;v=1\"><head>", tt.MetaCharset, "</head><body></body></html>")
+	inputDoc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("html.Parse for %s failed %q", input, err)
+	}
+	inputDOM, err := amphtml.NewDOM(inputDoc)
+	if err != nil {
+		t.Fatalf("amphtml.NewDOM for %s failed %q", input, err)
+	}
+	// The version of the transforms doesn't affect the identifier.
+	transformers.SelfTransformedIdentifier(&transformers.Context{DOM: inputDOM, Version: 5})
+
+	var output strings.Builder
+	if err := html.Render(&output, inputDoc); err != nil {
+		t.Fatalf("html.Render for %s failed %q", input, err)
+	}
+	expectedDoc, err := html.Parse(strings.NewReader(expected))
+	if err != nil {
+		t.Fatalf("html.Parse for %s failed %q", expected, err)
+	}
+	var want strings.Builder
+	if err := html.Render(&want, expectedDoc); err != nil {
+		t.Fatalf("html.Render for %s failed %q", expected, err)
+	}
+	if output.String() != want.String() {
+		t.Errorf("SelfTransformedIdentifier=\n%q\nwant=\n%q", &output, &want)
+	}
+}
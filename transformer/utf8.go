@@ -55,3 +55,20 @@ func validateUTF8ForHTML(html string) error {
 	}
 	return nil
 }
+
+// validateUTF8BytesForHTML is like validateUTF8ForHTML, but for a byte slice,
+// to avoid copying it to a string.
+func validateUTF8BytesForHTML(html []byte) error {
+	pos := 0
+	for pos < len(html) {
+		r, width := utf8.DecodeRune(html[pos:])
+		if r == utf8.RuneError && width < 2 {
+			return errors.Errorf("invalid UTF-8 at byte position %d", pos)
+		}
+		if !isHTMLValid(r) {
+			return errors.Errorf("character U+%04x at position %d is not allowed in AMPHTML", r, pos)
+		}
+		pos += width
+	}
+	return nil
+}